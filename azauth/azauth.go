@@ -28,6 +28,7 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/azure/auth"
 )
 
@@ -54,3 +55,12 @@ func Load(url string) autorest.Authorizer {
 	}
 	return authorizer
 }
+
+// ARMClient returns a plain Azure Resource Manager client, for APIs that are
+// newer than the Azure SDK we use.
+func ARMClient() autorest.Client {
+	client := autorest.NewClientWithUserAgent("flamenco-manager-azure")
+	client.Authorizer = Load(azure.PublicCloud.ResourceManagerEndpoint)
+	client.Sender = Sender()
+	return client
+}
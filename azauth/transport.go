@@ -0,0 +1,146 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azauth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// transport is used for all HTTP traffic to Azure; see ConfigureHTTP().
+var transport = newTransport(httpproxy.FromEnvironment(), nil)
+
+// ConfigureHTTP sets up the proxy and trusted CA certificates for all HTTP traffic.
+// Call this before making any request to Azure.
+func ConfigureHTTP(config azconfig.AZConfig) {
+	proxyConfig := httpproxy.FromEnvironment()
+	proxyConfig.HTTPSProxy = config.HTTPSProxy()
+	proxyConfig.NoProxy = config.NoProxy()
+
+	logger := logrus.WithFields(logrus.Fields{
+		"httpsProxy": proxyConfig.HTTPSProxy,
+		"noProxy":    proxyConfig.NoProxy,
+	})
+
+	var rootCAs *x509.CertPool
+	if caBundle := config.CABundlePath(); caBundle != "" {
+		logger = logger.WithField("caBundle", caBundle)
+		rootCAs = loadCABundle(logger, caBundle)
+	}
+
+	transport = newTransport(proxyConfig, rootCAs)
+	// The authentication library and other code using the default client should behave the same.
+	http.DefaultTransport = transport
+	// So should the Azure CLI, which is used to create the credentials file.
+	setEnv(logger, "HTTPS_PROXY", proxyConfig.HTTPSProxy)
+	setEnv(logger, "NO_PROXY", proxyConfig.NoProxy)
+	setEnv(logger, "REQUESTS_CA_BUNDLE", config.CABundlePath())
+	if proxyConfig.HTTPSProxy != "" || rootCAs != nil {
+		logger.Info("using custom HTTPS settings")
+	}
+}
+
+// HTTPClient returns an HTTP client that uses the configured proxy and CA certificates.
+func HTTPClient() *http.Client {
+	return &http.Client{Transport: transport}
+}
+
+// Sender returns the sender for Azure SDK clients, so that they use the configured proxy and CA certificates.
+func Sender() autorest.Sender {
+	return HTTPClient()
+}
+
+// PipelineSender returns the sender for azure-pipeline-go pipelines, such as the one of the Azure Files SDK.
+func PipelineSender() pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			response, err := HTTPClient().Do(request.WithContext(ctx))
+			if err != nil {
+				err = pipeline.NewError(err, "HTTP request failed")
+			}
+			return pipeline.NewHTTPResponse(response), err
+		}
+	})
+}
+
+func newTransport(proxyConfig *httpproxy.Config, rootCAs *x509.CertPool) *http.Transport {
+	proxyFunc := proxyConfig.ProxyFunc()
+	return &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		},
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    rootCAs,
+		},
+	}
+}
+
+func setEnv(logger *logrus.Entry, name, value string) {
+	if value == "" {
+		return
+	}
+	if err := os.Setenv(name, value); err != nil {
+		logger.WithField("variable", name).WithError(err).Fatal("unable to set environment variable")
+	}
+}
+
+// loadCABundle returns the system's trusted CA certificates plus the ones in the bundle.
+func loadCABundle(logger *logrus.Entry, caBundle string) *x509.CertPool {
+	pemCerts, err := ioutil.ReadFile(caBundle)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to read CA bundle")
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		logger.WithField("reason", err).Warning("unable to load system CA certificates, only trusting the CA bundle")
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		logger.Fatal("no certificates found in CA bundle")
+	}
+	return pool
+}
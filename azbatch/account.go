@@ -37,6 +37,7 @@ import (
 func getBatchAccountClient(config azconfig.AZConfig) batchARM.AccountClient {
 	accountClient := batchARM.NewAccountClient(config.SubscriptionID)
 	accountClient.Authorizer = azauth.Load(azure.PublicCloud.ResourceManagerEndpoint)
+	accountClient.Sender = azauth.Sender()
 	// accountClient.RequestInspector = azdebug.LogRequest()
 	// accountClient.ResponseInspector = azdebug.LogResponse()
 	return accountClient
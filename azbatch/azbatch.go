@@ -25,6 +25,7 @@ package azbatch
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/batch/2018-12-01.8.0/batch"
@@ -39,21 +40,80 @@ import (
 func getPoolClient(batchURL string) batch.PoolClient {
 	poolClient := batch.NewPoolClient(batchURL)
 	poolClient.Authorizer = azauth.Load(azure.PublicCloud.BatchManagementEndpoint)
+	poolClient.Sender = azauth.Sender()
 	// poolClient.RequestInspector = azdebug.LogRequest()
 	// poolClient.ResponseInspector = azdebug.LogResponse()
 	return poolClient
 }
 
+func getComputeNodeClient(batchURL string) batch.ComputeNodeClient {
+	nodeClient := batch.NewComputeNodeClient(batchURL)
+	nodeClient.Authorizer = azauth.Load(azure.PublicCloud.BatchManagementEndpoint)
+	nodeClient.Sender = azauth.Sender()
+	return nodeClient
+}
+
+func getAccountDataClient(batchURL string) batch.AccountClient {
+	accountClient := batch.NewAccountClient(batchURL)
+	accountClient.Authorizer = azauth.Load(azure.PublicCloud.BatchManagementEndpoint)
+	accountClient.Sender = azauth.Sender()
+	return accountClient
+}
+
 // CreatePool starts a pool of Flamenco Workers.
 func CreatePool(config azconfig.AZConfig, netStack aznetwork.NetworkStack) {
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(1*time.Minute))
 	defer cancel()
 
-	poolParams := PoolParameters(config, netStack)
 	batchURL := constructBatchURL(config)
+	nodeAgentSKUID := findNodeAgentSKU(ctx, batchURL, config.Batch.WorkerOSImage())
+	poolParams := PoolParameters(config, netStack, nodeAgentSKUID)
 	createPoolIfNotExist(ctx, batchURL, poolParams)
 }
 
+// findNodeAgentSKU returns the ID of the Batch node agent SKU that supports the given image.
+// The image has to be one of the images verified by Azure Batch.
+func findNodeAgentSKU(ctx context.Context, batchURL string, image azconfig.AZImageConfig) string {
+	logger := logrus.WithFields(logrus.Fields{
+		"publisher": image.Publisher,
+		"offer":     image.Offer,
+		"sku":       image.SKU,
+	})
+	logger.Debug("finding Batch node agent for worker image")
+
+	accountClient := getAccountDataClient(batchURL)
+	iter, err := accountClient.ListNodeAgentSkusComplete(ctx, "", nil, nil, nil, nil, nil)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to list Batch node agent SKUs")
+	}
+
+	supported := []string{}
+	for iter.NotDone() {
+		agentSKU := iter.Value()
+		if agentSKU.VerifiedImageReferences != nil && agentSKU.OsType == batch.Linux {
+			for _, ref := range *agentSKU.VerifiedImageReferences {
+				if ref.Publisher == nil || ref.Offer == nil || ref.Sku == nil {
+					continue
+				}
+				if strings.EqualFold(*ref.Publisher, image.Publisher) &&
+					strings.EqualFold(*ref.Offer, image.Offer) &&
+					strings.EqualFold(*ref.Sku, image.SKU) {
+					logger.WithField("nodeAgentSKUID", *agentSKU.ID).Info("found Batch node agent for worker image")
+					return *agentSKU.ID
+				}
+				supported = append(supported, fmt.Sprintf("%s/%s/%s", *ref.Publisher, *ref.Offer, *ref.Sku))
+			}
+		}
+		if err := iter.NextWithContext(ctx); err != nil {
+			logger.WithError(err).Fatal("unable to get next page of Batch node agent SKUs")
+		}
+	}
+
+	logger.WithField("supportedImages", strings.Join(supported, ", ")).
+		Fatal("worker image is not supported by Azure Batch")
+	return ""
+}
+
 func constructBatchURL(config azconfig.AZConfig) string {
 	return fmt.Sprintf("https://%s.%s.batch.azure.com", config.BatchAccountName, config.Location)
 }
@@ -34,19 +34,26 @@ import (
 	"github.com/Azure/flamenco-manager-azure/azconfig"
 	"github.com/Azure/flamenco-manager-azure/aznetwork"
 	"github.com/Azure/flamenco-manager-azure/azstorage"
+	"github.com/Azure/flamenco-manager-azure/azvm"
 	"github.com/Azure/flamenco-manager-azure/textio"
 )
 
 // AskParametersAndSave asks the user for the batch pool parameters and saves them in the config.
 func AskParametersAndSave(ctx context.Context, config *azconfig.AZConfig, defaultPoolName string) {
 	if config.Batch != nil && config.Batch.PoolID != "" && config.Batch.VMSize != "" {
-		logrus.WithFields(logrus.Fields{
+		logger := logrus.WithFields(logrus.Fields{
 			"poolID":                 config.Batch.PoolID,
 			"vmSize":                 config.Batch.VMSize,
 			"targetDedicatedNodes":   config.Batch.TargetDedicatedNodes,
 			"targetLowPriorityNodes": config.Batch.TargetLowPriorityNodes,
-		}).Info("batch pool config loaded")
-		return
+		})
+		sizes := SupportedVMSizes(ctx, *config, azvm.ListVMSizes(ctx, *config))
+		if _, found := azvm.FindVMSize(sizes, config.Batch.VMSize); found {
+			logger.Info("batch pool config loaded")
+			return
+		}
+		logger.Error("batch pool VM size is not available in this location")
+		defaultPoolName = config.Batch.PoolID
 	}
 
 	poolID := textio.ReadLineWithDefault(ctx, "Desired batch pool ID", defaultPoolName)
@@ -56,25 +63,33 @@ func AskParametersAndSave(ctx context.Context, config *azconfig.AZConfig, defaul
 
 	fmt.Println()
 	fmt.Println("For sizes, see https://docs.microsoft.com/azure/batch/batch-pool-vm-sizes")
-	vmSize := textio.ReadLine(ctx, "Batch pool VM size for Flamenco workers [Standard_F16s]")
-	if vmSize == "" {
-		vmSize = "Standard_F16s"
-	}
+	sizes := SupportedVMSizes(ctx, *config, azvm.ListVMSizes(ctx, *config))
+	vmSize := azvm.ChooseVMSize(ctx, sizes, "Batch pool VM size for Flamenco workers", "Standard_F16s")
 
-	targetDedicatedNodes := textio.ReadNonNegativeInt(ctx, "Number of dedicated Flamenco worker VMs [0]", true)
-	targetLowPriorityNodes := textio.ReadNonNegativeInt(ctx, "Number of low-priority Flamenco worker VMs [0]", true)
+	var targetDedicatedNodes, targetLowPriorityNodes int
+	for {
+		targetDedicatedNodes = textio.ReadNonNegativeInt(ctx, "Number of dedicated Flamenco worker VMs [0]", true)
+		targetLowPriorityNodes = textio.ReadNonNegativeInt(ctx, "Number of low-priority Flamenco worker VMs [0]", true)
+		if checkAccountQuota(ctx, *config, vmSize, targetDedicatedNodes, targetLowPriorityNodes) {
+			break
+		}
+		fmt.Println("Choose fewer VMs, or request a quota increase for the batch account in the Azure portal.")
+	}
 
-	config.Batch = &azconfig.AZBatchConfig{
-		PoolID:                 poolID,
-		VMSize:                 vmSize,
-		TargetDedicatedNodes:   int32(targetDedicatedNodes),
-		TargetLowPriorityNodes: int32(targetLowPriorityNodes),
+	// Keep other settings of the pool, such as its image.
+	if config.Batch == nil {
+		config.Batch = &azconfig.AZBatchConfig{}
 	}
+	config.Batch.PoolID = poolID
+	config.Batch.VMSize = vmSize.Name
+	config.Batch.TargetDedicatedNodes = int32(targetDedicatedNodes)
+	config.Batch.TargetLowPriorityNodes = int32(targetLowPriorityNodes)
 	config.Save()
 }
 
 // PoolParameters returns the batch pool parameters.
-func PoolParameters(config azconfig.AZConfig, netStack aznetwork.NetworkStack) batch.PoolAddParameter {
+func PoolParameters(config azconfig.AZConfig, netStack aznetwork.NetworkStack, nodeAgentSKUID string) batch.PoolAddParameter {
+	image := config.Batch.WorkerOSImage()
 	mountOpts := azstorage.GetMountOptions(config, "flamenco-resources")
 	startCmd := fmt.Sprintf("bash -exc 'sudo mkdir -p /mnt/flamenco-resources; "+
 		"sudo groupadd --force %s; "+
@@ -94,12 +109,12 @@ func PoolParameters(config azconfig.AZConfig, netStack aznetwork.NetworkStack) b
 
 		VirtualMachineConfiguration: &batch.VirtualMachineConfiguration{
 			ImageReference: &batch.ImageReference{
-				Publisher: to.StringPtr("Canonical"),
-				Sku:       to.StringPtr("18.04-LTS"),
-				Offer:     to.StringPtr("UbuntuServer"),
-				Version:   to.StringPtr("latest"),
+				Publisher: to.StringPtr(image.Publisher),
+				Sku:       to.StringPtr(image.SKU),
+				Offer:     to.StringPtr(image.Offer),
+				Version:   to.StringPtr(image.Version),
 			},
-			NodeAgentSKUID: to.StringPtr("batch.node.ubuntu 18.04"),
+			NodeAgentSKUID: to.StringPtr(nodeAgentSKUID),
 		},
 
 		NetworkConfiguration: &batch.NetworkConfiguration{
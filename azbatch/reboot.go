@@ -0,0 +1,147 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azbatch
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/batch/2018-12-01.8.0/batch"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	rebootPollInterval = 10 * time.Second
+	rebootTimeout      = 20 * time.Minute
+)
+
+// RollingReboot reboots the nodes of the Flamenco Worker pool, batchSize at a time. Rebooting runs
+// the start task again, which restarts Flamenco Worker from the resources share. The next nodes
+// are only rebooted when the previous ones are back; a failing start task stops the reboot.
+// Nodes that are not idle or running, for example because they are still starting, are skipped.
+func RollingReboot(ctx context.Context, config azconfig.AZConfig, batchSize int) {
+	if config.BatchAccountName == "" || config.Batch == nil || config.Batch.PoolID == "" {
+		logrus.Warning("no Azure Batch pool configured, not rebooting its nodes")
+		return
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	poolID := config.Batch.PoolID
+	logger := logrus.WithField("poolID", poolID)
+	nodeClient := getComputeNodeClient(constructBatchURL(config))
+
+	nodeIDs := []string{}
+	// A node is back from its reboot once it has booted after this time.
+	bootedBefore := map[string]time.Time{}
+	page, err := nodeClient.List(ctx, poolID, "", "id,state,lastBootTime", nil, nil, nil, nil, nil)
+	for ; err == nil && page.NotDone(); err = page.NextWithContext(ctx) {
+		for _, node := range page.Values() {
+			if node.State != batch.Idle && node.State != batch.Running {
+				logger.WithFields(logrus.Fields{
+					"nodeID": *node.ID,
+					"state":  node.State,
+				}).Info("skipping node that is not idle or running")
+				continue
+			}
+			nodeIDs = append(nodeIDs, *node.ID)
+			if node.LastBootTime != nil {
+				bootedBefore[*node.ID] = node.LastBootTime.Time
+			}
+		}
+	}
+	if err != nil {
+		logger.WithError(err).Fatal("unable to list nodes of Azure Batch pool")
+	}
+	if len(nodeIDs) == 0 {
+		logger.Info("no nodes to reboot")
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"numNodes":  len(nodeIDs),
+		"batchSize": batchSize,
+	}).Info("rebooting nodes of Azure Batch pool")
+	for start := 0; start < len(nodeIDs); start += batchSize {
+		end := start + batchSize
+		if end > len(nodeIDs) {
+			end = len(nodeIDs)
+		}
+		for _, nodeID := range nodeIDs[start:end] {
+			if _, found := bootedBefore[nodeID]; !found {
+				bootedBefore[nodeID] = time.Now()
+			}
+			logger.WithField("nodeID", nodeID).Info("rebooting node")
+			_, err := nodeClient.Reboot(ctx, poolID, nodeID, &batch.NodeRebootParameter{
+				NodeRebootOption: batch.ComputeNodeRebootOptionRequeue,
+			}, nil, nil, nil, nil)
+			if err != nil {
+				logger.WithField("nodeID", nodeID).WithError(err).Fatal("unable to reboot node")
+			}
+		}
+		for _, nodeID := range nodeIDs[start:end] {
+			waitForRebootedNode(ctx, nodeClient, poolID, nodeID, bootedBefore[nodeID], logger.WithField("nodeID", nodeID))
+		}
+	}
+	logger.Info("all nodes rebooted")
+}
+
+// waitForRebootedNode waits until the node has booted after bootedBefore and the start task succeeded.
+// The boot time is compared rather than the states seen while polling, as a quick reboot can
+// happen entirely between two polls.
+func waitForRebootedNode(ctx context.Context, nodeClient batch.ComputeNodeClient, poolID, nodeID string,
+	bootedBefore time.Time, logger *logrus.Entry) {
+	deadline := time.Now().Add(rebootTimeout)
+	for {
+		node, err := nodeClient.Get(ctx, poolID, nodeID, "id,state,lastBootTime", nil, nil, nil, nil)
+		if err != nil {
+			logger.WithError(err).Fatal("unable to retrieve node")
+		}
+
+		switch node.State {
+		case batch.Idle, batch.Running:
+			// Right after the reboot request, the node may not have left these states yet.
+			if node.LastBootTime != nil && node.LastBootTime.After(bootedBefore) {
+				logger.WithField("lastBootTime", node.LastBootTime.Time).Info("node is back")
+				return
+			}
+		case batch.Preempted:
+			// The low-priority node is gone; it gets the new Worker when it is allocated again.
+			logger.Info("node was preempted while rebooting")
+			return
+		case batch.StartTaskFailed, batch.Unusable:
+			logger.WithField("state", node.State).Fatal("node did not come back after rebooting; see the start task output in the Azure portal")
+		}
+
+		if time.Now().After(deadline) {
+			logger.WithField("state", node.State).Fatal("timeout waiting for node to reboot")
+		}
+		select {
+		case <-ctx.Done():
+			logger.Fatal("aborted")
+		case <-time.After(rebootPollInterval):
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azbatch
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/batch/2018-12-01.8.0/batch"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/sirupsen/logrus"
+)
+
+// ScalePool sets the target number of nodes of the Flamenco Worker pool.
+// Running tasks are requeued when nodes are removed. A resize that is still in progress is stopped first.
+func ScalePool(ctx context.Context, config azconfig.AZConfig, dedicatedNodes, lowPriorityNodes int32) {
+	if config.BatchAccountName == "" || config.Batch == nil || config.Batch.PoolID == "" {
+		logrus.Warning("no Azure Batch pool configured, not scaling it")
+		return
+	}
+
+	logger := logrus.WithFields(logrus.Fields{
+		"poolID":                 config.Batch.PoolID,
+		"targetDedicatedNodes":   dedicatedNodes,
+		"targetLowPriorityNodes": lowPriorityNodes,
+	})
+	poolClient := getPoolClient(constructBatchURL(config))
+
+	pool, err := poolClient.Get(ctx, config.Batch.PoolID, "", "", nil, nil, nil, nil, "", "", nil, nil)
+	if err != nil {
+		if pool.StatusCode == 404 {
+			logger.Warning("Azure Batch pool does not exist, not scaling it")
+			return
+		}
+		logger.WithError(err).Fatal("unable to retrieve Azure Batch pool")
+	}
+	if pool.AllocationState == batch.Resizing {
+		logger.Info("stopping resize that is still in progress")
+		if _, err := poolClient.StopResize(ctx, config.Batch.PoolID, nil, nil, nil, nil, "", "", nil, nil); err != nil {
+			logger.WithError(err).Fatal("unable to stop resizing Azure Batch pool")
+		}
+		waitForSteadyPool(ctx, poolClient, config.Batch.PoolID, logger)
+	}
+
+	logger.Info("scaling Azure Batch pool")
+	_, err = poolClient.Resize(ctx, config.Batch.PoolID, batch.PoolResizeParameter{
+		TargetDedicatedNodes:   to.Int32Ptr(dedicatedNodes),
+		TargetLowPriorityNodes: to.Int32Ptr(lowPriorityNodes),
+		NodeDeallocationOption: batch.Requeue,
+	}, nil, nil, nil, nil, "", "", nil, nil)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to scale Azure Batch pool")
+	}
+}
+
+// PoolTargets returns the current target number of nodes of the Flamenco Worker pool.
+// Returns nil when there is no pool.
+func PoolTargets(ctx context.Context, config azconfig.AZConfig) *azconfig.AZPoolTargets {
+	if config.BatchAccountName == "" || config.Batch == nil || config.Batch.PoolID == "" {
+		return nil
+	}
+	logger := logrus.WithField("poolID", config.Batch.PoolID)
+	poolClient := getPoolClient(constructBatchURL(config))
+
+	pool, err := poolClient.Get(ctx, config.Batch.PoolID, "targetDedicatedNodes,targetLowPriorityNodes",
+		"", nil, nil, nil, nil, "", "", nil, nil)
+	if err != nil {
+		if pool.StatusCode == 404 {
+			return nil
+		}
+		logger.WithError(err).Fatal("unable to retrieve Azure Batch pool")
+	}
+	return &azconfig.AZPoolTargets{
+		DedicatedNodes:   to.Int32(pool.TargetDedicatedNodes),
+		LowPriorityNodes: to.Int32(pool.TargetLowPriorityNodes),
+	}
+}
+
+func waitForSteadyPool(ctx context.Context, poolClient batch.PoolClient, poolID string, logger *logrus.Entry) {
+	for {
+		pool, err := poolClient.Get(ctx, poolID, "allocationState", "", nil, nil, nil, nil, "", "", nil, nil)
+		if err != nil {
+			logger.WithError(err).Fatal("unable to retrieve Azure Batch pool")
+		}
+		if pool.AllocationState == batch.Steady {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Fatal("aborted")
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
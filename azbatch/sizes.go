@@ -0,0 +1,156 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azbatch
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/flamenco-manager-azure/azauth"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/flamenco-manager-azure/azvm"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/sirupsen/logrus"
+)
+
+// The Batch management API version of the Azure SDK we use cannot list supported VM sizes.
+const supportedSkusAPIVersion = "2021-06-01"
+
+type supportedSkuList struct {
+	Value []struct {
+		Name string `json:"name"`
+	} `json:"value"`
+	NextLink string `json:"nextLink"`
+}
+
+// SupportedVMSizes returns those sizes that can be used for Batch pools in the configured location.
+// When the list of supported sizes cannot be fetched, all sizes are returned.
+func SupportedVMSizes(ctx context.Context, config azconfig.AZConfig, sizes []azvm.VMSize) []azvm.VMSize {
+	supported, ok := listSupportedSkus(ctx, config)
+	if !ok {
+		return sizes
+	}
+
+	filtered := []azvm.VMSize{}
+	for _, size := range sizes {
+		if supported[strings.ToLower(size.Name)] {
+			filtered = append(filtered, size)
+		}
+	}
+	return filtered
+}
+
+// listSupportedSkus returns the lower-cased names of the VM sizes supported by Azure Batch.
+func listSupportedSkus(ctx context.Context, config azconfig.AZConfig) (map[string]bool, bool) {
+	logger := logrus.WithField("location", config.Location)
+	logger.Info("fetching VM sizes supported by Azure Batch")
+
+	client := azauth.ARMClient()
+	supported := map[string]bool{}
+
+	req, err := autorest.Prepare((&http.Request{}).WithContext(ctx),
+		autorest.AsGet(),
+		autorest.WithBaseURL(azure.PublicCloud.ResourceManagerEndpoint),
+		autorest.WithPathParameters(
+			"/subscriptions/{subscriptionId}/providers/Microsoft.Batch/locations/{locationName}/virtualMachineSkus",
+			map[string]interface{}{
+				"subscriptionId": autorest.Encode("path", config.SubscriptionID),
+				"locationName":   autorest.Encode("path", config.Location),
+			}),
+		autorest.WithQueryParameters(map[string]interface{}{"api-version": supportedSkusAPIVersion}))
+
+	for err == nil {
+		page := supportedSkuList{}
+		resp, doErr := client.Do(req)
+		if doErr != nil {
+			err = doErr
+			break
+		}
+		err = autorest.Respond(resp,
+			client.ByInspecting(),
+			azure.WithErrorUnlessStatusCode(http.StatusOK),
+			autorest.ByUnmarshallingJSON(&page),
+			autorest.ByClosing())
+		if err != nil {
+			break
+		}
+
+		for _, sku := range page.Value {
+			supported[strings.ToLower(sku.Name)] = true
+		}
+		if page.NextLink == "" {
+			break
+		}
+		req, err = autorest.Prepare((&http.Request{}).WithContext(ctx),
+			autorest.AsGet(),
+			autorest.WithBaseURL(page.NextLink))
+	}
+	if err != nil {
+		logger.WithError(err).Warning("unable to fetch supported VM sizes, not filtering VM sizes")
+		return nil, false
+	}
+
+	logger.WithField("numSizes", len(supported)).Debug("found VM sizes supported by Azure Batch")
+	return supported, true
+}
+
+// checkAccountQuota checks that the requested number of nodes fits in the Batch account core quota.
+// Dedicated and low-priority nodes have separate quotas. Returns false and logs an error if they don't fit.
+func checkAccountQuota(ctx context.Context, config azconfig.AZConfig, size azvm.VMSize, dedicatedNodes, lowPriorityNodes int) bool {
+	logger := logrus.WithFields(logrus.Fields{
+		"batchAccountName": config.BatchAccountName,
+		"vmSize":           size.Name,
+	})
+
+	accountClient := getBatchAccountClient(config)
+	account, err := accountClient.Get(ctx, config.ResourceGroup, config.BatchAccountName)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to fetch batch account")
+	}
+	if account.AccountProperties == nil {
+		logger.Warning("batch account has no properties, unable to check core quota")
+		return true
+	}
+
+	ok := true
+	check := func(kind string, nodes int, quota *int32) {
+		if quota == nil {
+			return
+		}
+		requiredCores := nodes * size.Cores
+		if requiredCores > int(*quota) {
+			logger.WithFields(logrus.Fields{
+				"nodeKind":      kind,
+				"nodes":         nodes,
+				"requiredCores": requiredCores,
+				"coreQuota":     *quota,
+			}).Error("not enough batch account core quota")
+			ok = false
+		}
+	}
+	check("dedicated", dedicatedNodes, account.DedicatedCoreQuota)
+	check("low-priority", lowPriorityNodes, account.LowPriorityCoreQuota)
+	return ok
+}
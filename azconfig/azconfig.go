@@ -36,7 +36,8 @@ import (
 )
 
 const (
-	configFile = "flamenco_manager_azure.yaml"
+	// DefaultFilename is the config file used when no other file is given on the CLI.
+	DefaultFilename = "flamenco_manager_azure.yaml"
 )
 
 // AZBatchConfig has all the batch parameters.
@@ -46,9 +47,20 @@ type AZBatchConfig struct {
 
 	TargetDedicatedNodes   int32 `yaml:"targetDedicatedNodes"`
 	TargetLowPriorityNodes int32 `yaml:"targetLowPriorityNodes"`
+
+	Image *AZImageConfig `yaml:"image,omitempty"` // OS image of the worker VMs; see DefaultImage
+
+	// Targets of the pool before 'vm stop' scaled it down, so that 'vm start' can restore them.
+	StoppedTargets *AZPoolTargets `yaml:"stoppedTargets,omitempty"`
 }
 
-// AZConfig is loaded from 'configFile'
+// AZPoolTargets is the target number of nodes of a batch pool.
+type AZPoolTargets struct {
+	DedicatedNodes   int32 `yaml:"dedicatedNodes"`
+	LowPriorityNodes int32 `yaml:"lowPriorityNodes"`
+}
+
+// AZConfig is loaded from 'DefaultFilename' or another YAML file.
 type AZConfig struct {
 	// File this config was read from, so it can be saved after modification.
 	filename string
@@ -69,24 +81,48 @@ type AZConfig struct {
 	StorageAccountName string `yaml:"storageAccountName,omitempty"`
 	// Name of the Virtual Machine that's going to run Flamenco Manager.
 	VMName string `yaml:"virtualMachine,omitempty"`
+	// SSH known_hosts file for the VM, relative to this config file; see KnownHostsPath().
+	KnownHostsFile string `yaml:"knownHostsFile,omitempty"`
+	// SSH key pair used to access the VM, and extra public keys to install on it.
+	SSH *AZSSHConfig `yaml:"ssh,omitempty"`
+	// OS image of the Flamenco Manager VM; see DefaultImage.
+	ManagerImage *AZImageConfig `yaml:"managerImage,omitempty"`
+	// Optional data disk of the Flamenco Manager VM, for MongoDB and the Manager state.
+	DataDisk *AZDataDiskConfig `yaml:"dataDisk,omitempty"`
+	// How Flamenco Manager is installed on the VM; see ProvisionSSH and ProvisionCloudInit.
+	Provisioning string `yaml:"provisioning,omitempty"`
 	// Worker registration secret; shouldn't change, as we don't overwrite the Manager config if it already exists on the VM.
 	WorkerRegistrationSecret string `yaml:"workerRegistrationSecret,omitempty"`
 
 	// this is set by main.go after creating the storage account.
 	StorageCreds StorageCredentials `yaml:"-"`
+	// Optional network restrictions for the storage account.
+	StorageNetwork *AZStorageNetworkConfig `yaml:"storageNetwork,omitempty"`
 
 	Batch *AZBatchConfig `yaml:"batch,omitempty"`
+
+	// Optional DNS record in an Azure DNS zone, for using a custom domain name instead of the Azure one.
+	DNS *AZDNSConfig `yaml:"dns,omitempty"`
+	// Optional point-to-site VPN gateway, for accessing the shares and the Manager privately.
+	VPN *AZVPNConfig `yaml:"vpn,omitempty"`
+	// Optional settings for the 'backup' command.
+	Backup *AZBackupConfig `yaml:"backup,omitempty"`
+	// Optional HTTPS proxy and CA certificates for the Azure API traffic.
+	Proxy *AZProxyConfig `yaml:"proxy,omitempty"`
+	// Versions, download URLs and checksums of the installed components; see DefaultComponents.
+	ComponentVersions *AZComponentsConfig `yaml:"components,omitempty"`
 }
 
 // Load returns the config file, or hard-exits the process if it cannot be loaded.
-func Load() AZConfig {
-	logger := logrus.WithField("filename", configFile)
-	paramFile, err := ioutil.ReadFile(configFile)
+// A file that does not exist yet results in an empty config, which is saved to that file.
+func Load(filename string) AZConfig {
+	logger := logrus.WithField("filename", filename)
+	paramFile, err := ioutil.ReadFile(filename)
 	if err != nil && !os.IsNotExist(err) {
 		logger.WithError(err).Fatal("unable to open config file")
 	}
 
-	abspath, err := filepath.Abs(configFile)
+	abspath, err := filepath.Abs(filename)
 	if err != nil {
 		logger.WithError(err).Fatal("unable to construct absolute path")
 	}
@@ -105,6 +141,38 @@ func Load() AZConfig {
 	return params
 }
 
+// KnownHostsPath returns the path of the SSH known_hosts file of this deployment.
+// It defaults to the name of the config file with a ".known_hosts" extension.
+func (azc AZConfig) KnownHostsPath() string {
+	if azc.KnownHostsFile == "" {
+		return strings.TrimSuffix(azc.filename, filepath.Ext(azc.filename)) + ".known_hosts"
+	}
+	if filepath.IsAbs(azc.KnownHostsFile) {
+		return azc.KnownHostsFile
+	}
+	return filepath.Join(filepath.Dir(azc.filename), azc.KnownHostsFile)
+}
+
+// Filename returns the absolute path of the file this config is saved to.
+func (azc AZConfig) Filename() string {
+	return azc.filename
+}
+
+// SaveAs stores the config as YAML in another file, which is then used for subsequent saves.
+func (azc *AZConfig) SaveAs(filename string) {
+	abspath, err := filepath.Abs(filename)
+	if err != nil {
+		logrus.WithField("filename", filename).WithError(err).Fatal("unable to construct absolute path")
+	}
+	azc.filename = abspath
+	azc.Save()
+}
+
+// ResetWorkerRegistrationSecret replaces the worker registration secret with a new random one.
+func (azc *AZConfig) ResetWorkerRegistrationSecret() {
+	azc.WorkerRegistrationSecret = randomWorkerSecret()
+}
+
 // StorageAccountID computes the storage account ID given the other properties.
 func (azc AZConfig) StorageAccountID() string {
 	return fmt.Sprintf(
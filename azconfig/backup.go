@@ -0,0 +1,39 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azconfig
+
+// DefaultBackupRetention is the number of backups kept when not configured otherwise.
+const DefaultBackupRetention = 14
+
+// AZBackupConfig configures the backups of Flamenco Manager.
+type AZBackupConfig struct {
+	Retention int `yaml:"retention"` // number of most recent backups to keep; older ones are removed
+}
+
+// BackupRetention returns the number of backups to keep.
+func (azc AZConfig) BackupRetention() int {
+	if azc.Backup == nil || azc.Backup.Retention <= 0 {
+		return DefaultBackupRetention
+	}
+	return azc.Backup.Retention
+}
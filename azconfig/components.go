@@ -0,0 +1,284 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azconfig
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/sirupsen/logrus"
+)
+
+// Names of the downloaded components. They are also the names of the symlinks pointing to the
+// installed version, in the Manager's home directory or the 'flamenco-resources' share.
+const (
+	ComponentManager        = "flamenco-manager"
+	ComponentWorker         = "flamenco-worker"
+	ComponentPreemptMonitor = "azure-preempt-monitor"
+	ComponentBlender        = "blender"
+	ComponentFFmpeg         = "ffmpeg"
+)
+
+// AZComponentConfig pins the version of a component. In the URL, "{version}" is replaced by the
+// version, and "{series}" by its first two numbers, like "2.83" for "2.83.20".
+type AZComponentConfig struct {
+	Version string `yaml:"version"`
+	URL     string `yaml:"url,omitempty"`    // defaults to the URL of the default version, with the version replaced
+	SHA256  string `yaml:"sha256,omitempty"` // checksum of the downloaded archive; see DefaultChecksums
+
+	// Install the archive without verifying its checksum. Only meant for testing unreleased versions.
+	SkipChecksum bool `yaml:"skipChecksum,omitempty"`
+
+	// Flamenco variable for a Blender version, like "blender_293"; defaults to "blender_" followed
+	// by the digits of the series. Only used for Blender.
+	Variable string `yaml:"variable,omitempty"`
+}
+
+// AZComponentsConfig contains the versions of the components installed by the setup script.
+// Components that are not mentioned use DefaultComponents.
+type AZComponentsConfig struct {
+	Manager        *AZComponentConfig `yaml:"manager,omitempty"`
+	Worker         *AZComponentConfig `yaml:"worker,omitempty"`
+	PreemptMonitor *AZComponentConfig `yaml:"preemptMonitor,omitempty"`
+	Blender        *AZComponentConfig `yaml:"blender,omitempty"` // default Blender for the workers
+	FFmpeg         *AZComponentConfig `yaml:"ffmpeg,omitempty"`
+
+	// Blender versions installed next to the default one; each needs a version.
+	ExtraBlenders []AZComponentConfig `yaml:"extraBlenders,omitempty"`
+
+	// Local directory for the downloaded archives, relative to the config file. When set, the
+	// archives are downloaded here and uploaded to the resources share, instead of being
+	// downloaded by the VM.
+	CacheDir string `yaml:"cacheDir,omitempty"`
+}
+
+// DefaultComponents are installed when the config doesn't specify otherwise.
+// Their checksums are in DefaultChecksums.
+var DefaultComponents = map[string]AZComponentConfig{
+	ComponentManager: {
+		Version: "2.7",
+		URL:     "https://www.flamenco.io/download/flamenco-manager-{version}-linux.tar.gz",
+	},
+	ComponentWorker: {
+		Version: "2.5",
+		URL:     "https://www.flamenco.io/download/flamenco-worker-{version}-linux.tar.gz",
+	},
+	ComponentPreemptMonitor: {
+		Version: "1.1",
+		URL:     "https://flamenco.io/download/azure-preempt-monitor/azure-preempt-monitor-v{version}-linux.tar.gz",
+	},
+	ComponentBlender: {
+		Version: "2.83.20",
+		URL:     "https://download.blender.org/release/Blender{series}/blender-{version}-linux-x64.tar.xz",
+	},
+	ComponentFFmpeg: {
+		Version: "4.2.1",
+		URL:     "https://johnvansickle.com/ffmpeg/old-releases/ffmpeg-{version}-amd64-static.tar.xz",
+	},
+}
+
+// Component is a downloadable archive, with the config and defaults resolved.
+type Component struct {
+	ID      string // unique, like "blender_293" for an extra Blender version; otherwise the same as Name
+	Name    string // one of the Component* constants
+	Version string
+	URL     string
+	SHA256  string // lower-case hexadecimal; empty when SkipChecksum is set
+
+	// Install the archive without verifying it; only set when explicitly configured.
+	SkipChecksum bool
+
+	// Symlinks pointing to the installed version. For Blender these are also the names of the
+	// Flamenco variables, so the default Blender has "blender" as well as its own series variable.
+	Links []string
+}
+
+var (
+	validComponentVersion = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+	validSHA256           = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	validVariable         = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	nonDigits             = regexp.MustCompile(`[^0-9]+`)
+)
+
+// Dir returns the directory the component is extracted into, relative to its symlinks.
+func (c Component) Dir() string {
+	return c.Name + "-" + c.Version
+}
+
+// Filename returns the filename of the downloaded archive.
+func (c Component) Filename() string {
+	parsed, err := url.Parse(c.URL)
+	if err != nil {
+		return path.Base(c.URL)
+	}
+	return path.Base(parsed.Path)
+}
+
+// ComponentCacheDir returns the absolute path of the local component cache,
+// or an empty string if it is not used.
+func (azc AZConfig) ComponentCacheDir() string {
+	if azc.ComponentVersions == nil || azc.ComponentVersions.CacheDir == "" {
+		return ""
+	}
+	cacheDir, err := homedir.Expand(os.ExpandEnv(azc.ComponentVersions.CacheDir))
+	if err != nil {
+		logrus.WithField("cacheDir", azc.ComponentVersions.CacheDir).WithError(err).Fatal("unable to expand path")
+	}
+	if filepath.IsAbs(cacheDir) {
+		return cacheDir
+	}
+	return filepath.Join(filepath.Dir(azc.filename), cacheDir)
+}
+
+// Components returns all components to install, in installation order.
+// Invalid versions, URLs and checksums are fatal.
+func (azc AZConfig) Components() []Component {
+	configured := AZComponentsConfig{}
+	if azc.ComponentVersions != nil {
+		configured = *azc.ComponentVersions
+	}
+
+	components := []Component{
+		resolveComponent(ComponentManager, configured.Manager),
+		resolveComponent(ComponentWorker, configured.Worker),
+		resolveComponent(ComponentPreemptMonitor, configured.PreemptMonitor),
+	}
+
+	defaultBlender := resolveComponent(ComponentBlender, configured.Blender)
+	defaultBlender.ID = ComponentBlender
+	defaultBlender.Links = []string{ComponentBlender, blenderVariable(defaultBlender, configured.Blender)}
+	components = append(components, defaultBlender)
+
+	for index := range configured.ExtraBlenders {
+		extra := &configured.ExtraBlenders[index]
+		if extra.Version == "" {
+			logrus.WithField("index", index).Fatal("extra Blender versions need a version")
+		}
+		blender := resolveComponent(ComponentBlender, extra)
+		blender.ID = blenderVariable(blender, extra)
+		blender.Links = []string{blender.ID}
+		components = append(components, blender)
+	}
+
+	components = append(components, resolveComponent(ComponentFFmpeg, configured.FFmpeg))
+
+	// IDs and symlinks must be unique, or one version would overwrite the other.
+	seen := map[string]bool{}
+	for _, component := range components {
+		names := map[string]bool{component.ID: true}
+		for _, link := range component.Links {
+			names[link] = true
+		}
+		for name := range names {
+			if seen[name] {
+				logrus.WithFields(logrus.Fields{
+					"component": component.Name,
+					"version":   component.Version,
+					"name":      name,
+				}).Fatal("two components use the same name; set a different 'variable' for one of the Blender versions")
+			}
+			seen[name] = true
+		}
+	}
+	return components
+}
+
+// blenderVariable returns the Flamenco variable name for a Blender version, like "blender_293".
+func blenderVariable(blender Component, configured *AZComponentConfig) string {
+	if configured != nil && configured.Variable != "" {
+		if !validVariable.MatchString(configured.Variable) {
+			logrus.WithField("variable", configured.Variable).Fatal("invalid Blender variable name; use lower-case letters, digits and underscores")
+		}
+		return configured.Variable
+	}
+	return ComponentBlender + "_" + nonDigits.ReplaceAllString(componentSeries(blender.Version), "")
+}
+
+func resolveComponent(name string, configured *AZComponentConfig) Component {
+	defaults := DefaultComponents[name]
+	resolved := defaults
+	if configured != nil {
+		if configured.Version != "" {
+			resolved.Version = configured.Version
+		}
+		if configured.URL != "" {
+			resolved.URL = configured.URL
+		}
+		resolved.SHA256 = configured.SHA256
+		resolved.SkipChecksum = configured.SkipChecksum
+	}
+
+	component := Component{
+		ID:           name,
+		Name:         name,
+		Version:      resolved.Version,
+		URL:          expandComponentURL(resolved.URL, resolved.Version),
+		SHA256:       strings.ToLower(resolved.SHA256),
+		SkipChecksum: resolved.SkipChecksum,
+	}
+	if component.SHA256 == "" {
+		// Checksums are known per archive, so they only apply to the exact same download.
+		component.SHA256 = DefaultChecksums[component.URL]
+	}
+
+	logger := logrus.WithFields(logrus.Fields{
+		"component": name,
+		"version":   component.Version,
+		"url":       component.URL,
+	})
+	if !validComponentVersion.MatchString(component.Version) {
+		logger.Fatal("invalid component version; use only letters, digits and . _ + -")
+	}
+	if parsed, err := url.Parse(component.URL); err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+		logger.WithError(err).Fatal("invalid component download URL")
+	}
+	switch {
+	case component.SkipChecksum:
+		logger.Warning("checksum verification is disabled for this component")
+		component.SHA256 = ""
+	case component.SHA256 == "":
+		logger.Fatal("no checksum known for this component; set its sha256 in the components section of the config, " +
+			"or set skipChecksum to install it without verification")
+	case !validSHA256.MatchString(component.SHA256):
+		logger.WithField("sha256", component.SHA256).Fatal("invalid component checksum; expected 64 hexadecimal digits")
+	}
+	component.Links = []string{name}
+	return component
+}
+
+func expandComponentURL(urlPattern, version string) string {
+	return strings.NewReplacer("{version}", version, "{series}", componentSeries(version)).Replace(urlPattern)
+}
+
+// componentSeries returns the first two numbers of the version, like "2.83" for "2.83.20".
+func componentSeries(version string) string {
+	if parts := strings.SplitN(version, ".", 3); len(parts) > 2 {
+		return parts[0] + "." + parts[1]
+	}
+	return version
+}
@@ -0,0 +1,46 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package azconfig
+
+import (
+	"testing"
+)
+
+// A config without a components section has to deploy, so every default archive needs a checksum.
+func TestDefaultComponentsResolve(t *testing.T) {
+	for name, component := range DefaultComponents {
+		url := expandComponentURL(component.URL, component.Version)
+		if DefaultChecksums[url] == "" {
+			t.Fatalf("no checksum for the default %s archive %s; run 'make component-checksums'", name, url)
+		}
+	}
+
+	components := AZConfig{}.Components()
+	if len(components) == 0 {
+		t.Fatal("no components resolved")
+	}
+	for _, component := range components {
+		if component.SkipChecksum || !validSHA256.MatchString(component.SHA256) {
+			t.Errorf("%s %s resolved without a valid checksum: %#v", component.Name, component.Version, component)
+		}
+	}
+}
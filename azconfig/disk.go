@@ -0,0 +1,51 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azconfig
+
+// AZDataDiskConfig describes the managed data disk for MongoDB and the Manager state.
+type AZDataDiskConfig struct {
+	SizeGB  int32  `yaml:"sizeGB"`            // size of the disk in gigabytes
+	SKU     string `yaml:"sku,omitempty"`     // "Premium_LRS", "StandardSSD_LRS" (default) or "Standard_LRS"
+	Caching string `yaml:"caching,omitempty"` // "None", "ReadOnly" or "ReadWrite" (default)
+}
+
+// Defaults for the data disk configuration.
+const (
+	DefaultDataDiskSizeGB  int32 = 64
+	DefaultDataDiskSKU           = "StandardSSD_LRS"
+	DefaultDataDiskCaching       = "ReadWrite"
+)
+
+// WithDefaults returns a copy of the data disk config with empty fields set to their defaults.
+func (dc AZDataDiskConfig) WithDefaults() AZDataDiskConfig {
+	if dc.SizeGB == 0 {
+		dc.SizeGB = DefaultDataDiskSizeGB
+	}
+	if dc.SKU == "" {
+		dc.SKU = DefaultDataDiskSKU
+	}
+	if dc.Caching == "" {
+		dc.Caching = DefaultDataDiskCaching
+	}
+	return dc
+}
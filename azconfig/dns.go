@@ -0,0 +1,51 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azconfig
+
+import "strings"
+
+// AZDNSConfig names a record in an Azure DNS zone that should point to Flamenco Manager.
+type AZDNSConfig struct {
+	ZoneName      string `yaml:"zoneName"`                // name of the DNS zone, like "ourstudio.com"
+	ResourceGroup string `yaml:"resourceGroup,omitempty"` // resource group of the zone; defaults to the deployment's resource group
+	RecordName    string `yaml:"recordName"`              // name relative to the zone, like "render"; use "@" for the zone apex
+	RecordType    string `yaml:"recordType,omitempty"`    // "A" (default) to point at the public IP, or "CNAME" to point at the Azure domain name
+}
+
+// FQDN returns the fully-qualified domain name of the DNS record.
+func (dc AZDNSConfig) FQDN() string {
+	zone := strings.TrimSuffix(dc.ZoneName, ".")
+	if dc.RecordName == "" || dc.RecordName == "@" {
+		return zone
+	}
+	return dc.RecordName + "." + zone
+}
+
+// ManagerFQDN returns the domain name under which Flamenco Manager is reachable.
+// This is the custom DNS record when configured, and azureFQDN otherwise.
+func (azc AZConfig) ManagerFQDN(azureFQDN string) string {
+	if azc.DNS == nil || azc.DNS.ZoneName == "" {
+		return azureFQDN
+	}
+	return azc.DNS.FQDN()
+}
@@ -0,0 +1,61 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azconfig
+
+// AZImageConfig identifies a Marketplace image for virtual machines.
+type AZImageConfig struct {
+	Publisher string `yaml:"publisher"`         // like "Canonical"
+	Offer     string `yaml:"offer"`             // like "0001-com-ubuntu-server-jammy"
+	SKU       string `yaml:"sku"`               // like "22_04-lts"
+	Version   string `yaml:"version,omitempty"` // defaults to "latest"
+}
+
+// DefaultImage is used for both the Manager VM and the Workers when no image is configured.
+var DefaultImage = AZImageConfig{
+	Publisher: "Canonical",
+	Offer:     "0001-com-ubuntu-server-jammy",
+	SKU:       "22_04-lts",
+	Version:   "latest",
+}
+
+// imageOrDefault returns the image, or DefaultImage if it's nil.
+func imageOrDefault(image *AZImageConfig) AZImageConfig {
+	if image == nil {
+		return DefaultImage
+	}
+	result := *image
+	if result.Version == "" {
+		result.Version = "latest"
+	}
+	return result
+}
+
+// ManagerOSImage returns the image for the Flamenco Manager VM.
+func (azc AZConfig) ManagerOSImage() AZImageConfig {
+	return imageOrDefault(azc.ManagerImage)
+}
+
+// WorkerOSImage returns the image for the Flamenco Worker VMs in the Batch pool.
+func (bc AZBatchConfig) WorkerOSImage() AZImageConfig {
+	return imageOrDefault(bc.Image)
+}
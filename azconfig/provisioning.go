@@ -0,0 +1,47 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azconfig
+
+import "github.com/sirupsen/logrus"
+
+// Ways of installing Flamenco Manager on its VM.
+const (
+	// ProvisionSSH uploads the files and runs the install script over SSH from this machine.
+	ProvisionSSH = "ssh"
+	// ProvisionCloudInit passes the files and the install script to the VM as cloud-init custom data,
+	// and only talks to the VM through the Azure API.
+	ProvisionCloudInit = "cloud-init"
+)
+
+// ProvisioningMode returns the configured way of installing Flamenco Manager, defaulting to ProvisionSSH.
+func (azc AZConfig) ProvisioningMode() string {
+	switch azc.Provisioning {
+	case "", ProvisionSSH:
+		return ProvisionSSH
+	case ProvisionCloudInit:
+		return ProvisionCloudInit
+	}
+	logrus.WithField("provisioning", azc.Provisioning).Fatalf(
+		"unknown provisioning mode, use %q or %q", ProvisionSSH, ProvisionCloudInit)
+	return ""
+}
@@ -0,0 +1,73 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azconfig
+
+import "os"
+
+// AZProxyConfig configures how HTTPS traffic to the Azure APIs leaves the network.
+// Empty fields fall back to the environment, like the Azure CLI does.
+type AZProxyConfig struct {
+	// Proxy for HTTPS requests, like "http://proxy.example.com:3128"; defaults to $HTTPS_PROXY.
+	HTTPS string `yaml:"https,omitempty"`
+	// Comma-separated hosts and domains that are reached without proxy; defaults to $NO_PROXY.
+	NoProxy string `yaml:"noProxy,omitempty"`
+	// PEM file with extra trusted CA certificates, for proxies that inspect TLS traffic;
+	// defaults to $REQUESTS_CA_BUNDLE, which is also used by the Azure CLI.
+	CABundle string `yaml:"caBundle,omitempty"`
+}
+
+// HTTPSProxy returns the configured HTTPS proxy URL, or an empty string if there is none.
+func (azc AZConfig) HTTPSProxy() string {
+	if azc.Proxy != nil && azc.Proxy.HTTPS != "" {
+		return azc.Proxy.HTTPS
+	}
+	return firstEnv("HTTPS_PROXY", "https_proxy")
+}
+
+// NoProxy returns the hosts and domains that should not go through the proxy.
+func (azc AZConfig) NoProxy() string {
+	if azc.Proxy != nil && azc.Proxy.NoProxy != "" {
+		return azc.Proxy.NoProxy
+	}
+	return firstEnv("NO_PROXY", "no_proxy")
+}
+
+// CABundlePath returns the file with extra trusted CA certificates, or an empty string if there is none.
+func (azc AZConfig) CABundlePath() string {
+	if azc.Proxy != nil && azc.Proxy.CABundle != "" {
+		return expandPath(azc.Proxy.CABundle)
+	}
+	if bundle := os.Getenv("REQUESTS_CA_BUNDLE"); bundle != "" {
+		return expandPath(bundle)
+	}
+	return ""
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -27,3 +27,16 @@ type StorageCredentials struct {
 	Username string // the storage account name
 	Password string // the storage account key
 }
+
+// AZStorageNetworkConfig restricts network access to the storage account.
+type AZStorageNetworkConfig struct {
+	// Deny access by default, only allowing the deployment subnet and AllowedIPs.
+	DenyByDefault bool `yaml:"denyByDefault"`
+	// IP addresses or CIDR ranges of operators that still need access, like "203.0.113.0/24".
+	AllowedIPs []string `yaml:"allowedIPs,omitempty"`
+	// Temporarily allow the public IP address of the machine running this program, while it needs
+	// access to the file shares. The address is looked up via https://api.ipify.org.
+	AllowOperatorIP bool `yaml:"allowOperatorIP,omitempty"`
+	// Create a private endpoint in the virtual network, so that SMB traffic never leaves it.
+	PrivateEndpoint bool `yaml:"privateEndpoint"`
+}
@@ -0,0 +1,62 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azconfig
+
+// AZVPNConfig configures the optional point-to-site VPN gateway.
+type AZVPNConfig struct {
+	// Address range of the GatewaySubnet; must be inside the virtual network, but outside its default subnet.
+	GatewaySubnet string `yaml:"gatewaySubnet,omitempty"`
+	// Address range from which VPN clients get their IP address; must not overlap the virtual network.
+	ClientAddressPool string `yaml:"clientAddressPool,omitempty"`
+	// SKU of the VPN gateway, like "VpnGw1".
+	SKU string `yaml:"sku,omitempty"`
+	// Names of the VPN clients; a client certificate is generated for each.
+	Clients []string `yaml:"clients"`
+	// Local directory for certificates, client configuration and mount instructions.
+	OutputDir string `yaml:"outputDir,omitempty"`
+}
+
+// Defaults for the VPN configuration.
+const (
+	DefaultVPNGatewaySubnet     = "10.1.255.0/27"
+	DefaultVPNClientAddressPool = "172.16.201.0/24"
+	DefaultVPNSKU               = "VpnGw1"
+	DefaultVPNOutputDir         = "vpn"
+)
+
+// WithDefaults returns a copy of the VPN config with empty fields set to their defaults.
+func (vc AZVPNConfig) WithDefaults() AZVPNConfig {
+	if vc.GatewaySubnet == "" {
+		vc.GatewaySubnet = DefaultVPNGatewaySubnet
+	}
+	if vc.ClientAddressPool == "" {
+		vc.ClientAddressPool = DefaultVPNClientAddressPool
+	}
+	if vc.SKU == "" {
+		vc.SKU = DefaultVPNSKU
+	}
+	if vc.OutputDir == "" {
+		vc.OutputDir = DefaultVPNOutputDir
+	}
+	return vc
+}
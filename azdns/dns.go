@@ -0,0 +1,122 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azdns
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/dns/mgmt/2017-10-01/dns"
+	"github.com/Azure/flamenco-manager-azure/azauth"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/flamenco-manager-azure/aznetwork"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/sirupsen/logrus"
+)
+
+const recordTTL int64 = 300 // seconds
+
+func getZonesClient(config azconfig.AZConfig) dns.ZonesClient {
+	zonesClient := dns.NewZonesClient(config.SubscriptionID)
+	zonesClient.Authorizer = azauth.Load(azure.PublicCloud.ResourceManagerEndpoint)
+	zonesClient.Sender = azauth.Sender()
+	return zonesClient
+}
+
+func getRecordSetsClient(config azconfig.AZConfig) dns.RecordSetsClient {
+	recordSetsClient := dns.NewRecordSetsClient(config.SubscriptionID)
+	recordSetsClient.Authorizer = azauth.Load(azure.PublicCloud.ResourceManagerEndpoint)
+	recordSetsClient.Sender = azauth.Sender()
+	return recordSetsClient
+}
+
+// EnsureRecord creates or updates the DNS record from the config so that it points to the VM.
+// Does nothing when no custom DNS record is configured.
+func EnsureRecord(ctx context.Context, config azconfig.AZConfig, netStack aznetwork.NetworkStack) {
+	if config.DNS == nil || config.DNS.ZoneName == "" {
+		logrus.Debug("no custom DNS record configured")
+		return
+	}
+
+	zoneGroup := config.DNS.ResourceGroup
+	if zoneGroup == "" {
+		zoneGroup = config.ResourceGroup
+	}
+	recordName := config.DNS.RecordName
+	if recordName == "" {
+		recordName = "@"
+	}
+	recordType := dns.RecordType(strings.ToUpper(config.DNS.RecordType))
+	if recordType == "" {
+		recordType = dns.A
+	}
+
+	logger := logrus.WithFields(logrus.Fields{
+		"zoneResourceGroup": zoneGroup,
+		"zoneName":          config.DNS.ZoneName,
+		"recordName":        recordName,
+		"recordType":        recordType,
+		"fqdn":              config.DNS.FQDN(),
+	})
+
+	zonesClient := getZonesClient(config)
+	if _, err := zonesClient.Get(ctx, zoneGroup, config.DNS.ZoneName); err != nil {
+		logger.WithError(err).Fatal("unable to find DNS zone; it has to be created before deploying")
+	}
+
+	props := dns.RecordSetProperties{
+		TTL: to.Int64Ptr(recordTTL),
+	}
+	switch recordType {
+	case dns.A:
+		props.ARecords = &[]dns.ARecord{{
+			Ipv4Address: netStack.PublicIP.IPAddress,
+		}}
+	case dns.CNAME:
+		if recordName == "@" {
+			logger.Fatal("a CNAME record cannot be created at the zone apex, use an A record instead")
+		}
+		props.CnameRecord = &dns.CnameRecord{
+			Cname: to.StringPtr(netStack.FQDN()),
+		}
+	default:
+		logger.Fatal("unsupported DNS record type, use either A or CNAME")
+	}
+
+	logger.Info("creating or updating DNS record")
+	recordSetsClient := getRecordSetsClient(config)
+	_, err := recordSetsClient.CreateOrUpdate(
+		ctx,
+		zoneGroup,
+		config.DNS.ZoneName,
+		recordName,
+		recordType,
+		dns.RecordSet{RecordSetProperties: &props},
+		"", "",
+	)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to create or update DNS record")
+	}
+	logger.Info("DNS record points to Flamenco Manager")
+}
@@ -60,18 +60,21 @@ func (ns *NetworkStack) SubnetID() string {
 func getNicClient(config azconfig.AZConfig) network.InterfacesClient {
 	nicClient := network.NewInterfacesClient(config.SubscriptionID)
 	nicClient.Authorizer = azauth.Load(azure.PublicCloud.ResourceManagerEndpoint)
+	nicClient.Sender = azauth.Sender()
 	return nicClient
 }
 
 func getVnetClient(config azconfig.AZConfig) network.VirtualNetworksClient {
 	vnetClient := network.NewVirtualNetworksClient(config.SubscriptionID)
 	vnetClient.Authorizer = azauth.Load(azure.PublicCloud.ResourceManagerEndpoint)
+	vnetClient.Sender = azauth.Sender()
 	return vnetClient
 }
 
 func getIPClient(config azconfig.AZConfig) network.PublicIPAddressesClient {
 	ipClient := network.NewPublicIPAddressesClient(config.SubscriptionID)
 	ipClient.Authorizer = azauth.Load(azure.PublicCloud.ResourceManagerEndpoint)
+	ipClient.Sender = azauth.Sender()
 	return ipClient
 }
 
@@ -0,0 +1,113 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package aznetwork
+
+import (
+	"context"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2017-09-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/privatedns/mgmt/2018-09-01/privatedns"
+	"github.com/Azure/flamenco-manager-azure/azauth"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/sirupsen/logrus"
+)
+
+const privateDNSRecordTTL int64 = 3600 // seconds
+
+func getPrivateZonesClient(config azconfig.AZConfig) privatedns.PrivateZonesClient {
+	zonesClient := privatedns.NewPrivateZonesClient(config.SubscriptionID)
+	zonesClient.Authorizer = azauth.Load(azure.PublicCloud.ResourceManagerEndpoint)
+	zonesClient.Sender = azauth.Sender()
+	return zonesClient
+}
+
+func getVNetLinksClient(config azconfig.AZConfig) privatedns.VirtualNetworkLinksClient {
+	linksClient := privatedns.NewVirtualNetworkLinksClient(config.SubscriptionID)
+	linksClient.Authorizer = azauth.Load(azure.PublicCloud.ResourceManagerEndpoint)
+	linksClient.Sender = azauth.Sender()
+	return linksClient
+}
+
+func getPrivateRecordSetsClient(config azconfig.AZConfig) privatedns.RecordSetsClient {
+	recordSetsClient := privatedns.NewRecordSetsClient(config.SubscriptionID)
+	recordSetsClient.Authorizer = azauth.Load(azure.PublicCloud.ResourceManagerEndpoint)
+	recordSetsClient.Sender = azauth.Sender()
+	return recordSetsClient
+}
+
+// EnsurePrivateDNSRecord creates a private DNS zone linked to the virtual network,
+// and an A record in that zone pointing to the given private IP address.
+func EnsurePrivateDNSRecord(ctx context.Context, config azconfig.AZConfig, vnet network.VirtualNetwork,
+	zoneName, recordName, privateIP string,
+) {
+	logger := logrus.WithFields(logrus.Fields{
+		"resourceGroup": config.ResourceGroup,
+		"zoneName":      zoneName,
+		"recordName":    recordName,
+		"privateIP":     privateIP,
+		"vnet":          *vnet.Name,
+	})
+
+	logger.Info("creating private DNS zone")
+	zonesClient := getPrivateZonesClient(config)
+	zoneFuture, err := zonesClient.CreateOrUpdate(ctx, config.ResourceGroup, zoneName,
+		privatedns.PrivateZone{Location: to.StringPtr("global")}, "", "")
+	if err != nil {
+		logger.WithError(err).Fatal("error creating private DNS zone")
+	}
+	if err := zoneFuture.WaitForCompletionRef(ctx, zonesClient.Client); err != nil {
+		logger.WithError(err).Fatal("error creating private DNS zone")
+	}
+
+	logger.Info("linking private DNS zone to virtual network")
+	linksClient := getVNetLinksClient(config)
+	linkFuture, err := linksClient.CreateOrUpdate(ctx, config.ResourceGroup, zoneName, *vnet.Name,
+		privatedns.VirtualNetworkLink{
+			Location: to.StringPtr("global"),
+			VirtualNetworkLinkProperties: &privatedns.VirtualNetworkLinkProperties{
+				VirtualNetwork:      &privatedns.SubResource{ID: vnet.ID},
+				RegistrationEnabled: to.BoolPtr(false),
+			},
+		}, "", "")
+	if err != nil {
+		logger.WithError(err).Fatal("error linking private DNS zone to virtual network")
+	}
+	if err := linkFuture.WaitForCompletionRef(ctx, linksClient.Client); err != nil {
+		logger.WithError(err).Fatal("error linking private DNS zone to virtual network")
+	}
+
+	logger.Info("creating private DNS record")
+	recordSetsClient := getPrivateRecordSetsClient(config)
+	_, err = recordSetsClient.CreateOrUpdate(ctx, config.ResourceGroup, zoneName, privatedns.A, recordName,
+		privatedns.RecordSet{
+			RecordSetProperties: &privatedns.RecordSetProperties{
+				TTL:      to.Int64Ptr(privateDNSRecordTTL),
+				ARecords: &[]privatedns.ARecord{{Ipv4Address: to.StringPtr(privateIP)}},
+			},
+		}, "", "")
+	if err != nil {
+		logger.WithError(err).Fatal("error creating private DNS record")
+	}
+}
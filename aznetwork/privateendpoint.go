@@ -0,0 +1,147 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package aznetwork
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Azure/flamenco-manager-azure/azauth"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/sirupsen/logrus"
+)
+
+// The network API version of the Azure SDK we use predates private endpoints,
+// so those are managed with plain ARM requests.
+const privateEndpointAPIVersion = "2019-04-01"
+
+type subResource struct {
+	ID string `json:"id"`
+}
+
+type privateLinkServiceConnection struct {
+	Name       string                                 `json:"name"`
+	Properties privateLinkServiceConnectionProperties `json:"properties"`
+}
+
+type privateLinkServiceConnectionProperties struct {
+	PrivateLinkServiceID string   `json:"privateLinkServiceId"`
+	GroupIDs             []string `json:"groupIds"`
+}
+
+type privateEndpoint struct {
+	ID         string                    `json:"id,omitempty"`
+	Location   string                    `json:"location"`
+	Properties privateEndpointProperties `json:"properties"`
+}
+
+type privateEndpointProperties struct {
+	Subnet                        subResource                    `json:"subnet"`
+	PrivateLinkServiceConnections []privateLinkServiceConnection `json:"privateLinkServiceConnections"`
+	NetworkInterfaces             []subResource                  `json:"networkInterfaces,omitempty"`
+}
+
+// EnsurePrivateEndpoint creates a private endpoint in the deployment subnet, connected to the target resource.
+// groupID indicates the sub-resource to connect to, such as "file" for Azure Files. Returns the private IP address.
+func EnsurePrivateEndpoint(ctx context.Context, config azconfig.AZConfig, netStack NetworkStack,
+	endpointName, targetResourceID, groupID string,
+) string {
+	logger := logrus.WithFields(logrus.Fields{
+		"resourceGroup":    config.ResourceGroup,
+		"location":         config.Location,
+		"endpointName":     endpointName,
+		"targetResourceID": targetResourceID,
+		"groupID":          groupID,
+	})
+	logger.Info("creating private endpoint")
+
+	client := azauth.ARMClient()
+	params := privateEndpoint{
+		Location: config.Location,
+		Properties: privateEndpointProperties{
+			Subnet: subResource{ID: netStack.SubnetID()},
+			PrivateLinkServiceConnections: []privateLinkServiceConnection{{
+				Name: endpointName,
+				Properties: privateLinkServiceConnectionProperties{
+					PrivateLinkServiceID: targetResourceID,
+					GroupIDs:             []string{groupID},
+				},
+			}},
+		},
+	}
+
+	req, err := autorest.Prepare((&http.Request{}).WithContext(ctx),
+		autorest.AsContentType("application/json; charset=utf-8"),
+		autorest.AsPut(),
+		autorest.WithBaseURL(azure.PublicCloud.ResourceManagerEndpoint),
+		autorest.WithPathParameters(
+			"/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.Network/privateEndpoints/{privateEndpointName}",
+			map[string]interface{}{
+				"subscriptionId":      autorest.Encode("path", config.SubscriptionID),
+				"resourceGroupName":   autorest.Encode("path", config.ResourceGroup),
+				"privateEndpointName": autorest.Encode("path", endpointName),
+			}),
+		autorest.WithJSON(params),
+		autorest.WithQueryParameters(map[string]interface{}{"api-version": privateEndpointAPIVersion}),
+		client.WithAuthorization())
+	if err != nil {
+		logger.WithError(err).Fatal("unable to construct private endpoint request")
+	}
+
+	resp, err := autorest.SendWithSender(client, req, azure.DoRetryWithRegistration(client))
+	if err != nil {
+		logger.WithError(err).Fatal("error creating private endpoint")
+	}
+	future, err := azure.NewFutureFromResponse(resp)
+	if err != nil {
+		logger.WithError(err).Fatal("error creating private endpoint")
+	}
+	if err := future.WaitForCompletionRef(ctx, client); err != nil {
+		logger.WithError(err).Fatal("error creating private endpoint")
+	}
+
+	resp, err = future.GetResult(client)
+	if err != nil {
+		logger.WithError(err).Fatal("error creating private endpoint")
+	}
+	endpoint := privateEndpoint{}
+	err = autorest.Respond(resp,
+		client.ByInspecting(),
+		azure.WithErrorUnlessStatusCode(http.StatusOK, http.StatusCreated),
+		autorest.ByUnmarshallingJSON(&endpoint),
+		autorest.ByClosing())
+	if err != nil {
+		logger.WithError(err).Fatal("unable to parse private endpoint")
+	}
+
+	if len(endpoint.Properties.NetworkInterfaces) == 0 {
+		logger.Fatal("private endpoint has no network interface")
+	}
+	nic := findNIC(ctx, config, endpoint.Properties.NetworkInterfaces[0].ID)
+	privateIP := findPrivateIP(config, nic)
+
+	logger.WithField("privateIP", privateIP).Info("private endpoint created")
+	return privateIP
+}
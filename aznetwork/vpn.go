@@ -0,0 +1,318 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package aznetwork
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2017-09-01/network"
+	"github.com/Azure/flamenco-manager-azure/azauth"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/sirupsen/logrus"
+)
+
+// Azure requires the VPN gateway subnet to have exactly this name.
+const gatewaySubnetName = "GatewaySubnet"
+
+func getSubnetClient(config azconfig.AZConfig) network.SubnetsClient {
+	subnetClient := network.NewSubnetsClient(config.SubscriptionID)
+	subnetClient.Authorizer = azauth.Load(azure.PublicCloud.ResourceManagerEndpoint)
+	subnetClient.Sender = azauth.Sender()
+	return subnetClient
+}
+
+func getGatewayClient(config azconfig.AZConfig) network.VirtualNetworkGatewaysClient {
+	gatewayClient := network.NewVirtualNetworkGatewaysClient(config.SubscriptionID)
+	gatewayClient.Authorizer = azauth.Load(azure.PublicCloud.ResourceManagerEndpoint)
+	gatewayClient.Sender = azauth.Sender()
+	return gatewayClient
+}
+
+// EnsureVPNGateway creates a point-to-site VPN gateway with certificate authentication.
+// Client certificates and the VPN client configuration are stored in the configured output directory.
+// Does nothing when no VPN is configured.
+func EnsureVPNGateway(ctx context.Context, config azconfig.AZConfig, netStack NetworkStack, basename string) {
+	if config.VPN == nil {
+		logrus.Debug("no VPN configured")
+		return
+	}
+	vpnConfig := config.VPN.WithDefaults()
+	gatewayName := basename + "-vpn"
+
+	logger := logrus.WithFields(logrus.Fields{
+		"resourceGroup": config.ResourceGroup,
+		"location":      config.Location,
+		"gatewayName":   gatewayName,
+		"sku":           vpnConfig.SKU,
+	})
+
+	rootCertData := EnsureVPNCertificates(vpnConfig.OutputDir, vpnConfig.Clients)
+	subnet := createGatewaySubnet(ctx, config, *netStack.VNet.Name, vpnConfig.GatewaySubnet)
+	publicIP := createGatewayPublicIP(ctx, config, gatewayName+"-ip")
+
+	gateway := network.VirtualNetworkGateway{
+		Location: to.StringPtr(config.Location),
+		VirtualNetworkGatewayPropertiesFormat: &network.VirtualNetworkGatewayPropertiesFormat{
+			GatewayType: network.VirtualNetworkGatewayTypeVpn,
+			VpnType:     network.RouteBased,
+			EnableBgp:   to.BoolPtr(false),
+			Sku: &network.VirtualNetworkGatewaySku{
+				Name: network.VirtualNetworkGatewaySkuName(vpnConfig.SKU),
+				Tier: network.VirtualNetworkGatewaySkuTier(vpnConfig.SKU),
+			},
+			IPConfigurations: &[]network.VirtualNetworkGatewayIPConfiguration{{
+				Name: to.StringPtr("gatewayIPConfig"),
+				VirtualNetworkGatewayIPConfigurationPropertiesFormat: &network.VirtualNetworkGatewayIPConfigurationPropertiesFormat{
+					PrivateIPAllocationMethod: network.Dynamic,
+					Subnet:                    &network.SubResource{ID: subnet.ID},
+					PublicIPAddress:           &network.SubResource{ID: publicIP.ID},
+				},
+			}},
+			VpnClientConfiguration: &network.VpnClientConfiguration{
+				VpnClientAddressPool: &network.AddressSpace{
+					AddressPrefixes: &[]string{vpnConfig.ClientAddressPool},
+				},
+				VpnClientProtocols: &[]network.VpnClientProtocol{network.IkeV2, network.SSTP},
+				VpnClientRootCertificates: &[]network.VpnClientRootCertificate{{
+					Name: to.StringPtr(vpnRootName),
+					VpnClientRootCertificatePropertiesFormat: &network.VpnClientRootCertificatePropertiesFormat{
+						PublicCertData: to.StringPtr(rootCertData),
+					},
+				}},
+			},
+		},
+	}
+
+	gatewayClient := getGatewayClient(config)
+	existing, err := gatewayClient.Get(ctx, config.ResourceGroup, gatewayName)
+	switch {
+	case err == nil && gatewayUpToDate(existing, gateway):
+		// Updating a gateway takes a long time, even when nothing changes.
+		logger.Info("VPN gateway is up to date")
+	case err != nil && existing.StatusCode != http.StatusNotFound:
+		logger.WithError(err).Fatal("unable to check for existing VPN gateway")
+	default:
+		if err == nil {
+			logger.Info("updating VPN gateway, this can take 45 minutes")
+		} else {
+			logger.Info("creating VPN gateway, this can take 45 minutes")
+		}
+		future, err := gatewayClient.CreateOrUpdate(ctx, config.ResourceGroup, gatewayName, gateway)
+		if err != nil {
+			logger.WithError(err).Fatal("error creating VPN gateway")
+		}
+		if err := future.WaitForCompletionRef(ctx, gatewayClient.Client); err != nil {
+			logger.WithError(err).Fatal("error creating VPN gateway")
+		}
+		logger.Info("VPN gateway created")
+	}
+
+	downloadVPNClientPackage(ctx, config, gatewayName, vpnConfig.OutputDir)
+}
+
+// gatewayUpToDate returns whether the existing gateway has the settings of the desired one.
+// Only the settings that EnsureVPNGateway sets are compared.
+func gatewayUpToDate(existing, desired network.VirtualNetworkGateway) bool {
+	have, want := existing.VirtualNetworkGatewayPropertiesFormat, desired.VirtualNetworkGatewayPropertiesFormat
+	if have == nil || have.Sku == nil || have.VpnClientConfiguration == nil || have.IPConfigurations == nil {
+		return false
+	}
+	if have.Sku.Name != want.Sku.Name || len(*have.IPConfigurations) != len(*want.IPConfigurations) {
+		return false
+	}
+	for index, wantIPConfig := range *want.IPConfigurations {
+		haveIPConfig := (*have.IPConfigurations)[index].VirtualNetworkGatewayIPConfigurationPropertiesFormat
+		if haveIPConfig == nil || haveIPConfig.Subnet == nil || haveIPConfig.PublicIPAddress == nil {
+			return false
+		}
+		wantProps := wantIPConfig.VirtualNetworkGatewayIPConfigurationPropertiesFormat
+		if !strings.EqualFold(to.String(haveIPConfig.Subnet.ID), to.String(wantProps.Subnet.ID)) ||
+			!strings.EqualFold(to.String(haveIPConfig.PublicIPAddress.ID), to.String(wantProps.PublicIPAddress.ID)) {
+			return false
+		}
+	}
+
+	haveClient, wantClient := have.VpnClientConfiguration, want.VpnClientConfiguration
+	if haveClient.VpnClientAddressPool == nil || haveClient.VpnClientAddressPool.AddressPrefixes == nil ||
+		!sameStrings(*haveClient.VpnClientAddressPool.AddressPrefixes, *wantClient.VpnClientAddressPool.AddressPrefixes) {
+		return false
+	}
+	if haveClient.VpnClientProtocols == nil || len(*haveClient.VpnClientProtocols) != len(*wantClient.VpnClientProtocols) {
+		return false
+	}
+	for _, protocol := range *wantClient.VpnClientProtocols {
+		found := false
+		for _, haveProtocol := range *haveClient.VpnClientProtocols {
+			found = found || haveProtocol == protocol
+		}
+		if !found {
+			return false
+		}
+	}
+
+	// Azure may store the certificate data with different whitespace.
+	haveCerts := []string{}
+	if haveClient.VpnClientRootCertificates != nil {
+		for _, cert := range *haveClient.VpnClientRootCertificates {
+			if cert.VpnClientRootCertificatePropertiesFormat != nil {
+				haveCerts = append(haveCerts, strings.Join(strings.Fields(to.String(cert.PublicCertData)), ""))
+			}
+		}
+	}
+	wantCerts := []string{}
+	for _, cert := range *wantClient.VpnClientRootCertificates {
+		wantCerts = append(wantCerts, strings.Join(strings.Fields(to.String(cert.PublicCertData)), ""))
+	}
+	return sameStrings(haveCerts, wantCerts)
+}
+
+// sameStrings returns whether both slices contain the same strings, regardless of order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := map[string]int{}
+	for _, value := range a {
+		counts[value]++
+	}
+	for _, value := range b {
+		counts[value]--
+		if counts[value] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func createGatewaySubnet(ctx context.Context, config azconfig.AZConfig, vnetName, addressPrefix string) network.Subnet {
+	logger := logrus.WithFields(logrus.Fields{
+		"resourceGroup": config.ResourceGroup,
+		"vnetName":      vnetName,
+		"addressPrefix": addressPrefix,
+	})
+	logger.Info("creating gateway subnet")
+
+	subnetClient := getSubnetClient(config)
+	future, err := subnetClient.CreateOrUpdate(ctx, config.ResourceGroup, vnetName, gatewaySubnetName, network.Subnet{
+		SubnetPropertiesFormat: &network.SubnetPropertiesFormat{
+			AddressPrefix: to.StringPtr(addressPrefix),
+		},
+	})
+	if err != nil {
+		logger.WithError(err).Fatal("error creating gateway subnet")
+	}
+	if err := future.WaitForCompletionRef(ctx, subnetClient.Client); err != nil {
+		logger.WithError(err).Fatal("error creating gateway subnet")
+	}
+	subnet, err := future.Result(subnetClient)
+	if err != nil {
+		logger.WithError(err).Fatal("error creating gateway subnet")
+	}
+	return subnet
+}
+
+func createGatewayPublicIP(ctx context.Context, config azconfig.AZConfig, ipName string) network.PublicIPAddress {
+	logger := logrus.WithFields(logrus.Fields{
+		"resourceGroup": config.ResourceGroup,
+		"location":      config.Location,
+		"ipName":        ipName,
+	})
+	logger.Info("creating VPN gateway public IP")
+
+	ipClient := getIPClient(config)
+	future, err := ipClient.CreateOrUpdate(ctx, config.ResourceGroup, ipName, network.PublicIPAddress{
+		Name:     to.StringPtr(ipName),
+		Location: to.StringPtr(config.Location),
+		Sku:      &network.PublicIPAddressSku{Name: network.PublicIPAddressSkuNameStandard},
+		PublicIPAddressPropertiesFormat: &network.PublicIPAddressPropertiesFormat{
+			PublicIPAddressVersion:   network.IPv4,
+			PublicIPAllocationMethod: network.Static,
+		},
+	})
+	if err != nil {
+		logger.WithError(err).Fatal("error creating VPN gateway public IP")
+	}
+	if err := future.WaitForCompletionRef(ctx, ipClient.Client); err != nil {
+		logger.WithError(err).Fatal("error creating VPN gateway public IP")
+	}
+	ip, err := future.Result(ipClient)
+	if err != nil {
+		logger.WithError(err).Fatal("error creating VPN gateway public IP")
+	}
+	return ip
+}
+
+// downloadVPNClientPackage lets Azure generate the VPN client configuration bundle and downloads it.
+func downloadVPNClientPackage(ctx context.Context, config azconfig.AZConfig, gatewayName, outputDir string) {
+	zipPath := filepath.Join(outputDir, "vpn-client-configuration.zip")
+	logger := logrus.WithFields(logrus.Fields{
+		"gatewayName": gatewayName,
+		"filename":    zipPath,
+	})
+	logger.Info("generating VPN client configuration")
+
+	gatewayClient := getGatewayClient(config)
+	future, err := gatewayClient.GenerateVpnProfile(ctx, config.ResourceGroup, gatewayName, network.VpnClientParameters{
+		AuthenticationMethod: network.EAPTLS,
+	})
+	if err != nil {
+		logger.WithError(err).Fatal("error generating VPN client configuration")
+	}
+	if err := future.WaitForCompletionRef(ctx, gatewayClient.Client); err != nil {
+		logger.WithError(err).Fatal("error generating VPN client configuration")
+	}
+	packageURL, err := future.Result(gatewayClient)
+	if err != nil || packageURL.Value == nil {
+		logger.WithError(err).Fatal("error generating VPN client configuration")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, *packageURL.Value, nil)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to construct download request")
+	}
+	resp, err := azauth.HTTPClient().Do(req.WithContext(ctx))
+	if err != nil {
+		logger.WithError(err).Fatal("unable to download VPN client configuration")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logger.WithField("statusCode", resp.StatusCode).Fatal("unable to download VPN client configuration")
+	}
+
+	zipFile, err := os.Create(zipPath)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to create file")
+	}
+	defer zipFile.Close()
+	if _, err := io.Copy(zipFile, resp.Body); err != nil {
+		logger.WithError(err).Fatal("unable to save VPN client configuration")
+	}
+	logger.Info("VPN client configuration downloaded")
+}
@@ -0,0 +1,167 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package aznetwork
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	vpnRootName      = "flamenco-vpn-root"
+	vpnCertValidity  = 10 * 365 * 24 * time.Hour
+	vpnCertKeyLength = 2048
+)
+
+// vpnCertificate is a certificate with its private key, as stored on disk.
+type vpnCertificate struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+}
+
+// EnsureVPNCertificates loads or generates the VPN root certificate and a client certificate per client name.
+// They are stored as PEM files in outputDir. Returns the base64-encoded DER of the root certificate,
+// as expected by the VPN gateway.
+func EnsureVPNCertificates(outputDir string, clientNames []string) string {
+	logger := logrus.WithField("outputDir", outputDir)
+	if err := os.MkdirAll(outputDir, 0700); err != nil {
+		logger.WithError(err).Fatal("unable to create VPN output directory")
+	}
+
+	root := ensureVPNCertificate(outputDir, vpnRootName, nil)
+	for _, clientName := range clientNames {
+		ensureVPNCertificate(outputDir, clientName, &root)
+	}
+
+	return base64.StdEncoding.EncodeToString(root.cert.Raw)
+}
+
+// ensureVPNCertificate loads a certificate from disk, or generates it when it doesn't exist yet.
+// When parent is nil, a self-signed root certificate is generated; otherwise a client certificate signed by parent.
+func ensureVPNCertificate(outputDir, name string, parent *vpnCertificate) vpnCertificate {
+	certPath := filepath.Join(outputDir, name+".crt")
+	keyPath := filepath.Join(outputDir, name+".key")
+	logger := logrus.WithField("certificate", certPath)
+
+	if loaded, ok := loadVPNCertificate(certPath, keyPath); ok {
+		logger.Debug("using existing VPN certificate")
+		return loaded
+	}
+
+	logger.Info("generating VPN certificate")
+	key, err := rsa.GenerateKey(rand.Reader, vpnCertKeyLength)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to generate private key")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		logger.WithError(err).Fatal("unable to generate serial number")
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-1 * time.Hour),
+		NotAfter:     now.Add(vpnCertValidity),
+	}
+
+	signerCert := &template
+	signerKey := key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		signerCert = parent.cert
+		signerKey = parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to create certificate")
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to parse generated certificate")
+	}
+
+	writePEM(keyPath, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), 0600)
+	writePEM(certPath, "CERTIFICATE", der, 0644)
+	return vpnCertificate{cert, key}
+}
+
+func loadVPNCertificate(certPath, keyPath string) (vpnCertificate, bool) {
+	certBlock := readPEM(certPath)
+	keyBlock := readPEM(keyPath)
+	if certBlock == nil || keyBlock == nil {
+		return vpnCertificate{}, false
+	}
+
+	logger := logrus.WithField("certificate", certPath)
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to parse certificate")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to parse private key")
+	}
+	return vpnCertificate{cert, key}, true
+}
+
+// readPEM returns the first PEM block in the file, or nil if the file does not exist.
+func readPEM(filename string) *pem.Block {
+	contents, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		logrus.WithField("filename", filename).WithError(err).Fatal("unable to read file")
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		logrus.WithField("filename", filename).Fatal("file contains no PEM data")
+	}
+	return block
+}
+
+func writePEM(filename, blockType string, data []byte, mode os.FileMode) {
+	contents := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data})
+	if err := ioutil.WriteFile(filename, contents, mode); err != nil {
+		logrus.WithField("filename", filename).WithError(err).Fatal("unable to write file")
+	}
+}
@@ -0,0 +1,111 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package aznetwork
+
+import (
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/sirupsen/logrus"
+)
+
+// VPNMountInfo describes what VPN clients can reach, for writing mount instructions.
+type VPNMountInfo struct {
+	ManagerFQDN      string
+	ManagerPrivateIP string
+	StorageAccount   string
+	StorageHost      string   // like "saflamenco.file.core.windows.net"
+	StoragePrivateIP string   // private endpoint address; empty when there is none
+	Shares           []string // names of the SMB shares
+	Clients          []string // names of the VPN clients
+}
+
+var vpnInstructions = template.Must(template.New("vpn").Parse(`# Connecting to Flamenco via the VPN
+
+This directory contains everything needed to connect to the Flamenco virtual network:
+
+- vpn-client-configuration.zip: VPN client configuration generated by Azure.
+- {{ range .Clients }}{{ . }}.crt/.key, {{ end }}one certificate per client.
+- flamenco-vpn-root.crt/.key: root certificate. Keep the key safe; it is only needed to create new clients.
+
+Most VPN clients want the client certificate as PKCS#12 file. Convert it with:
+
+    openssl pkcs12 -export -in CLIENT.crt -inkey CLIENT.key -certfile flamenco-vpn-root.crt -out CLIENT.pfx
+
+Import CLIENT.pfx into the operating system's certificate store, then install the VPN profile from
+the ZIP file (Windows: WindowsAmd64/VpnClientSetupAmd64.exe; macOS and Linux: Generic/VpnSettings.xml
+for an IKEv2 connection).
+
+## Flamenco Manager
+
+Once connected, Flamenco Manager is reachable at https://{{ .ManagerFQDN }}/, and via its private
+address {{ .ManagerPrivateIP }} on ports 8080 (HTTP) and 8443 (HTTPS).
+
+## Mounting the shares
+{{ if .StoragePrivateIP }}
+The VPN does not provide DNS, so map the storage account to its private endpoint by adding this line
+to the hosts file (Windows: C:\Windows\System32\drivers\etc\hosts; macOS and Linux: /etc/hosts):
+
+    {{ .StoragePrivateIP }} {{ .StorageHost }}
+
+The username is "{{ .StorageAccount }}", and the password is the storage account key. Get it with:
+
+    az storage account keys list --account-name {{ .StorageAccount }} --query [0].value --output tsv
+{{ range .Shares }}
+### {{ . }}
+
+- Windows: net use * \\{{ $.StorageHost }}\{{ . }} /user:Azure\{{ $.StorageAccount }} STORAGE-KEY
+- macOS: open smb://{{ $.StorageAccount }}@{{ $.StorageHost }}/{{ . }} in Finder (Go, Connect to Server)
+- Linux: sudo mount -t cifs //{{ $.StorageHost }}/{{ . }} /mnt/{{ . }} -o vers=3.0,username={{ $.StorageAccount }},password=STORAGE-KEY,serverino
+{{ end }}{{ else }}
+The storage account has no private endpoint, so SMB traffic does not go through the VPN.
+Set storageNetwork.privateEndpoint in the configuration file and re-run the deployment.
+{{ end }}`))
+
+// WriteVPNInstructions writes per-OS instructions for connecting to the VPN and mounting the shares.
+func WriteVPNInstructions(config azconfig.AZConfig, info VPNMountInfo) {
+	if config.VPN == nil {
+		return
+	}
+	vpnConfig := config.VPN.WithDefaults()
+	info.Clients = vpnConfig.Clients
+
+	filename := filepath.Join(vpnConfig.OutputDir, "README.md")
+	logger := logrus.WithField("filename", filename)
+
+	outfile, err := os.Create(filename)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to create VPN instructions")
+	}
+	defer outfile.Close()
+
+	if err := vpnInstructions.Execute(outfile, info); err != nil {
+		logger.WithError(err).Fatal("unable to write VPN instructions")
+	}
+	if info.StoragePrivateIP == "" {
+		logger.Warning("storage account has no private endpoint, shares cannot be mounted via the VPN")
+	}
+	logger.Info("VPN instructions written")
+}
@@ -112,6 +112,7 @@ func EnsureResourceGroup(ctx context.Context, config *azconfig.AZConfig, groupNa
 func createResourceGroup(ctx context.Context, config azconfig.AZConfig) (resources.Group, bool) {
 	groupsClient := resources.NewGroupsClient(config.SubscriptionID)
 	groupsClient.Authorizer = azauth.Load(azure.PublicCloud.ResourceManagerEndpoint)
+	groupsClient.Sender = azauth.Sender()
 	// groupsClient.RequestInspector = azdebug.LogRequest()
 	// groupsClient.ResponseInspector = azdebug.LogResponse()
 
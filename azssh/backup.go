@@ -0,0 +1,112 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azssh
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Azure/flamenco-manager-azure/flamenco"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	backupScriptName      = "flamenco-manager-backup.sh"
+	backupCredentialsName = "flamenco-backup.smbcredentials"
+	restoredConfigName    = "restored-flamenco-manager.yaml"
+)
+
+// prepareBackupScript sends the backup script and the credentials for the backup share to the VM.
+func (c *Connection) prepareBackupScript(smbCredentials []byte) {
+	c.UploadStaticFile(backupScriptName)
+	c.Upload(smbCredentials, backupCredentialsName, FileOptions{Mode: 0600})
+}
+
+// Backup stores a backup of MongoDB and the Manager config on the backup share,
+// and removes all but the 'keep' most recent backups.
+func (c *Connection) Backup(ctx context.Context, share string, smbCredentials []byte, archiveName string, keep int) {
+	logger := c.logger.WithFields(logrus.Fields{
+		"share":   share,
+		"archive": archiveName,
+		"keep":    keep,
+	})
+	logger.Info("creating backup")
+
+	c.prepareBackupScript(smbCredentials)
+	c.loggingRun(ctx, logger, "bash %s backup %s %s %d", backupScriptName, share, archiveName, keep)
+	logger.Info("backup completed")
+}
+
+// ListBackups returns the names of the backups on the backup share, most recent first.
+func (c *Connection) ListBackups(share string, smbCredentials []byte) []string {
+	c.prepareBackupScript(smbCredentials)
+	output := c.run("bash %s list %s", backupScriptName, share)
+	if output == "" {
+		return []string{}
+	}
+	return strings.Split(output, "\n")
+}
+
+// ManagerSettings are the settings in flamenco-manager.yaml that are specific to a deployment.
+type ManagerSettings struct {
+	FQDN             string
+	WorkerSecret     string
+	Location         string
+	BatchAccountName string
+}
+
+// Restore replaces the MongoDB database and the Manager config with the ones from the backup.
+// The config is adjusted to the settings of this deployment, so that a backup can be restored
+// on another VM or in another deployment.
+func (c *Connection) Restore(ctx context.Context, share string, smbCredentials []byte, archiveName string, settings ManagerSettings) {
+	logger := c.logger.WithFields(logrus.Fields{
+		"share":            share,
+		"archive":          archiveName,
+		"managerFQDN":      settings.FQDN,
+		"location":         settings.Location,
+		"batchAccountName": settings.BatchAccountName,
+	})
+	logger.Info("restoring backup")
+
+	c.prepareBackupScript(smbCredentials)
+	c.run("bash %s extract-config %s %s %s", backupScriptName, share, archiveName, restoredConfigName)
+	adjusted, err := flamenco.SetManagerConfigValues(c.Download(restoredConfigName), settings.configValues())
+	if err != nil {
+		logger.WithError(err).Fatal("unable to adjust flamenco-manager.yaml from the backup to this deployment")
+	}
+	c.Upload(adjusted, restoredConfigName, FileOptions{Mode: 0600})
+
+	c.loggingRun(ctx, logger, "bash %s restore %s %s %s", backupScriptName, share, archiveName, restoredConfigName)
+	logger.Info("restore completed")
+}
+
+// configValues returns the values to set in flamenco-manager.yaml, by dotted path.
+func (s ManagerSettings) configValues() map[string]string {
+	return map[string]string{
+		"acme_domain_name":                                s.FQDN,
+		"own_url":                                         "https://" + s.FQDN + "/",
+		"worker_registration_secret":                      s.WorkerSecret,
+		"dynamic_pool_platforms.azure.location":           s.Location,
+		"dynamic_pool_platforms.azure.batch_account_name": s.BatchAccountName,
+	}
+}
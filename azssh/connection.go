@@ -23,10 +23,14 @@
 package azssh
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"strings"
 	"time"
 
+	"github.com/pkg/sftp"
 	"github.com/sirupsen/logrus"
 
 	"golang.org/x/crypto/ssh"
@@ -34,35 +38,192 @@ import (
 
 // Connection models an SSH connection
 type Connection struct {
-	sshContext Context
-	client     *ssh.Client
-	logger     *logrus.Entry
+	sshContext  Context
+	client      *ssh.Client
+	jumpClients []*ssh.Client // connections to the jump hosts, in the order they were made
+	sftpClient  *sftp.Client  // started on first use; see Connection.sftp()
+	logger      *logrus.Entry
 }
 
-// Connect connects to a machine via SSH.
-func Connect(sshContext Context, address string) Connection {
+// errHandshakeTimeout is returned when the SSH server does not complete the handshake in time.
+var errHandshakeTimeout = errors.New("ssh: handshake timed out")
+
+// jumpHostError is returned when the connection to a jump host fails.
+type jumpHostError struct {
+	address string
+	err     error
+}
+
+func (e jumpHostError) Error() string {
+	return fmt.Sprintf("jump host %s: %v", e.address, e.err)
+}
+
+const (
+	// loggingRun gives up when a command has been silent for this long.
+	loggingRunIdleTimeout = 5 * time.Minute
+
+	connectInitialBackoff = 2 * time.Second
+	connectMaxBackoff     = 30 * time.Second
+)
+
+// Connect connects to a machine via SSH. Network errors are retried with exponential backoff, as sshd
+// may not accept connections yet right after the VM has started. Authentication and host key errors
+// are not retried. Errors are fatal.
+func Connect(ctx context.Context, sshContext Context, address string) Connection {
 	if !strings.ContainsRune(address, ':') {
 		address = address + ":22"
 	}
-
-	client, err := ssh.Dial("tcp", address, sshContext.sshConfig)
 	logger := logrus.WithField("remoteAddress", address)
+
+	ctx, cancel := context.WithTimeout(ctx, sshContext.connectDeadline)
+	defer cancel()
+
+	backoff := connectInitialBackoff
+	for attempt := 1; ; attempt++ {
+		client, jumpClients, err := dial(ctx, address, sshContext)
+		if err == nil {
+			return Connection{
+				sshContext:  sshContext,
+				client:      client,
+				jumpClients: jumpClients,
+				logger:      logger,
+			}
+		}
+
+		attemptLogger := logger.WithFields(logrus.Fields{
+			logrus.ErrorKey: err,
+			"attempt":       attempt,
+			"maxAttempts":   sshContext.connectAttempts,
+		})
+		switch {
+		case !isRetryable(err):
+			attemptLogger.Fatal("SSH connection failed")
+		case attempt >= sshContext.connectAttempts:
+			attemptLogger.Fatal("SSH connection failed, giving up")
+		}
+
+		attemptLogger.WithField("retryIn", backoff).Warning("SSH connection failed, will retry")
+		select {
+		case <-ctx.Done():
+			logger.WithField("deadline", sshContext.connectDeadline).Fatal("SSH connection failed, giving up")
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > connectMaxBackoff {
+			backoff = connectMaxBackoff
+		}
+	}
+}
+
+// dial connects to the address via the jump hosts, if any. Apart from the client for the address itself,
+// it returns the clients for the jump hosts; these have to be closed after the former.
+func dial(ctx context.Context, address string, sshContext Context) (*ssh.Client, []*ssh.Client, error) {
+	dialFunc := func(network, address string) (net.Conn, error) {
+		return sshContext.dial(ctx, network, address)
+	}
+
+	jumpClients := []*ssh.Client{}
+	for _, jump := range sshContext.jumpHosts {
+		logrus.WithFields(logrus.Fields{
+			"jumpHost": jump.address,
+			"user":     jump.config.User,
+		}).Debug("connecting to jump host")
+		client, err := handshake(ctx, dialFunc, jump.address, jump.config)
+		if err != nil {
+			closeClients(jumpClients)
+			return nil, nil, jumpHostError{jump.address, err}
+		}
+		jumpClients = append(jumpClients, client)
+		dialFunc = client.Dial
+	}
+
+	client, err := handshake(ctx, dialFunc, address, sshContext.sshConfig)
 	if err != nil {
-		logrus.WithError(err).Fatal("SSH connection failed")
+		closeClients(jumpClients)
+		return nil, nil, err
 	}
+	return client, jumpClients, nil
+}
+
+// handshake connects to the address and sets up the SSH connection. It gives up after the configured
+// timeout, as sshd may accept connections before it's able to talk, or when the context is done.
+func handshake(ctx context.Context, dialFunc func(network, address string) (net.Conn, error),
+	address string, config *ssh.ClientConfig) (*ssh.Client, error) {
 
-	return Connection{
-		sshContext,
-		client,
-		logger,
+	conn, err := dialFunc("tcp", address)
+	if err != nil {
+		return nil, err
 	}
+
+	type result struct {
+		client *ssh.Client
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		clientConn, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+		if err != nil {
+			done <- result{nil, err}
+			return
+		}
+		done <- result{ssh.NewClient(clientConn, chans, reqs), nil}
+	}()
+
+	timer := time.NewTimer(config.Timeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		if res.err != nil {
+			conn.Close()
+		}
+		return res.client, res.err
+	case <-timer.C:
+		conn.Close()
+		return nil, errHandshakeTimeout
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func closeClients(clients []*ssh.Client) {
+	for idx := len(clients) - 1; idx >= 0; idx-- {
+		clients[idx].Close()
+	}
+}
+
+// isRetryable returns whether the connection error may go away by trying again.
+// The SSH library reports handshake errors as plain strings, so those have to be matched on.
+func isRetryable(err error) bool {
+	if jumpErr, isJumpErr := err.(jumpHostError); isJumpErr {
+		err = jumpErr.err
+	}
+	if _, isNetError := err.(net.Error); isNetError {
+		return true
+	}
+	message := err.Error()
+	for _, permanent := range []string{"unable to authenticate", "knownhosts:", "host key"} {
+		if strings.Contains(message, permanent) {
+			return false
+		}
+	}
+	// Anything else, like "connection refused" or sshd closing the connection during the handshake.
+	return true
 }
 
 // Close closes the SSH connection.
 func (c *Connection) Close() {
+	if c.sftpClient != nil {
+		if err := c.sftpClient.Close(); err != nil {
+			c.logger.WithError(err).Error("error closing SFTP session")
+		}
+		c.sftpClient = nil
+	}
 	if err := c.client.Close(); err != nil {
 		c.logger.WithError(err).Error("error closing SSH connection")
 	}
+	closeClients(c.jumpClients)
 }
 
 // Run a command, return the output. Errors are fatal.
@@ -91,61 +252,18 @@ func (c *Connection) run(cmd string, args ...interface{}) string {
 	return stringOut
 }
 
-// loggingRun runs a command and logs its output. Errors are fatal.
-func (c *Connection) loggingRun(logger *logrus.Entry, cmd string, args ...interface{}) {
-	session, err := c.client.NewSession()
-	if err != nil {
-		c.logger.WithError(err).Fatal("error creating SSH session")
-	}
-	defer session.Close()
-
-	stdoutReader, err := session.StdoutPipe()
-	if err != nil {
-		logger.WithError(err).Fatal("unable to open stdout pipe")
-	}
-	stderrReader, err := session.StderrPipe()
-	if err != nil {
-		logger.WithError(err).Fatal("unable to open stderr pipe")
-	}
-	stdoutLines, stdoutErr := LineReader(stdoutReader)
-	stderrLines, stderrErr := LineReader(stderrReader)
-
+// loggingRun runs a command and logs its output. Errors are fatal, and so is the context
+// being done, as the command was stopped before it completed.
+func (c *Connection) loggingRun(ctx context.Context, logger *logrus.Entry, cmd string, args ...interface{}) {
 	command := fmt.Sprintf(cmd, args...)
-	if err := session.Start(command); err != nil {
-		logger.WithError(err).Fatal("unable to start command")
+	err := c.Stream(ctx, command, loggingRunIdleTimeout, func(channel, line string) {
+		logger.WithField("channel", channel).Info(line)
+	})
+	if err != nil {
+		logger.WithError(err).Fatal("command exited with an error")
 	}
-
-	doneChan := make(chan error)
-	go func() {
-		doneChan <- session.Wait()
-		close(doneChan)
-	}()
-
-	func() {
-		for {
-			select {
-			case line := <-stdoutLines:
-				logger.WithField("channel", "stdout").Info(line)
-			case line := <-stderrLines:
-				logger.WithField("channel", "stderr").Info(line)
-			case err := <-doneChan:
-				if err != nil {
-					logger.WithError(err).Fatal("command exited with an error")
-				}
-				logger.Debug("command completed")
-				return
-			case <-time.After(5 * time.Minute):
-				logger.Fatal("timeout waiting for command output")
-			}
-		}
-	}()
-
-	outErr := stdoutErr()
-	errErr := stderrErr()
-	if outErr != nil || errErr != nil {
-		logger.WithFields(logrus.Fields{
-			"stdoutErr": outErr,
-			"stderrErr": errErr,
-		}).Fatal("error reading stdout/err")
+	if ctx.Err() != nil {
+		logger.Fatal("aborted")
 	}
+	logger.Debug("command completed")
 }
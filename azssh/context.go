@@ -23,76 +23,112 @@
 package azssh
 
 import (
+	"bytes"
+	"context"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
+	"os/user"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
 	"github.com/Azure/flamenco-manager-azure/flamenco"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/net/proxy"
 )
 
 // Context provides everything necessary to connect via SSH.
 type Context struct {
 	sshConfig *ssh.ClientConfig
+
+	connectAttempts int
+	connectDeadline time.Duration
+
+	// dial makes the TCP connection to the first hop, either directly or via a SOCKS5 proxy.
+	dial      func(ctx context.Context, network, address string) (net.Conn, error)
+	jumpHosts []jumpHost
 }
 
-func keyfileAuther() ssh.AuthMethod {
-	// If you have an encrypted private key, the crypto/x509 package
-	// can be used to decrypt it.
-	keyfile := os.ExpandEnv("$HOME/.ssh/id_rsa")
-	logger := logrus.WithField("keyfile", keyfile)
+// jumpHost is an SSH server to connect through, like OpenSSH's ProxyJump.
+type jumpHost struct {
+	address string
+	config  *ssh.ClientConfig
+}
 
-	key, err := ioutil.ReadFile(keyfile)
-	if err != nil {
-		logger.WithError(err).Info("unable to load private SSH key")
+func keyfileAuther(ctx context.Context, config azconfig.AZConfig, agentKeys []*agent.Key) ssh.AuthMethod {
+	keyfile := config.SSHPrivateKeyPath()
+	if keyfile == "" {
+		keyfile = findPrivateKey()
+	}
+	if keyfile == "" {
+		logrus.Info("no private SSH key file found")
 		return nil
 	}
 
-	// Create the Signer for this private key.
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		logger.WithField("reason", err).Info("unable to parse private key file")
-		return nil
+	// Don't bother asking for a passphrase when the SSH agent has the key loaded already.
+	if publicKey, err := ioutil.ReadFile(publicKeyPath(config, keyfile)); err == nil {
+		if parsed, _, _, _, err := ssh.ParseAuthorizedKey(publicKey); err == nil {
+			for _, agentKey := range agentKeys {
+				if bytes.Equal(agentKey.Marshal(), parsed.Marshal()) {
+					logrus.WithField("keyfile", keyfile).Info("private SSH key is loaded in SSH agent")
+					return nil
+				}
+			}
+		}
 	}
 
+	signer := loadSigner(ctx, keyfile, false)
+	if signer == nil {
+		return nil
+	}
 	return ssh.PublicKeys(signer)
 }
 
-func sshAgent() ssh.AuthMethod {
+// publicKeyPath returns the public key file that belongs to the private key file.
+func publicKeyPath(config azconfig.AZConfig, keyfile string) string {
+	if keyfile == config.SSHPrivateKeyPath() {
+		return config.SSHPublicKeyPath()
+	}
+	return keyfile + ".pub"
+}
+
+func sshAgent() (ssh.AuthMethod, []*agent.Key) {
 	agentAddr := os.Getenv("SSH_AUTH_SOCK")
 	if agentAddr == "" {
 		logrus.Info("no SSH_AUTH_SOCK set, not using SSH agent")
-		return nil
+		return nil, nil
 	}
 	logger := logrus.WithField("SSH_AUTH_SOCK", agentAddr)
 	sshAgent, err := net.Dial("unix", agentAddr)
 	if err != nil {
 		logger.WithError(err).Warning("unable to connect to SSH agent")
-		return nil
+		return nil, nil
 	}
 	agentClient := agent.NewClient(sshAgent)
 	keys, err := agentClient.List()
 	if err != nil {
 		logger.WithError(err).Warning("unable to list keys in SSH agent")
-		return nil
+		return nil, nil
 	}
 
 	if len(keys) == 0 {
 		logger.WithError(err).Warning("no keys loaded in SSH agent")
-		return nil
+		return nil, nil
 	}
 
 	logger.WithField("keysKnown", len(keys)).Info("using SSH agent")
-	return ssh.PublicKeysCallback(agentClient.Signers)
+	return ssh.PublicKeysCallback(agentClient.Signers), keys
 }
 
-// LoadSSHContext tries to find a private key to load.
-func LoadSSHContext() Context {
-	keyfileAuther := keyfileAuther()
-	agentAuth := sshAgent()
+// LoadSSHContext tries to find a private key to load, prompting for its passphrase when necessary.
+// Host keys are verified against the known_hosts file of the deployment; see tofuHostKeyCallback.
+func LoadSSHContext(ctx context.Context, config azconfig.AZConfig) Context {
+	agentAuth, agentKeys := sshAgent()
+	keyfileAuther := keyfileAuther(ctx, config, agentKeys)
 
 	authMethods := []ssh.AuthMethod{}
 	if keyfileAuther != ssh.AuthMethod(nil) {
@@ -107,14 +143,83 @@ func LoadSSHContext() Context {
 		logrus.Fatal("no SSH key available")
 	}
 
-	config := &ssh.ClientConfig{
+	sshConfig := &ssh.ClientConfig{
 		User:            flamenco.AdminUsername,
 		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // we don't know the hostname anyway
+		HostKeyCallback: tofuHostKeyCallback(config.KnownHostsPath()),
 		Timeout:         10 * time.Second,
 	}
 
 	return Context{
-		sshConfig: config,
+		sshConfig:       sshConfig,
+		connectAttempts: config.SSHConnectAttempts(),
+		connectDeadline: config.SSHConnectDeadline(),
+		dial:            socksDialer(config.SSHSOCKSProxy(), sshConfig.Timeout),
+		jumpHosts:       parseProxyJump(config.SSHProxyJump(), sshConfig),
+	}
+}
+
+// socksDialer returns a function that connects via the SOCKS5 proxy, or directly when the proxy URL is empty.
+func socksDialer(proxyURL string, timeout time.Duration) func(ctx context.Context, network, address string) (net.Conn, error) {
+	directDialer := &net.Dialer{Timeout: timeout}
+	if proxyURL == "" {
+		return directDialer.DialContext
+	}
+
+	logger := logrus.WithField("socksProxy", proxyURL)
+	parsedURL, err := url.Parse(proxyURL)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to parse SOCKS proxy URL")
+	}
+	dialer, err := proxy.FromURL(parsedURL, directDialer)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to use SOCKS proxy")
+	}
+	logger.Info("connecting via SOCKS proxy")
+
+	if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
+		return contextDialer.DialContext
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialer.Dial(network, address)
+	}
+}
+
+// parseProxyJump parses comma-separated "[user@]host[:port]" jump hosts. They are logged into with the
+// same keys as the VM; the user defaults to the local user, like OpenSSH does.
+func parseProxyJump(proxyJump string, vmConfig *ssh.ClientConfig) []jumpHost {
+	jumpHosts := []jumpHost{}
+	if proxyJump == "" {
+		return jumpHosts
+	}
+
+	for _, spec := range strings.Split(proxyJump, ",") {
+		spec = strings.TrimSpace(spec)
+		logger := logrus.WithField("jumpHost", spec)
+
+		username := ""
+		address := spec
+		if at := strings.LastIndex(spec, "@"); at >= 0 {
+			username, address = spec[:at], spec[at+1:]
+		}
+		if username == "" {
+			localUser, err := user.Current()
+			if err != nil {
+				logger.WithError(err).Fatal("unable to determine local username for jump host")
+			}
+			username = localUser.Username
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, "22")
+		}
+		if address == "" || strings.HasPrefix(address, ":") {
+			logger.Fatal("invalid jump host")
+		}
+
+		config := *vmConfig
+		config.User = username
+		jumpHosts = append(jumpHosts, jumpHost{address, &config})
+		logger.WithField("user", username).Info("connecting via jump host")
 	}
+	return jumpHosts
 }
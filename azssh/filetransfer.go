@@ -23,21 +23,35 @@
 package azssh
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"io/ioutil"
+	"os"
 	"path"
 	"strings"
 
+	"github.com/Azure/flamenco-manager-azure/flamenco"
+	"github.com/pkg/sftp"
 	"github.com/sirupsen/logrus"
 )
 
-// UploadStaticFile reads a local file from 'files-static' and sends it to the server via SSH.
-// WARNING: the given filename must be a simple name, no spaces, no directory, no need for shell escaping.
+// FileOptions determine how an uploaded file is stored on the server.
+type FileOptions struct {
+	// File permissions; 0644 when zero.
+	Mode os.FileMode
+	// Owner as "user" or "user:group". When given, the file is put in place via sudo;
+	// otherwise it is owned by the SSH user.
+	Owner string
+}
+
+// UploadStaticFile sends a file from 'files-static' to the server's home directory.
 func (c *Connection) UploadStaticFile(filename string) {
-	c.UploadLocalFile(path.Join("files-static", filename))
+	c.UploadAsFile(flamenco.StaticFile(filename), filename)
 }
 
-// UploadLocalFile reads a local file and sends it to the server via SSH.
-// WARNING: the given filename must be a simple name, no spaces, no directory, no need for shell escaping.
+// UploadLocalFile reads a local file and sends it to the server's home directory.
 func (c *Connection) UploadLocalFile(filename string) {
 	logger := c.logger.WithField("filename", filename)
 
@@ -49,32 +63,177 @@ func (c *Connection) UploadLocalFile(filename string) {
 }
 
 // UploadAsFile sends bytes to the SSH server and stores them in a file.
-// WARNING: the given filename must be a simple name, no spaces, no directory, no need for shell escaping.
+// Relative paths are relative to the home directory of the SSH user.
 func (c *Connection) UploadAsFile(content []byte, filename string) {
-	logger := c.logger.WithField("filename", filename)
+	c.Upload(content, filename, FileOptions{})
+}
+
+// Upload sends bytes to the SSH server and stores them in a file, replacing it atomically.
+// The SHA-256 checksum is verified before the file is put in place. Errors are fatal.
+func (c *Connection) Upload(content []byte, remotePath string, options FileOptions) {
+	mode := options.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+	logger := c.logger.WithFields(logrus.Fields{
+		"remotePath": remotePath,
+		"mode":       mode,
+		"size":       len(content),
+	})
+	if options.Owner != "" {
+		logger = logger.WithField("owner", options.Owner)
+	}
+	logger.Info("sending file")
+
+	checksum := sha256sum(content)
+	dir, name := path.Split(remotePath)
+	tempName := "." + name + ".upload-" + randomSuffix()
+
+	if options.Owner == "" {
+		tempPath := path.Join(dir, tempName)
+		c.writeViaSFTP(logger, content, tempPath, mode)
+		c.verifyChecksum(logger, tempPath, checksum, false)
+		if err := c.sftp(logger).PosixRename(tempPath, remotePath); err != nil {
+			logger.WithError(err).Fatal("unable to move uploaded file into place")
+		}
+		return
+	}
+
+	// The SSH user cannot write there, so stage the file in its home directory first.
+	stagingPath := tempName
+	c.writeViaSFTP(logger, content, stagingPath, 0600)
+	c.verifyChecksum(logger, stagingPath, checksum, false)
 
-	session, err := c.client.NewSession()
+	user, group := splitOwner(options.Owner)
+	installCmd := "sudo install -D -o " + ShellQuote(user)
+	if group != "" {
+		installCmd += " -g " + ShellQuote(group)
+	}
+	tempPath := path.Join(dir, tempName)
+	c.run("%s -m %o %s %s && sudo mv -f %s %s && rm -f %s",
+		installCmd, mode, ShellQuote(stagingPath), ShellQuote(tempPath),
+		ShellQuote(tempPath), ShellQuote(remotePath), ShellQuote(stagingPath))
+	c.verifyChecksum(logger, remotePath, checksum, true)
+}
+
+// Download returns the contents of a file on the SSH server, after verifying its SHA-256 checksum.
+// Relative paths are relative to the home directory of the SSH user. Errors are fatal.
+func (c *Connection) Download(remotePath string) []byte {
+	logger := c.logger.WithField("remotePath", remotePath)
+	logger.Info("receiving file")
+
+	file, err := c.sftp(logger).Open(remotePath)
 	if err != nil {
-		logger.WithError(err).Fatal("error creating SSH session")
+		logger.WithError(err).Fatal("unable to open remote file")
 	}
-	defer session.Close()
+	defer file.Close()
 
-	logger.Info("sending file")
-	pipe, err := session.StdinPipe()
+	content, err := ioutil.ReadAll(file)
 	if err != nil {
-		logger.WithError(err).Fatal("unable to create pipe")
+		logger.WithError(err).Fatal("unable to read remote file")
+	}
+	c.verifyChecksum(logger, remotePath, sha256sum(content), false)
+	return content
+}
+
+// DownloadToFile stores a file from the SSH server in a local file, replacing it atomically.
+func (c *Connection) DownloadToFile(remotePath, localPath string, mode os.FileMode) {
+	content := c.Download(remotePath)
+
+	logger := c.logger.WithFields(logrus.Fields{
+		"remotePath": remotePath,
+		"localPath":  localPath,
+	})
+	tmpname := localPath + "~"
+	if err := ioutil.WriteFile(tmpname, content, mode); err != nil {
+		logger.WithError(err).Fatal("unable to write local file")
 	}
-	go func() {
-		pipe.Write(content)
-		pipe.Close()
-	}()
+	if err := os.Rename(tmpname, localPath); err != nil {
+		logger.WithError(err).Fatal("unable to rename local file")
+	}
+}
 
-	combinedOut, err := session.CombinedOutput("cat > " + filename)
+// sftp returns the SFTP client of this connection, starting it when necessary.
+func (c *Connection) sftp(logger *logrus.Entry) *sftp.Client {
+	if c.sftpClient != nil {
+		return c.sftpClient
+	}
+	client, err := sftp.NewClient(c.client)
 	if err != nil {
-		stringOut := strings.TrimSpace(string(combinedOut))
+		logger.WithError(err).Fatal("unable to start SFTP session")
+	}
+	c.sftpClient = client
+	return client
+}
+
+func (c *Connection) writeViaSFTP(logger *logrus.Entry, content []byte, remotePath string, mode os.FileMode) {
+	client := c.sftp(logger)
+	if dir := path.Dir(remotePath); dir != "." {
+		if err := client.MkdirAll(dir); err != nil {
+			logger.WithError(err).Fatal("unable to create remote directory")
+		}
+	}
+
+	// SFTP creates files with the server's umask, and this SFTP client cannot pass permissions when
+	// opening a file. Create it empty and private first, so that the contents are never readable by
+	// others, not even before the permissions are set.
+	c.run("umask 077 && : > %s", ShellQuote(remotePath))
+	file, err := client.OpenFile(remotePath, os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to create remote file")
+	}
+	if _, err := file.ReadFrom(bytes.NewReader(content)); err != nil {
+		file.Close()
+		logger.WithError(err).Fatal("unable to write remote file")
+	}
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		logger.WithError(err).Fatal("unable to set permissions of remote file")
+	}
+	if err := file.Close(); err != nil {
+		logger.WithError(err).Fatal("unable to close remote file")
+	}
+}
+
+// verifyChecksum compares the SHA-256 checksum of a remote file with the expected one.
+func (c *Connection) verifyChecksum(logger *logrus.Entry, remotePath, expected string, useSudo bool) {
+	command := "sha256sum -- %s"
+	if useSudo {
+		command = "sudo " + command
+	}
+	output := c.run(command, ShellQuote(remotePath))
+	actual := strings.Fields(output)
+	if len(actual) == 0 || actual[0] != expected {
 		logger.WithFields(logrus.Fields{
-			"output":        stringOut,
-			logrus.ErrorKey: err,
-		}).Fatal("error running command")
+			"expected": expected,
+			"actual":   output,
+		}).Fatal("checksum of remote file does not match")
+	}
+}
+
+func sha256sum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func randomSuffix() string {
+	randomBytes := make([]byte, 6)
+	if _, err := rand.Read(randomBytes); err != nil {
+		logrus.WithError(err).Fatal("unable to generate random bytes")
 	}
+	return hex.EncodeToString(randomBytes)
+}
+
+// splitOwner splits "user:group" into its parts; the group is optional.
+func splitOwner(owner string) (user, group string) {
+	parts := strings.SplitN(owner, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// ShellQuote quotes the string for use as a single argument in a shell command.
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
 }
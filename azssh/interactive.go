@@ -0,0 +1,110 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azssh
+
+import (
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// Interactive runs a command on the server with the local terminal attached, or a login shell when
+// the command is empty. Returns the exit status of the remote command.
+func (c *Connection) Interactive(command string) int {
+	logger := c.logger
+	if command != "" {
+		logger = logger.WithField("command", command)
+	}
+
+	session, err := c.client.NewSession()
+	if err != nil {
+		logger.WithError(err).Fatal("error creating SSH session")
+	}
+	defer session.Close()
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		width, height, err := term.GetSize(fd)
+		if err != nil {
+			logger.WithError(err).Fatal("unable to get terminal size")
+		}
+		termType := os.Getenv("TERM")
+		if termType == "" {
+			termType = "xterm-256color"
+		}
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+		if err := session.RequestPty(termType, height, width, modes); err != nil {
+			logger.WithError(err).Fatal("unable to request pseudo-terminal")
+		}
+
+		oldState, err := term.MakeRaw(fd)
+		if err != nil {
+			logger.WithError(err).Fatal("unable to put terminal in raw mode")
+		}
+		defer term.Restore(fd, oldState)
+
+		stopWatching := watchWindowSize(fd, session)
+		defer stopWatching()
+	}
+
+	if command == "" {
+		err = session.Shell()
+	} else {
+		err = session.Start(command)
+	}
+	if err != nil {
+		logger.WithError(err).Fatal("unable to start remote command")
+	}
+
+	switch err := session.Wait().(type) {
+	case nil:
+		return 0
+	case *ssh.ExitError:
+		return err.ExitStatus()
+	default:
+		logger.WithError(err).Error("SSH session ended without exit status")
+		return 255
+	}
+}
+
+// sendWindowSize tells the server about the current size of the local terminal.
+func sendWindowSize(fd int, session *ssh.Session) {
+	width, height, err := term.GetSize(fd)
+	if err != nil {
+		logrus.WithError(err).Debug("unable to get terminal size")
+		return
+	}
+	if err := session.WindowChange(height, width); err != nil {
+		logrus.WithError(err).Debug("unable to send terminal size")
+	}
+}
@@ -0,0 +1,250 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azssh
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/flamenco-manager-azure/textio"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// keyComment is added to the public key of generated key pairs.
+const keyComment = "flamenco_manager"
+
+// privateKeyCandidates are searched for in ~/.ssh when no key is configured, in this order.
+// The first ones are dedicated deployment keys, created by us or by the 'install' script.
+var privateKeyCandidates = []string{
+	"id_ed25519_flamenco_manager",
+	"id_ecdsa_flamenco_manager",
+	"id_rsa_flamenco_manager",
+	"id_ed25519",
+	"id_ecdsa",
+	"id_rsa",
+}
+
+// EnsureKeyPair makes sure there is an SSH key pair to access the Manager VM, and saves its paths
+// in the config. A configured key is used as-is, or generated when its file does not exist.
+// Otherwise the usual keys in ~/.ssh are tried, and when none exists a dedicated deployment key is generated.
+func EnsureKeyPair(ctx context.Context, config *azconfig.AZConfig) {
+	privateKey := config.SSHPrivateKeyPath()
+	publicKey := config.SSHPublicKeyPath()
+
+	if privateKey == "" {
+		privateKey = findPrivateKey()
+		if privateKey == "" {
+			privateKey = filepath.Join(sshDir(), fmt.Sprintf("id_%s_flamenco_manager", config.SSHKeyType()))
+		}
+		publicKey = privateKey + ".pub"
+	}
+
+	logger := logrus.WithFields(logrus.Fields{
+		"privateKey": privateKey,
+		"publicKey":  publicKey,
+	})
+
+	if _, err := os.Stat(privateKey); os.IsNotExist(err) {
+		generateKeyPair(privateKey, publicKey, config.SSHKeyType())
+	} else if err != nil {
+		logger.WithError(err).Fatal("unable to check private SSH key")
+	} else if _, err := os.Stat(publicKey); os.IsNotExist(err) {
+		logger.Info("public SSH key does not exist, deriving it from the private key")
+		signer := loadSigner(ctx, privateKey, true)
+		writePublicKey(publicKey, signer.PublicKey())
+	}
+
+	if privateKey != config.SSHPrivateKeyPath() || publicKey != config.SSHPublicKeyPath() {
+		logger.Info("using SSH key pair")
+		config.SetSSHKeyPair(privateKey, publicKey)
+		config.Save()
+	}
+}
+
+// PublicKey returns the public key of the deployment, in authorized_keys format.
+func PublicKey(config azconfig.AZConfig) string {
+	publicKey := config.SSHPublicKeyPath()
+	if publicKey == "" {
+		if privateKey := findPrivateKey(); privateKey != "" {
+			publicKey = privateKey + ".pub"
+		}
+	}
+	logger := logrus.WithField("publicKey", publicKey)
+	if publicKey == "" {
+		logger.Fatal("no public SSH key available")
+	}
+
+	keyData, err := ioutil.ReadFile(publicKey)
+	if err != nil {
+		logger.WithError(err).Fatal("failed to read SSH key data")
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey(keyData); err != nil {
+		logger.WithError(err).Fatal("unable to parse public SSH key")
+	}
+	return strings.TrimSpace(string(keyData))
+}
+
+// AuthorizedKeys returns the public keys that should be able to log in on the Manager VM:
+// the key of the deployment, plus the configured team keys.
+func AuthorizedKeys(config azconfig.AZConfig) []string {
+	keys := []string{PublicKey(config)}
+	for _, teamKey := range config.SSHTeamKeys() {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(teamKey)); err != nil {
+			logrus.WithFields(logrus.Fields{
+				logrus.ErrorKey: err,
+				"teamKey":       teamKey,
+			}).Fatal("unable to parse team SSH key")
+		}
+		keys = append(keys, teamKey)
+	}
+	return keys
+}
+
+func sshDir() string {
+	dir, err := homedir.Expand("~/.ssh")
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to find home directory")
+	}
+	return dir
+}
+
+// findPrivateKey returns the first of privateKeyCandidates that exists together with its public key,
+// or an empty string if there is none.
+func findPrivateKey() string {
+	for _, candidate := range privateKeyCandidates {
+		privateKey := filepath.Join(sshDir(), candidate)
+		if _, err := os.Stat(privateKey); err != nil {
+			continue
+		}
+		if _, err := os.Stat(privateKey + ".pub"); err != nil {
+			continue
+		}
+		return privateKey
+	}
+	return ""
+}
+
+// generateKeyPair creates a new, unencrypted key pair of the given type.
+func generateKeyPair(privateKey, publicKey, keyType string) {
+	logger := logrus.WithFields(logrus.Fields{
+		"privateKey": privateKey,
+		"publicKey":  publicKey,
+		"keyType":    keyType,
+	})
+
+	var cryptoKey crypto.PrivateKey
+	var err error
+	switch keyType {
+	case azconfig.SSHKeyTypeED25519:
+		_, cryptoKey, err = ed25519.GenerateKey(rand.Reader)
+	case azconfig.SSHKeyTypeECDSA:
+		cryptoKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case azconfig.SSHKeyTypeRSA:
+		cryptoKey, err = rsa.GenerateKey(rand.Reader, 4096)
+	default:
+		logger.Fatal("unsupported SSH key type")
+	}
+	if err != nil {
+		logger.WithError(err).Fatal("unable to generate SSH key")
+	}
+
+	pemBlock, err := ssh.MarshalPrivateKey(cryptoKey, keyComment)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to encode private SSH key")
+	}
+	signer, err := ssh.NewSignerFromKey(cryptoKey)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to construct public SSH key")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(privateKey), 0700); err != nil {
+		logger.WithError(err).Fatal("unable to create directory for SSH key")
+	}
+	if err := ioutil.WriteFile(privateKey, pem.EncodeToMemory(pemBlock), 0600); err != nil {
+		logger.WithError(err).Fatal("unable to write private SSH key")
+	}
+	writePublicKey(publicKey, signer.PublicKey())
+	logger.WithField("fingerprint", ssh.FingerprintSHA256(signer.PublicKey())).Info("generated SSH key pair")
+}
+
+func writePublicKey(publicKey string, key ssh.PublicKey) {
+	keyData := bytes.TrimSpace(ssh.MarshalAuthorizedKey(key))
+	keyData = append(keyData, []byte(" "+keyComment+"\n")...)
+	if err := ioutil.WriteFile(publicKey, keyData, 0644); err != nil {
+		logrus.WithField("publicKey", publicKey).WithError(err).Fatal("unable to write public SSH key")
+	}
+}
+
+// loadSigner reads a private key, prompting for its passphrase if it is protected by one.
+// Returns nil when the key cannot be used, unless mustLoad is true; then the process exits.
+func loadSigner(ctx context.Context, keyfile string, mustLoad bool) ssh.Signer {
+	logger := logrus.WithField("keyfile", keyfile)
+	fail := func(err error, message string) ssh.Signer {
+		if mustLoad {
+			logger.WithError(err).Fatal(message)
+		}
+		logger.WithField("reason", err).Info(message)
+		return nil
+	}
+
+	key, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return fail(err, "unable to load private SSH key")
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if _, isPassphraseMissing := err.(*ssh.PassphraseMissingError); !isPassphraseMissing {
+		if err != nil {
+			return fail(err, "unable to parse private key file")
+		}
+		return signer
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		passphrase, ok := textio.ReadPassword(ctx, fmt.Sprintf("Passphrase for %s", keyfile))
+		if !ok {
+			return fail(err, "unable to read passphrase")
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+		if err == nil {
+			return signer
+		}
+		logger.WithField("reason", err).Warning("unable to decrypt private key")
+	}
+	return fail(err, "unable to decrypt private key file")
+}
@@ -0,0 +1,183 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azssh
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// tofuHostKeyCallback verifies host keys against the known_hosts file. A host that is not in the file
+// yet is trusted on first use, and its key is added. A host whose key does not match is refused.
+func tofuHostKeyCallback(knownHostsFile string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		logger := logrus.WithFields(logrus.Fields{
+			"knownHostsFile": knownHostsFile,
+			"host":           hostname,
+			"fingerprint":    ssh.FingerprintSHA256(key),
+		})
+
+		if _, err := os.Stat(knownHostsFile); err == nil {
+			check, err := knownhosts.New(knownHostsFile)
+			if err != nil {
+				return err
+			}
+			err = check(hostname, remote, key)
+			keyErr, isKeyErr := err.(*knownhosts.KeyError)
+			if !isKeyErr {
+				// Either nil for a known key, or some other error.
+				return err
+			}
+			if len(keyErr.Want) > 0 {
+				logger.Error("SSH host key does not match the known host key; refusing to connect. " +
+					"If the VM was re-created, remove its line from the known_hosts file.")
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		logger.Warning("SSH host is unknown, trusting its key on first use")
+		return appendKnownHost(knownHostsFile, []string{hostname}, key)
+	}
+}
+
+func appendKnownHost(knownHostsFile string, addresses []string, key ssh.PublicKey) error {
+	file, err := os.OpenFile(knownHostsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintln(file, knownhosts.Line(addresses, key))
+	return err
+}
+
+// IsKnownHost returns whether the known_hosts file has any key for the address.
+func IsKnownHost(knownHostsFile, address string) bool {
+	lines, err := readKnownHosts(knownHostsFile)
+	if err != nil {
+		logrus.WithField("knownHostsFile", knownHostsFile).WithError(err).Fatal("unable to read known_hosts file")
+	}
+	for _, line := range lines {
+		if lineHasAddress(line, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForgetHost removes all keys for the address from the known_hosts file.
+// This is for when the VM has been re-created, and thus legitimately has new host keys.
+func ForgetHost(knownHostsFile, address string) {
+	logger := logrus.WithFields(logrus.Fields{
+		"knownHostsFile": knownHostsFile,
+		"address":        address,
+	})
+	lines, err := readKnownHosts(knownHostsFile)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to read known_hosts file")
+	}
+
+	kept := []string{}
+	for _, line := range lines {
+		if !lineHasAddress(line, address) {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) == len(lines) {
+		return
+	}
+
+	logger.Info("forgetting SSH host keys")
+	contents := strings.Join(kept, "\n")
+	if len(kept) > 0 {
+		contents += "\n"
+	}
+	if err := ioutil.WriteFile(knownHostsFile, []byte(contents), 0600); err != nil {
+		logger.WithError(err).Fatal("unable to write known_hosts file")
+	}
+}
+
+// PinHostKeys adds the host keys to the known_hosts file for all the given addresses.
+// The keys are in authorized_keys format, as found in /etc/ssh/ssh_host_*_key.pub.
+func PinHostKeys(knownHostsFile string, addresses []string, hostKeys []string) {
+	logger := logrus.WithFields(logrus.Fields{
+		"knownHostsFile": knownHostsFile,
+		"addresses":      addresses,
+	})
+	for _, hostKey := range hostKeys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+		if err != nil {
+			logger.WithField("hostKey", hostKey).WithError(err).Fatal("unable to parse SSH host key")
+		}
+		if err := appendKnownHost(knownHostsFile, addresses, key); err != nil {
+			logger.WithError(err).Fatal("unable to write known_hosts file")
+		}
+		logger.WithField("fingerprint", ssh.FingerprintSHA256(key)).Info("pinned SSH host key")
+	}
+}
+
+// readKnownHosts returns the non-empty lines of the known_hosts file; a missing file has none.
+func readKnownHosts(knownHostsFile string) ([]string, error) {
+	file, err := os.Open(knownHostsFile)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// lineHasAddress returns whether the known_hosts line is for the address.
+// Only plain host names are considered, as that is what this package writes.
+func lineHasAddress(line, address string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || strings.HasPrefix(line, "#") {
+		return false
+	}
+	wanted := knownhosts.Normalize(address)
+	for _, host := range strings.Split(fields[0], ",") {
+		if host == wanted {
+			return true
+		}
+	}
+	return false
+}
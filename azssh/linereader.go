@@ -28,18 +28,26 @@ import (
 )
 
 // LineReader scans the reader line-by-line and sends those lines to the channel.
-// The returned function can be used to obtain the first non-EOF error seen by the scanner.
-func LineReader(reader io.Reader) (<-chan string, func() error) {
+// The channel is closed when the reader is exhausted. After that, the returned function
+// can be used to obtain the first non-EOF error seen by the scanner. Closing 'done' stops
+// sending lines, so that the goroutine can exit when nobody reads the channel any more.
+func LineReader(done <-chan struct{}, reader io.Reader) (<-chan string, func() error) {
 	channel := make(chan string)
 	var err error
 
 	go func() {
 		scanner := bufio.NewScanner(reader)
 		for scanner.Scan() {
-			channel <- scanner.Text()
+			select {
+			case channel <- scanner.Text():
+			case <-done:
+				close(channel)
+				return
+			}
 		}
 
 		err = scanner.Err()
+		close(channel)
 	}()
 
 	return channel, func() error {
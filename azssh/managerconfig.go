@@ -0,0 +1,74 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azssh
+
+import (
+	"context"
+	"strings"
+)
+
+const (
+	configScriptName    = "flamenco-manager-config.sh"
+	mergedConfigName    = "merged-flamenco-manager.yaml"
+	configDefaultUpload = "last-default-flamenco-manager.yaml"
+	configDownload      = "download-flamenco-manager.yaml"
+)
+
+// ManagerConfig returns the live flamenco-manager.yaml, and the default config it is based on.
+// Either is empty when it does not exist on the VM.
+func (c *Connection) ManagerConfig() (live, base []byte) {
+	c.UploadStaticFile(configScriptName)
+	return c.fetchManagerConfig("live"), c.fetchManagerConfig("base")
+}
+
+// fetchManagerConfig downloads the live or base config byte for byte, so that it can be compared
+// with the rendered default. Returns nil when the file does not exist.
+func (c *Connection) fetchManagerConfig(which string) []byte {
+	out := c.run("bash %s fetch %s %s", configScriptName, which, configDownload)
+	if !strings.HasSuffix(out, "present") {
+		return nil
+	}
+	content := c.Download(configDownload)
+	c.run("rm -f %s", configDownload)
+	return content
+}
+
+// ApplyManagerConfig replaces flamenco-manager.yaml with the merged config, stores the default
+// it is now based on, and restarts Flamenco Manager. The previous config is kept as a backup.
+func (c *Connection) ApplyManagerConfig(ctx context.Context, merged, newDefault []byte) {
+	logger := c.logger.WithField("scriptName", configScriptName)
+	c.UploadStaticFile(configScriptName)
+	c.UploadAsFile(merged, mergedConfigName)
+	c.UploadAsFile(newDefault, configDefaultUpload)
+	c.loggingRun(ctx, logger, "bash %s apply %s %s", configScriptName, mergedConfigName, configDefaultUpload)
+	logger.Info("merged Flamenco Manager configuration applied")
+}
+
+// SetManagerConfigBase stores the default config that flamenco-manager.yaml is based on,
+// without changing flamenco-manager.yaml itself.
+func (c *Connection) SetManagerConfigBase(newDefault []byte) {
+	c.UploadStaticFile(configScriptName)
+	c.UploadAsFile(newDefault, configDefaultUpload)
+	c.run("bash %s set-base %s", configScriptName, configDefaultUpload)
+	c.logger.Debug("stored default Flamenco Manager configuration")
+}
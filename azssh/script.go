@@ -23,6 +23,8 @@
 package azssh
 
 import (
+	"context"
+
 	"github.com/sirupsen/logrus"
 	"github.com/Azure/flamenco-manager-azure/flamenco"
 )
@@ -35,10 +37,12 @@ func (c *Connection) SetupUsers() {
 }
 
 // RunInstallScript sends the install script to the VM and runs it there.
-func (c *Connection) RunInstallScript() {
+func (c *Connection) RunInstallScript(ctx context.Context) {
 	c.run("chmod +x %s", flamenco.InstallScriptName)
 
-	c.loggingRun(c.logger, "bash %s", flamenco.InstallScriptName)
+	// Keep the output on the VM as well, for the 'logs' command.
+	c.loggingRun(ctx, c.logger, "bash %s > >(tee -a %s) 2> >(tee -a %s >&2)",
+		flamenco.InstallScriptName, flamenco.InstallLogFile, flamenco.InstallLogFile)
 	c.logger.WithFields(logrus.Fields{
 		"scriptName": flamenco.InstallScriptName,
 	}).Info("installation script completed")
@@ -0,0 +1,49 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azssh
+
+import (
+	"fmt"
+
+	"github.com/Azure/flamenco-manager-azure/flamenco"
+)
+
+// ServiceStatus returns the state of the systemd units on the VM. Unlike most commands, errors are
+// returned rather than fatal, so that they end up in the deployment verification report.
+func (c *Connection) ServiceStatus(units []string) ([]flamenco.ServiceStatus, error) {
+	session, err := c.client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("creating SSH session: %w", err)
+	}
+	defer session.Close()
+
+	command := flamenco.ServiceStatusCommand(units)
+	c.logger.WithField("command", command).Debug("querying service status via SSH")
+	output, err := session.Output(command)
+	if err != nil {
+		return nil, fmt.Errorf("running %q: %w", command, err)
+	}
+	statuses := flamenco.ParseServiceStatus(string(output))
+	c.logger.WithField("services", statuses).Debug("queried service status")
+	return statuses, nil
+}
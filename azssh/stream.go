@@ -0,0 +1,114 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azssh
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrIdleTimeout is returned by Stream when the command produced no output for too long.
+var ErrIdleTimeout = errors.New("timeout waiting for command output")
+
+// Stream runs a command and calls handleLine for each line it outputs, with channel "stdout" or
+// "stderr". It returns when the command exits, or returns nil when the context is done, closing the
+// session. When idleTimeout is not zero, the command is abandoned after being silent for that long.
+func (c *Connection) Stream(ctx context.Context, command string, idleTimeout time.Duration,
+	handleLine func(channel, line string)) error {
+
+	logger := c.logger.WithField("command", command)
+	session, err := c.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stdoutReader, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderrReader, err := session.StderrPipe()
+	if err != nil {
+		return err
+	}
+	// Returning early, for example on a timeout, leaves lines unread; this lets the readers exit.
+	done := make(chan struct{})
+	defer close(done)
+	stdoutLines, stdoutErr := LineReader(done, stdoutReader)
+	stderrLines, stderrErr := LineReader(done, stderrReader)
+
+	logger.Debug("streaming output of command via SSH")
+	if err := session.Start(command); err != nil {
+		return err
+	}
+
+	var idleTimer <-chan time.Time
+	resetIdleTimer := func() {
+		if idleTimeout > 0 {
+			idleTimer = time.After(idleTimeout)
+		}
+	}
+	resetIdleTimer()
+
+	// Read until both channels are closed, so that no output is lost.
+	for stdoutLines != nil || stderrLines != nil {
+		select {
+		case line, ok := <-stdoutLines:
+			if !ok {
+				stdoutLines = nil
+				continue
+			}
+			handleLine("stdout", line)
+			resetIdleTimer()
+		case line, ok := <-stderrLines:
+			if !ok {
+				stderrLines = nil
+				continue
+			}
+			handleLine("stderr", line)
+			resetIdleTimer()
+		case <-idleTimer:
+			return ErrIdleTimeout
+		case <-ctx.Done():
+			logger.Debug("context done, stopping command")
+			// Not every SSH server supports signals; closing the session is what really stops it.
+			_ = session.Signal(ssh.SIGTERM)
+			return nil
+		}
+	}
+
+	if err := session.Wait(); err != nil {
+		return err
+	}
+	if err := stdoutErr(); err != nil {
+		return err
+	}
+	if err := stderrErr(); err != nil {
+		return err
+	}
+	logger.Debug("command completed")
+	return nil
+}
@@ -0,0 +1,99 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azssh
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PortForward describes a local address that is forwarded to an address as seen from the server.
+type PortForward struct {
+	LocalAddress  string
+	RemoteAddress string
+}
+
+// Tunnel forwards connections on the local addresses to the remote addresses via SSH,
+// until the context is done. Errors listening on the local addresses are fatal.
+func (c *Connection) Tunnel(ctx context.Context, forwards []PortForward) {
+	listeners := []net.Listener{}
+	for _, forward := range forwards {
+		logger := c.logger.WithFields(logrus.Fields{
+			"localAddress":  forward.LocalAddress,
+			"remoteAddress": forward.RemoteAddress,
+		})
+		listener, err := net.Listen("tcp", forward.LocalAddress)
+		if err != nil {
+			logger.WithError(err).Fatal("unable to listen on local address")
+		}
+		listeners = append(listeners, listener)
+		logger.Info("forwarding port")
+		go c.acceptForwards(logger, listener, forward.RemoteAddress)
+	}
+
+	<-ctx.Done()
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
+
+func (c *Connection) acceptForwards(logger *logrus.Entry, listener net.Listener, remoteAddress string) {
+	for {
+		localConn, err := listener.Accept()
+		if err != nil {
+			// Closing the listener is the normal way to stop.
+			logger.WithError(err).Debug("stopped accepting connections")
+			return
+		}
+		go c.forward(logger.WithField("client", localConn.RemoteAddr().String()), localConn, remoteAddress)
+	}
+}
+
+func (c *Connection) forward(logger *logrus.Entry, localConn net.Conn, remoteAddress string) {
+	defer localConn.Close()
+
+	remoteConn, err := c.client.Dial("tcp", remoteAddress)
+	if err != nil {
+		logger.WithError(err).Warning("unable to connect to remote address")
+		return
+	}
+	defer remoteConn.Close()
+	logger.Debug("forwarding connection")
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	copyAndClose := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		// Unblock the copy in the other direction.
+		dst.Close()
+	}
+	go copyAndClose(remoteConn, localConn)
+	go copyAndClose(localConn, remoteConn)
+	wg.Wait()
+	logger.Debug("connection closed")
+}
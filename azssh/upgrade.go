@@ -0,0 +1,55 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azssh
+
+import (
+	"context"
+
+	"github.com/Azure/flamenco-manager-azure/flamenco"
+	"github.com/sirupsen/logrus"
+)
+
+// Upgrade installs the Flamenco Manager and Worker versions from the components file, restarts
+// Flamenco Manager, and restores the previous version if it doesn't come up. Errors are fatal.
+func (c *Connection) Upgrade(ctx context.Context, componentsFile []byte) {
+	c.Upload(componentsFile, flamenco.ComponentsFileName, FileOptions{})
+	c.UploadStaticFile(flamenco.ComponentFunctionsName)
+	c.UploadStaticFile(flamenco.UpgradeScriptName)
+
+	logger := c.logger.WithField("scriptName", flamenco.UpgradeScriptName)
+	logger.Info("upgrading Flamenco")
+	// Keep the output on the VM as well, for the 'logs' command.
+	c.loggingRun(ctx, logger, "bash %s > >(tee -a %s) 2> >(tee -a %s >&2)",
+		flamenco.UpgradeScriptName, flamenco.InstallLogFile, flamenco.InstallLogFile)
+	logger.Info("upgrade completed")
+}
+
+// ReadLink returns the target of a symlink on the VM, or an empty string if there is no symlink.
+func (c *Connection) ReadLink(path string) string {
+	target := c.run("readlink %s || true", ShellQuote(path))
+	c.logger.WithFields(logrus.Fields{
+		"path":   path,
+		"target": target,
+	}).Debug("read symlink")
+	return target
+}
@@ -37,6 +37,7 @@ import (
 func getAccountClient(config azconfig.AZConfig) storage.AccountsClient {
 	accountClient := storage.NewAccountsClient(config.SubscriptionID)
 	accountClient.Authorizer = azauth.Load(azure.PublicCloud.ResourceManagerEndpoint)
+	accountClient.Sender = azauth.Sender()
 	// accountClient.RequestInspector = azdebug.LogRequest()
 	// accountClient.ResponseInspector = azdebug.LogResponse()
 	return accountClient
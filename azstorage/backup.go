@@ -0,0 +1,46 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azstorage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+)
+
+// BackupShareName is the SMB share that holds the backups of Flamenco Manager.
+// It is only mounted on the Manager VM, and only while making or restoring a backup.
+const BackupShareName = "flamenco-backup"
+
+// EnsureBackupShare creates the backup share if necessary, and returns its UNC path for mounting.
+func EnsureBackupShare(ctx context.Context, config azconfig.AZConfig) string {
+	createFileShare(ctx, getShareURL(config), BackupShareName)
+	return fmt.Sprintf("//%s/%s", Host(config), BackupShareName)
+}
+
+// SMBCredentials returns the contents of a credentials file for mount.cifs.
+func SMBCredentials(config azconfig.AZConfig) []byte {
+	return []byte(fmt.Sprintf("username=%s\npassword=%s\n",
+		config.StorageCreds.Username, config.StorageCreds.Password))
+}
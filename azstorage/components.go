@@ -0,0 +1,101 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azstorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/Azure/azure-storage-file-go/azfile"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/flamenco-manager-azure/flamenco"
+	"github.com/sirupsen/logrus"
+)
+
+// UploadComponentCache uploads the archives from the local component cache to the resources share,
+// where the setup script picks them up. Archives that are already there with the same MD5 are skipped.
+func UploadComponentCache(ctx context.Context, config azconfig.AZConfig, archivePaths []string) {
+	shareURL := getShareURL(config).NewShareURL(flamenco.ComponentCacheShare)
+	dirURL := shareURL.NewRootDirectoryURL().NewDirectoryURL(flamenco.ComponentCacheShareDir)
+	logger := logrus.WithFields(logrus.Fields{
+		"shareName": flamenco.ComponentCacheShare,
+		"directory": flamenco.ComponentCacheShareDir,
+	})
+
+	_, err := dirURL.Create(ctx, azfile.Metadata{})
+	if err != nil {
+		storageErr, ok := err.(azfile.StorageError)
+		if !ok || storageErr.ServiceCode() != azfile.ServiceCodeResourceAlreadyExists {
+			logger.WithError(err).Fatal("unable to create component cache directory on share")
+		}
+	}
+
+	for _, archivePath := range archivePaths {
+		uploadComponent(ctx, dirURL.NewFileURL(filepath.Base(archivePath)), archivePath, logger)
+	}
+	logger.WithField("numFiles", len(archivePaths)).Info("component cache uploaded")
+}
+
+func uploadComponent(ctx context.Context, fileURL azfile.FileURL, archivePath string, logger *logrus.Entry) {
+	logger = logger.WithField("filename", filepath.Base(archivePath))
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to open cached component")
+	}
+	defer file.Close()
+
+	hasher := md5.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to read cached component")
+	}
+	checksum := hasher.Sum(nil)
+
+	props, err := fileURL.GetProperties(ctx)
+	switch {
+	case err == nil && props.ContentLength() == size && bytes.Equal(props.ContentMD5(), checksum):
+		logger.Debug("component already on share")
+		return
+	case err != nil && !isNotFound(err):
+		logger.WithError(err).Fatal("unable to inspect component on share")
+	}
+
+	logger.WithField("size", size).Info("uploading component to share")
+	err = azfile.UploadFileToAzureFile(ctx, file, fileURL, azfile.UploadToAzureFileOptions{
+		FileHTTPHeaders: azfile.FileHTTPHeaders{ContentMD5: checksum},
+	})
+	if err != nil {
+		logger.WithError(err).Fatal("unable to upload component to share")
+	}
+}
+
+func isNotFound(err error) bool {
+	storageErr, ok := err.(azfile.StorageError)
+	return ok && storageErr.Response() != nil && storageErr.Response().StatusCode == http.StatusNotFound
+}
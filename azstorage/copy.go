@@ -0,0 +1,132 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azstorage
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/azure-storage-file-go/azfile"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/sirupsen/logrus"
+)
+
+// CopyShare copies all files and directories of a share to the same share in another storage account.
+// Azure performs the copy server-side; both configs must have their storage credentials loaded.
+// Existing files in the target share are overwritten.
+func CopyShare(ctx context.Context, source, target azconfig.AZConfig, shareName string) {
+	logger := logrus.WithFields(logrus.Fields{
+		"shareName":     shareName,
+		"sourceAccount": source.StorageAccountName,
+		"targetAccount": target.StorageAccountName,
+	})
+
+	// The target storage service reads the source files, so it needs a SAS token to do so.
+	credential, err := azfile.NewSharedKeyCredential(source.StorageCreds.Username, source.StorageCreds.Password)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to construct credentials for Azure Files")
+	}
+	sas, err := azfile.AccountSASSignatureValues{
+		Protocol:      azfile.SASProtocolHTTPS,
+		ExpiryTime:    time.Now().UTC().Add(24 * time.Hour),
+		Permissions:   azfile.AccountSASPermissions{Read: true, List: true}.String(),
+		Services:      azfile.AccountSASServices{File: true}.String(),
+		ResourceTypes: azfile.AccountSASResourceTypes{Container: true, Object: true}.String(),
+	}.NewSASQueryParameters(credential)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to construct SAS token for source share")
+	}
+
+	createFileShare(ctx, getShareURL(target), shareName)
+	sourceRoot := getShareURL(source).NewShareURL(shareName).NewRootDirectoryURL()
+	targetRoot := getShareURL(target).NewShareURL(shareName).NewRootDirectoryURL()
+
+	logger.Info("copying SMB share")
+	pending := copyDirectory(ctx, sourceRoot, targetRoot, sas, logger)
+	logger.WithField("numFiles", len(pending)).Info("waiting for file copies to complete")
+	for _, fileURL := range pending {
+		waitForCopy(ctx, fileURL, logger)
+	}
+	logger.Info("SMB share copied")
+}
+
+// copyDirectory recursively starts copying the directory contents, and returns the files being copied.
+func copyDirectory(ctx context.Context, source, target azfile.DirectoryURL, sas azfile.SASQueryParameters, logger *logrus.Entry) []azfile.FileURL {
+	pending := []azfile.FileURL{}
+	for marker := (azfile.Marker{}); marker.NotDone(); {
+		listing, err := source.ListFilesAndDirectoriesSegment(ctx, marker, azfile.ListFilesAndDirectoriesOptions{})
+		if err != nil {
+			logger.WithField("directory", source.String()).WithError(err).Fatal("unable to list directory")
+		}
+
+		for _, dir := range listing.DirectoryItems {
+			targetDir := target.NewDirectoryURL(dir.Name)
+			if _, err := targetDir.Create(ctx, azfile.Metadata{}); err != nil {
+				storageErr, ok := err.(azfile.StorageError)
+				if !ok || storageErr.ServiceCode() != azfile.ServiceCodeResourceAlreadyExists {
+					logger.WithField("directory", dir.Name).WithError(err).Fatal("unable to create directory")
+				}
+			}
+			pending = append(pending, copyDirectory(ctx, source.NewDirectoryURL(dir.Name), targetDir, sas, logger)...)
+		}
+
+		for _, file := range listing.FileItems {
+			sourceParts := azfile.NewFileURLParts(source.NewFileURL(file.Name).URL())
+			sourceParts.SAS = sas
+			targetFile := target.NewFileURL(file.Name)
+			if _, err := targetFile.StartCopy(ctx, sourceParts.URL(), azfile.Metadata{}); err != nil {
+				logger.WithField("file", file.Name).WithError(err).Fatal("unable to start copying file")
+			}
+			pending = append(pending, targetFile)
+		}
+
+		marker = listing.NextMarker
+	}
+	return pending
+}
+
+func waitForCopy(ctx context.Context, fileURL azfile.FileURL, logger *logrus.Entry) {
+	fileLogger := logger.WithField("file", fileURL.String())
+	for {
+		props, err := fileURL.GetProperties(ctx)
+		if err != nil {
+			fileLogger.WithError(err).Fatal("unable to get status of file copy")
+		}
+		switch props.CopyStatus() {
+		case azfile.CopyStatusSuccess:
+			return
+		case azfile.CopyStatusPending:
+		default:
+			fileLogger.WithFields(logrus.Fields{
+				"status":      props.CopyStatus(),
+				"description": props.CopyStatusDescription(),
+			}).Fatal("file copy failed")
+		}
+
+		select {
+		case <-ctx.Done():
+			fileLogger.Fatal("aborted")
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
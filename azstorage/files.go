@@ -26,12 +26,15 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"sort"
 	"strings"
 
 	"github.com/Azure/flamenco-manager-azure/flamenco"
 
+	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-file-go/azfile"
 	"github.com/sirupsen/logrus"
+	"github.com/Azure/flamenco-manager-azure/azauth"
 	"github.com/Azure/flamenco-manager-azure/azconfig"
 )
 
@@ -55,6 +58,21 @@ var (
 	}
 )
 
+// ShareNames returns the sorted names of the default SMB shares.
+func ShareNames() []string {
+	names := []string{}
+	for shareName := range DefaultSMBShares {
+		names = append(names, shareName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Host returns the hostname of the Azure Files endpoint of the storage account.
+func Host(config azconfig.AZConfig) string {
+	return fmt.Sprintf("%s.file.core.windows.net", config.StorageAccountName)
+}
+
 // EnsureFileShares sets up the SMB shares. Returns fstab lines to mount them.
 func EnsureFileShares(ctx context.Context, config azconfig.AZConfig) string {
 	fstab := []string{}
@@ -73,8 +91,8 @@ func GetFSTabLine(config azconfig.AZConfig, shareName string) string {
 	mountOpts := GetMountOptions(config, shareName)
 
 	return fmt.Sprintf(
-		"//%s.file.core.windows.net/%s /mnt/%s cifs %s 0 0",
-		config.StorageAccountName,
+		"//%s/%s /mnt/%s cifs %s 0 0",
+		Host(config),
 		shareName, shareName,
 		mountOpts,
 	)
@@ -108,7 +126,7 @@ func getShareURL(config azconfig.AZConfig) azfile.ServiceURL {
 	// Create a request pipeline that is used to process HTTP(S) requests and responses. It requires
 	// your account credentials. In more advanced scenarios, you can configure telemetry, retry policies,
 	// logging, and other options. Also, you can configure multiple request pipelines for different scenarios.
-	pipeline := azfile.NewPipeline(credential, azfile.PipelineOptions{})
+	pipeline := newPipeline(credential)
 
 	// From the Azure portal, get your Storage account file service URL endpoint.
 	// The URL typically looks like this:
@@ -121,6 +139,24 @@ func getShareURL(config azconfig.AZConfig) azfile.ServiceURL {
 	return azfile.NewServiceURL(*topURL, pipeline)
 }
 
+// newPipeline does the same as azfile.NewPipeline(), except that the HTTP requests are sent
+// with the proxy and CA certificates configured in azauth.
+func newPipeline(credential azfile.Credential) pipeline.Pipeline {
+	options := azfile.PipelineOptions{}
+	factories := []pipeline.Factory{
+		azfile.NewTelemetryPolicyFactory(options.Telemetry),
+		azfile.NewUniqueRequestIDPolicyFactory(),
+		azfile.NewRetryPolicyFactory(options.Retry),
+		credential,
+		pipeline.MethodFactoryMarker(),
+		azfile.NewRequestLogPolicyFactory(options.RequestLog),
+	}
+	return pipeline.NewPipeline(factories, pipeline.Options{
+		HTTPSender: azauth.PipelineSender(),
+		Log:        options.Log,
+	})
+}
+
 // createFileShare creates an SMB file share.
 func createFileShare(ctx context.Context, serviceURL azfile.ServiceURL, shareName string) {
 	shareName = strings.ToLower(shareName)
@@ -0,0 +1,268 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azstorage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2018-07-01/storage"
+	"github.com/Azure/flamenco-manager-azure/azauth"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/flamenco-manager-azure/aznetwork"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Azure Files is resolved via this zone when accessed through a private endpoint.
+	privateFileZone = "privatelink.file.core.windows.net"
+
+	// Returns the public IP address of the caller, which is what the storage account sees.
+	operatorIPURL = "https://api.ipify.org"
+	// Changes to the IP rules of a storage account take a moment to be in effect.
+	ipRuleSettleTime = 30 * time.Second
+)
+
+// RestrictNetworkAccess applies the network restrictions from the config to the storage account.
+// This should be called after the file shares have been created, as creating those requires
+// access from the machine running this program.
+// Returns the private IP address of the storage account, or an empty string if there is no private endpoint.
+func RestrictNetworkAccess(ctx context.Context, config azconfig.AZConfig, netStack aznetwork.NetworkStack) string {
+	netConfig := config.StorageNetwork
+	if netConfig == nil {
+		logrus.Debug("no storage network restrictions configured")
+		return ""
+	}
+
+	logger := logrus.WithFields(logrus.Fields{
+		"storageAccountName": config.StorageAccountName,
+		"resourceGroup":      config.ResourceGroup,
+		"location":           config.Location,
+	})
+
+	if netConfig.DenyByDefault {
+		// This replaces all IP rules, including any left behind by AllowOperatorAccess().
+		allowedIPs := netConfig.AllowedIPs
+		ipRules := []storage.IPRule{}
+		for _, allowedIP := range allowedIPs {
+			ipRules = append(ipRules, storage.IPRule{
+				IPAddressOrRange: to.StringPtr(allowedIP),
+				Action:           storage.Allow,
+			})
+		}
+
+		logger.WithFields(logrus.Fields{
+			"subnet":     netStack.SubnetID(),
+			"allowedIPs": allowedIPs,
+		}).Info("restricting storage account network access")
+
+		accountClient := getAccountClient(config)
+		_, err := accountClient.Update(ctx, config.ResourceGroup, config.StorageAccountName,
+			storage.AccountUpdateParameters{
+				AccountPropertiesUpdateParameters: &storage.AccountPropertiesUpdateParameters{
+					NetworkRuleSet: &storage.NetworkRuleSet{
+						Bypass:        storage.AzureServices,
+						DefaultAction: storage.DefaultActionDeny,
+						IPRules:       &ipRules,
+						VirtualNetworkRules: &[]storage.VirtualNetworkRule{{
+							VirtualNetworkResourceID: to.StringPtr(netStack.SubnetID()),
+							Action:                   storage.Allow,
+						}},
+					},
+				},
+			})
+		if err != nil {
+			logger.WithError(err).Fatal("unable to restrict storage account network access")
+		}
+	}
+
+	if !netConfig.PrivateEndpoint {
+		return ""
+	}
+
+	endpointName := fmt.Sprintf("%s-file-endpoint", config.StorageAccountName)
+	privateIP := aznetwork.EnsurePrivateEndpoint(ctx, config, netStack,
+		endpointName, config.StorageAccountID(), "file")
+	aznetwork.EnsurePrivateDNSRecord(ctx, config, netStack.VNet,
+		privateFileZone, config.StorageAccountName, privateIP)
+	return privateIP
+}
+
+// AllowOperatorAccess gives the machine running this program access to the file shares, when the
+// storage account denies network access by default and storageNetwork.allowOperatorIP is set. Its
+// public IP address is then added to the IP rules of the storage account if necessary. This should
+// be called before accessing the file shares. Call the returned function when done, to remove the
+// rule again.
+func AllowOperatorAccess(ctx context.Context, config azconfig.AZConfig) (revoke func()) {
+	revoke = func() {}
+	if config.StorageNetwork == nil || !config.StorageNetwork.DenyByDefault {
+		return
+	}
+	logger := logrus.WithFields(logrus.Fields{
+		"storageAccountName": config.StorageAccountName,
+		"resourceGroup":      config.ResourceGroup,
+	})
+	if !config.StorageNetwork.AllowOperatorIP {
+		logger.Debug("relying on storageNetwork.allowedIPs for access to the storage account")
+		return
+	}
+
+	accountClient := getAccountClient(config)
+	ruleSet := networkRuleSet(ctx, config, logger)
+	if ruleSet == nil || ruleSet.DefaultAction != storage.DefaultActionDeny {
+		// Network access has not been restricted yet.
+		return
+	}
+
+	ip, err := operatorIP(ctx)
+	if err != nil {
+		logger.WithError(err).Fatal("the storage account denies network access by default, and our public IP " +
+			"address could not be determined; add it to storageNetwork.allowedIPs in the config file")
+	}
+	ipRules := []storage.IPRule{}
+	if ruleSet.IPRules != nil {
+		ipRules = *ruleSet.IPRules
+	}
+	allowedIPs := []string{}
+	for _, rule := range ipRules {
+		allowedIPs = append(allowedIPs, to.String(rule.IPAddressOrRange))
+	}
+	logger = logger.WithField("ip", ip)
+	if ipAllowed(ip, allowedIPs) {
+		logger.Debug("our IP address already has access to the storage account")
+		return
+	}
+
+	ipRules = append(ipRules, storage.IPRule{
+		IPAddressOrRange: to.StringPtr(ip),
+		Action:           storage.Allow,
+	})
+	ruleSet.IPRules = &ipRules
+	updateNetworkRuleSet(ctx, config, accountClient, *ruleSet, logger)
+	logger.Warning("added an IP rule for our public IP address to the storage account; it is removed when done")
+
+	logger.WithField("wait", ipRuleSettleTime).Info("waiting for the IP rule to be in effect")
+	select {
+	case <-ctx.Done():
+		logger.Fatal("aborted")
+	case <-time.After(ipRuleSettleTime):
+	}
+
+	return func() {
+		removeIPRule(context.Background(), config, ip, logger)
+	}
+}
+
+// removeIPRule removes the rule for the IP address added by AllowOperatorAccess().
+func removeIPRule(ctx context.Context, config azconfig.AZConfig, ip string, logger *logrus.Entry) {
+	ruleSet := networkRuleSet(ctx, config, logger)
+	if ruleSet == nil || ruleSet.IPRules == nil {
+		return
+	}
+	ipRules := []storage.IPRule{}
+	for _, rule := range *ruleSet.IPRules {
+		if to.String(rule.IPAddressOrRange) != ip {
+			ipRules = append(ipRules, rule)
+		}
+	}
+	if len(ipRules) == len(*ruleSet.IPRules) {
+		// Already removed, for example by RestrictNetworkAccess().
+		return
+	}
+	ruleSet.IPRules = &ipRules
+	updateNetworkRuleSet(ctx, config, getAccountClient(config), *ruleSet, logger)
+	logger.Info("removed the IP rule for our public IP address from the storage account")
+}
+
+// networkRuleSet returns the network rules of the storage account, or nil if it has none.
+func networkRuleSet(ctx context.Context, config azconfig.AZConfig, logger *logrus.Entry) *storage.NetworkRuleSet {
+	account, err := getAccountClient(config).GetProperties(ctx, config.ResourceGroup, config.StorageAccountName, "")
+	if err != nil {
+		logger.WithError(err).Fatal("unable to get storage account properties")
+	}
+	if account.AccountProperties == nil {
+		return nil
+	}
+	return account.NetworkRuleSet
+}
+
+func updateNetworkRuleSet(ctx context.Context, config azconfig.AZConfig, accountClient storage.AccountsClient,
+	ruleSet storage.NetworkRuleSet, logger *logrus.Entry) {
+	_, err := accountClient.Update(ctx, config.ResourceGroup, config.StorageAccountName,
+		storage.AccountUpdateParameters{
+			AccountPropertiesUpdateParameters: &storage.AccountPropertiesUpdateParameters{
+				NetworkRuleSet: &ruleSet,
+			},
+		})
+	if err != nil {
+		logger.WithError(err).Fatal("unable to update the network rules of the storage account")
+	}
+}
+
+// operatorIP returns the public IP address of the machine running this program,
+// as seen from the internet. When a proxy is used, this is the address of the proxy.
+func operatorIP(ctx context.Context) (string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, operatorIPURL, nil)
+	if err != nil {
+		return "", err
+	}
+	client := azauth.HTTPClient()
+	client.Timeout = 30 * time.Second
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s responded with %s", operatorIPURL, response.Status)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	ip := strings.TrimSpace(string(body))
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("%s returned %q, which is not an IP address", operatorIPURL, ip)
+	}
+	return ip, nil
+}
+
+// ipAllowed returns whether the IP address is one of the allowed addresses or in one of the allowed CIDR ranges.
+func ipAllowed(ip string, allowed []string) bool {
+	parsedIP := net.ParseIP(ip)
+	for _, entry := range allowed {
+		if entry == ip {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(parsedIP) {
+			return true
+		}
+	}
+	return false
+}
@@ -34,6 +34,7 @@ import (
 func getSubscriptionClient() subscriptions.Client {
 	client := subscriptions.NewClient()
 	client.Authorizer = azauth.Load(azure.PublicCloud.ResourceManagerEndpoint)
+	client.Sender = azauth.Sender()
 	return client
 }
 
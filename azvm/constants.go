@@ -25,10 +25,5 @@ package azvm
 import "github.com/Azure/flamenco-manager-azure/flamenco"
 
 const (
-	// used by default for VM operations
-	publisher = "Canonical"
-	offer     = "UbuntuServer"
-	sku       = "18.04-LTS"
-
 	adminUsername = flamenco.AdminUsername
 )
@@ -0,0 +1,169 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azvm
+
+import (
+	"context"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-06-01/compute"
+	"github.com/Azure/flamenco-manager-azure/azauth"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/sirupsen/logrus"
+)
+
+// The data disk is always attached at this LUN; the setup script expects it at /dev/disk/azure/scsi1/lun0.
+const dataDiskLun int32 = 0
+
+func getDisksClient(config azconfig.AZConfig) compute.DisksClient {
+	disksClient := compute.NewDisksClient(config.SubscriptionID)
+	disksClient.Authorizer = azauth.Load(azure.PublicCloud.ResourceManagerEndpoint)
+	disksClient.Sender = azauth.Sender()
+	return disksClient
+}
+
+func dataDiskName(vmName string) string {
+	return vmName + "-data"
+}
+
+// ensureDataDisk returns the managed data disk of the VM, creating it if it doesn't exist yet.
+// An existing disk is reused as-is, so that its data survives re-creating the VM.
+func ensureDataDisk(ctx context.Context, config azconfig.AZConfig, vmName string) compute.Disk {
+	diskConfig := config.DataDisk.WithDefaults()
+	diskName := dataDiskName(vmName)
+	logger := logrus.WithFields(logrus.Fields{
+		"resourceGroup": config.ResourceGroup,
+		"location":      config.Location,
+		"diskName":      diskName,
+	})
+
+	disksClient := getDisksClient(config)
+	disk, err := disksClient.Get(ctx, config.ResourceGroup, diskName)
+	if err == nil {
+		logger.WithField("sizeGB", *disk.DiskSizeGB).Info("reusing existing data disk")
+		return disk
+	}
+	if disk.StatusCode != 404 {
+		logger.WithError(err).Fatal("unable to check for existing data disk")
+	}
+
+	logger = logger.WithFields(logrus.Fields{
+		"sizeGB": diskConfig.SizeGB,
+		"sku":    diskConfig.SKU,
+	})
+	logger.Info("creating data disk")
+	future, err := disksClient.CreateOrUpdate(ctx, config.ResourceGroup, diskName, compute.Disk{
+		Location: to.StringPtr(config.Location),
+		Sku:      &compute.DiskSku{Name: compute.DiskStorageAccountTypes(diskConfig.SKU)},
+		DiskProperties: &compute.DiskProperties{
+			CreationData: &compute.CreationData{CreateOption: compute.Empty},
+			DiskSizeGB:   to.Int32Ptr(diskConfig.SizeGB),
+		},
+	})
+	if err != nil {
+		logger.WithError(err).Fatal("error creating data disk")
+	}
+	if err := future.WaitForCompletionRef(ctx, disksClient.Client); err != nil {
+		logger.WithError(err).Fatal("error creating data disk")
+	}
+	disk, err = future.Result(disksClient)
+	if err != nil {
+		logger.WithError(err).Fatal("error creating data disk")
+	}
+	return disk
+}
+
+// dataDisks returns the data disks to attach to a new VM; that's none if no data disk is configured.
+func dataDisks(ctx context.Context, config azconfig.AZConfig, vmName string) *[]compute.DataDisk {
+	if config.DataDisk == nil {
+		return &[]compute.DataDisk{}
+	}
+	disk := ensureDataDisk(ctx, config, vmName)
+	return &[]compute.DataDisk{dataDiskReference(config, disk)}
+}
+
+func dataDiskReference(config azconfig.AZConfig, disk compute.Disk) compute.DataDisk {
+	return compute.DataDisk{
+		Lun:          to.Int32Ptr(dataDiskLun),
+		Name:         disk.Name,
+		CreateOption: compute.DiskCreateOptionTypesAttach,
+		Caching:      compute.CachingTypes(config.DataDisk.WithDefaults().Caching),
+		ManagedDisk:  &compute.ManagedDiskParameters{ID: disk.ID},
+	}
+}
+
+// attachDataDisk attaches the configured data disk to an existing VM, if it doesn't have one yet.
+// Returns the possibly updated VM.
+func attachDataDisk(ctx context.Context, config azconfig.AZConfig, vm compute.VirtualMachine) compute.VirtualMachine {
+	if config.DataDisk == nil {
+		return vm
+	}
+	logger := logrus.WithFields(logrus.Fields{
+		"resourceGroup": config.ResourceGroup,
+		"vmName":        *vm.Name,
+	})
+
+	existing := []compute.DataDisk{}
+	if vm.StorageProfile.DataDisks != nil {
+		existing = *vm.StorageProfile.DataDisks
+	}
+	for _, dataDisk := range existing {
+		if dataDisk.Lun != nil && *dataDisk.Lun == dataDiskLun {
+			logger.Debug("VM already has a data disk")
+			return vm
+		}
+	}
+
+	disk := ensureDataDisk(ctx, config, *vm.Name)
+	logger.WithField("diskName", *disk.Name).Info("attaching data disk to VM")
+
+	// A PUT replaces the whole VM, so send it back as-is with only the data disk added. Get it again
+	// without the instance view, which cannot be sent along.
+	vmClient := getVMClient(config)
+	update, err := vmClient.Get(ctx, config.ResourceGroup, *vm.Name, "")
+	if err != nil {
+		logger.WithError(err).Fatal("unable to retrieve VM info")
+	}
+	// Extensions are child resources, managed through their own API.
+	update.Resources = nil
+	disks := []compute.DataDisk{}
+	if update.StorageProfile.DataDisks != nil {
+		disks = *update.StorageProfile.DataDisks
+	}
+	disks = append(disks, dataDiskReference(config, disk))
+	update.StorageProfile.DataDisks = &disks
+
+	future, err := vmClient.CreateOrUpdate(ctx, config.ResourceGroup, *vm.Name, update)
+	if err != nil {
+		logger.WithError(err).Fatal("error attaching data disk")
+	}
+	if err := future.WaitForCompletionRef(ctx, vmClient.Client); err != nil {
+		logger.WithError(err).Fatal("error attaching data disk")
+	}
+	vm, err = future.Result(vmClient)
+	if err != nil {
+		logger.WithError(err).Fatal("error attaching data disk")
+	}
+	return vm
+}
@@ -0,0 +1,216 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azvm
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-06-01/compute"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/sirupsen/logrus"
+)
+
+func vmLogger(config azconfig.AZConfig, vmName string) *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		"resourceGroup": config.ResourceGroup,
+		"vmName":        vmName,
+	})
+}
+
+// waitForFuture waits for a long-running VM operation, and hard-exits the process if it fails.
+func waitForFuture(ctx context.Context, vmClient compute.VirtualMachinesClient, future azure.Future, logger *logrus.Entry, action string) {
+	if err := future.WaitForCompletionRef(ctx, vmClient.Client); err != nil {
+		logger.WithError(err).Fatalf("error waiting for VM to %s", action)
+	}
+	logger.Infof("VM %s done", action)
+}
+
+// StartVM starts a stopped or deallocated VM and waits until it is ready.
+func StartVM(ctx context.Context, config azconfig.AZConfig, vmName string) {
+	logger := vmLogger(config, vmName)
+	logger.Info("starting VM")
+
+	vmClient := getVMClient(config)
+	future, err := vmClient.Start(ctx, config.ResourceGroup, vmName)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to start VM")
+	}
+	waitForFuture(ctx, vmClient, future.Future, logger, "start")
+	WaitForReady(ctx, config, vmName)
+}
+
+// DeallocateVM stops the VM and releases its compute resources, so that it is no longer billed for them.
+func DeallocateVM(ctx context.Context, config azconfig.AZConfig, vmName string) {
+	logger := vmLogger(config, vmName)
+	logger.Info("stopping and deallocating VM")
+
+	vmClient := getVMClient(config)
+	future, err := vmClient.Deallocate(ctx, config.ResourceGroup, vmName)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to deallocate VM")
+	}
+	waitForFuture(ctx, vmClient, future.Future, logger, "deallocate")
+}
+
+// RestartVM restarts a running VM and waits until it is ready.
+func RestartVM(ctx context.Context, config azconfig.AZConfig, vmName string) {
+	logger := vmLogger(config, vmName)
+	logger.Info("restarting VM")
+
+	vmClient := getVMClient(config)
+	future, err := vmClient.Restart(ctx, config.ResourceGroup, vmName)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to restart VM")
+	}
+	waitForFuture(ctx, vmClient, future.Future, logger, "restart")
+	WaitForReady(ctx, config, vmName)
+}
+
+// ResizeVM changes the size of the VM and, if it was running, waits until it is ready again.
+// If vmSize is empty, the user is asked to choose one.
+// When the new size is not available on the VM's current hardware, the VM is deallocated first.
+// A VM that was stopped or deallocated is left that way.
+func ResizeVM(ctx context.Context, config azconfig.AZConfig, vmName, vmSize string) {
+	logger := vmLogger(config, vmName)
+	vmClient := getVMClient(config)
+
+	vm, err := vmClient.Get(ctx, config.ResourceGroup, vmName, "")
+	if err != nil {
+		logger.WithError(err).Fatal("unable to retrieve VM info")
+	}
+	currentSize := string(vm.HardwareProfile.VMSize)
+
+	sizes := ListVMSizes(ctx, config)
+	if vmSize == "" {
+		vmSize = ChooseVMSize(ctx, sizes, "New Flamenco Manager VM size", currentSize).Name
+	} else if _, found := FindVMSize(sizes, vmSize); !found {
+		logger.WithField("vmSize", vmSize).Fatal("VM size is not available in this location")
+	}
+
+	logger = logger.WithFields(logrus.Fields{
+		"currentSize": currentSize,
+		"newSize":     vmSize,
+	})
+	if vmSize == currentSize {
+		logger.Info("VM already has the requested size")
+		return
+	}
+
+	previousState := powerState(ctx, config, vmName)
+	logger = logger.WithField("powerState", previousState)
+	wasRunning := previousState == powerStateRunning
+	// Any size in the location can be chosen for a deallocated VM.
+	mustDeallocate := previousState != powerStateDeallocated && !isAvailableForVM(ctx, config, vmName, vmSize)
+	if mustDeallocate {
+		logger.Info("new size is not available on the current hardware, VM has to be deallocated")
+		DeallocateVM(ctx, config, vmName)
+	}
+
+	logger.Info("resizing VM")
+	future, err := vmClient.Update(ctx, config.ResourceGroup, vmName, compute.VirtualMachineUpdate{
+		VirtualMachineProperties: &compute.VirtualMachineProperties{
+			HardwareProfile: &compute.HardwareProfile{
+				VMSize: compute.VirtualMachineSizeTypes(vmSize),
+			},
+		},
+	})
+	if err != nil {
+		logger.WithError(err).Fatal("unable to resize VM")
+	}
+	waitForFuture(ctx, vmClient, future.Future, logger, "resize")
+
+	if !wasRunning {
+		restorePowerState(ctx, config, vmName, previousState)
+		return
+	}
+	if mustDeallocate {
+		StartVM(ctx, config, vmName)
+		return
+	}
+	WaitForReady(ctx, config, vmName)
+}
+
+const (
+	powerStateRunning     = "PowerState/running"
+	powerStateDeallocated = "PowerState/deallocated"
+	powerStateStopped     = "PowerState/stopped"
+)
+
+// powerState returns the power state of the VM, like "PowerState/running".
+func powerState(ctx context.Context, config azconfig.AZConfig, vmName string) string {
+	vmClient := getVMClient(config)
+	vmInfo, err := vmClient.InstanceView(ctx, config.ResourceGroup, vmName)
+	if err != nil {
+		vmLogger(config, vmName).WithError(err).Fatal("error fetching VM status")
+	}
+	if vmInfo.Statuses != nil {
+		for _, status := range *vmInfo.Statuses {
+			if status.Code != nil && strings.HasPrefix(*status.Code, "PowerState/") {
+				return *status.Code
+			}
+		}
+	}
+	return ""
+}
+
+// restorePowerState stops or deallocates the VM again when an operation started it.
+func restorePowerState(ctx context.Context, config azconfig.AZConfig, vmName, previousState string) {
+	logger := vmLogger(config, vmName).WithField("powerState", previousState)
+	if powerState(ctx, config, vmName) != powerStateRunning {
+		logger.Info("VM left in its previous power state")
+		return
+	}
+
+	switch previousState {
+	case powerStateDeallocated:
+		DeallocateVM(ctx, config, vmName)
+	case powerStateStopped:
+		logger.Info("stopping VM")
+		vmClient := getVMClient(config)
+		future, err := vmClient.PowerOff(ctx, config.ResourceGroup, vmName)
+		if err != nil {
+			logger.WithError(err).Fatal("unable to stop VM")
+		}
+		waitForFuture(ctx, vmClient, future.Future, logger, "stop")
+	}
+}
+
+// isAvailableForVM returns whether the VM can be resized to the given size without deallocating it.
+func isAvailableForVM(ctx context.Context, config azconfig.AZConfig, vmName, vmSize string) bool {
+	vmClient := getVMClient(config)
+	available, err := vmClient.ListAvailableSizes(ctx, config.ResourceGroup, vmName)
+	if err != nil {
+		vmLogger(config, vmName).WithError(err).Fatal("unable to list sizes available to VM")
+	}
+	if available.Value == nil {
+		return false
+	}
+	for _, size := range *available.Value {
+		if size.Name != nil && *size.Name == vmSize {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package azvm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/flamenco-manager-azure/flamenco"
+	"github.com/sirupsen/logrus"
+)
+
+const configScriptName = "flamenco-manager-config.sh"
+
+// configScript returns a run-command script that runs the commands in a temporary directory,
+// next to flamenco-manager-config.sh and the given files.
+func configScript(files map[string][]byte, commands ...string) []string {
+	script := []string{
+		"set -e",
+		"cd \"$(mktemp -d)\"",
+		"trap 'rm -rf \"$PWD\"' EXIT",
+		fmt.Sprintf("echo %s | base64 -d > %s",
+			base64.StdEncoding.EncodeToString(flamenco.StaticFile(configScriptName)), configScriptName),
+	}
+	for name, content := range files {
+		script = append(script, fmt.Sprintf("echo %s | base64 -d > %s", base64.StdEncoding.EncodeToString(content), name))
+	}
+	return append(script, commands...)
+}
+
+// ManagerConfig returns the live flamenco-manager.yaml, and the default config it is based on,
+// queried via the Azure run-command API. Either is empty when it does not exist on the VM.
+func ManagerConfig(ctx context.Context, config azconfig.AZConfig, vmName string) (live, base []byte) {
+	logger := logrus.WithFields(logrus.Fields{
+		"resourceGroup": config.ResourceGroup,
+		"vmName":        vmName,
+	})
+
+	// Run-command only returns the last 4 KiB of output, so the files are compressed. Every file
+	// is on its own line, as "{which}" when it is missing or "{which} {gzip+base64}" otherwise.
+	script := configScript(nil,
+		"for which in live base; do",
+		fmt.Sprintf("  if [ \"$(bash %s fetch $which $which.yaml)\" = present ]; then", configScriptName),
+		"    echo \"$which $(gzip -c $which.yaml | base64 -w0)\"",
+		"  else",
+		"    echo $which",
+		"  fi",
+		"done",
+	)
+	output, err := runShellScript(ctx, config, vmName, script)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to read flamenco-manager.yaml via the Azure API")
+	}
+
+	contents := map[string][]byte{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 1:
+			contents[fields[0]] = nil
+		case len(fields) == 2:
+			content, err := gunzipBase64(fields[1])
+			if err != nil {
+				logger.WithError(err).WithField("file", fields[0]).Fatal("unable to decode flamenco-manager.yaml read via the Azure API")
+			}
+			contents[fields[0]] = content
+		}
+	}
+	for _, which := range []string{"live", "base"} {
+		if _, found := contents[which]; !found {
+			logger.WithField("file", which).Fatal("flamenco-manager.yaml missing from the output of the Azure API, it may be too large")
+		}
+	}
+	return contents["live"], contents["base"]
+}
+
+func gunzipBase64(encoded string) ([]byte, error) {
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// ApplyManagerConfig replaces flamenco-manager.yaml with the merged config via the Azure run-command
+// API, stores the default it is now based on, and restarts Flamenco Manager.
+func ApplyManagerConfig(ctx context.Context, config azconfig.AZConfig, vmName string, merged, newDefault []byte) {
+	logger := logrus.WithFields(logrus.Fields{
+		"resourceGroup": config.ResourceGroup,
+		"vmName":        vmName,
+	})
+	script := configScript(map[string][]byte{"merged.yaml": merged, "default.yaml": newDefault},
+		fmt.Sprintf("bash %s apply merged.yaml default.yaml", configScriptName))
+	output, err := runShellScript(ctx, config, vmName, script)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to apply the merged Flamenco Manager configuration")
+	}
+	logger.WithField("output", output).Info("merged Flamenco Manager configuration applied")
+}
+
+// SetManagerConfigBase stores the default config that flamenco-manager.yaml is based on via the
+// Azure run-command API, without changing flamenco-manager.yaml itself.
+func SetManagerConfigBase(ctx context.Context, config azconfig.AZConfig, vmName string, newDefault []byte) {
+	logger := logrus.WithFields(logrus.Fields{
+		"resourceGroup": config.ResourceGroup,
+		"vmName":        vmName,
+	})
+	script := configScript(map[string][]byte{"default.yaml": newDefault},
+		fmt.Sprintf("bash %s set-base default.yaml", configScriptName))
+	if _, err := runShellScript(ctx, config, vmName, script); err != nil {
+		logger.WithError(err).Fatal("unable to store the default Flamenco Manager configuration")
+	}
+	logger.Debug("stored default Flamenco Manager configuration")
+}
@@ -0,0 +1,221 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azvm
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-06-01/compute"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/flamenco-manager-azure/flamenco"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	provisioningPollInterval = 30 * time.Second
+	provisioningTimeout      = 90 * time.Minute
+)
+
+// runShellScript runs a shell script on the VM via the Azure run-command API, and returns its standard output.
+// This goes through the VM agent, so it doesn't need any network access to the VM.
+func runShellScript(ctx context.Context, config azconfig.AZConfig, vmName string, script []string) (string, error) {
+	vmClient := getVMClient(config)
+	future, err := vmClient.RunCommand(ctx, config.ResourceGroup, vmName, compute.RunCommandInput{
+		CommandID: to.StringPtr("RunShellScript"),
+		Script:    &script,
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := future.WaitForCompletionRef(ctx, vmClient.Client); err != nil {
+		return "", err
+	}
+	result, err := future.Result(vmClient)
+	if err != nil {
+		return "", err
+	}
+	return commandStdout(result), nil
+}
+
+// commandStdout extracts the standard output from a run-command result.
+// Its message looks like "Enable succeeded: \n[stdout]\n...\n[stderr]\n...".
+func commandStdout(result compute.RunCommandResult) string {
+	if result.Value == nil {
+		return ""
+	}
+	for _, status := range *result.Value {
+		if status.Message == nil {
+			continue
+		}
+		message := *status.Message
+		start := strings.Index(message, "[stdout]\n")
+		if start < 0 {
+			continue
+		}
+		stdout := message[start+len("[stdout]\n"):]
+		if end := strings.Index(stdout, "[stderr]"); end >= 0 {
+			stdout = stdout[:end]
+		}
+		return strings.TrimSpace(stdout)
+	}
+	return ""
+}
+
+// FetchHostKeys returns the public SSH host keys of the VM, in authorized_keys format.
+// They are obtained through the Azure API, so they can be trusted without connecting via SSH first.
+func FetchHostKeys(ctx context.Context, config azconfig.AZConfig, vmName string) ([]string, error) {
+	output, err := runShellScript(ctx, config, vmName, []string{"cat /etc/ssh/ssh_host_*_key.pub"})
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeys := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			hostKeys = append(hostKeys, line)
+		}
+	}
+	return hostKeys, nil
+}
+
+// Markers of the block in authorized_keys that is managed by InstallAuthorizedKeys.
+const (
+	authorizedKeysBegin = "# BEGIN keys managed by flamenco-manager-azure"
+	authorizedKeysEnd   = "# END keys managed by flamenco-manager-azure"
+)
+
+// InstallAuthorizedKeys replaces the managed block in the authorized_keys file of the admin user on
+// the VM with the given keys, so that keys removed from the config lose access. Keys outside the
+// block are kept, unless they are in the block as well. This goes through the Azure API, so it also
+// works when none of our keys are authorized yet.
+func InstallAuthorizedKeys(ctx context.Context, config azconfig.AZConfig, vmName string, keys []string) {
+	logger := logrus.WithFields(logrus.Fields{
+		"resourceGroup": config.ResourceGroup,
+		"vmName":        vmName,
+		"keyCount":      len(keys),
+	})
+	logger.Info("installing authorized SSH keys")
+
+	sshDir := fmt.Sprintf("/home/%s/.ssh", adminUsername)
+	authorizedKeys := sshDir + "/authorized_keys"
+	encodedKeys := base64.StdEncoding.EncodeToString([]byte(strings.Join(keys, "\n") + "\n"))
+	script := []string{
+		"set -e",
+		fmt.Sprintf("install -d -m 700 -o %s -g %s %s", adminUsername, adminUsername, sshDir),
+		fmt.Sprintf("touch %s", authorizedKeys),
+		"keys=$(mktemp)",
+		"unmanaged=$(mktemp)",
+		fmt.Sprintf("echo %s | base64 -d > \"$keys\"", encodedKeys),
+		// Everything outside the managed block, except the managed keys themselves.
+		fmt.Sprintf("awk -v begin='%s' -v end='%s' "+
+			"'NR == FNR { managed[$0] = 1; next } $0 == begin { skip = 1; next } $0 == end { skip = 0; next } "+
+			"!skip && !($0 in managed)' \"$keys\" %s > \"$unmanaged\"",
+			authorizedKeysBegin, authorizedKeysEnd, authorizedKeys),
+		fmt.Sprintf("{ cat \"$unmanaged\"; echo '%s'; cat \"$keys\"; echo '%s'; } > %s.new",
+			authorizedKeysBegin, authorizedKeysEnd, authorizedKeys),
+		fmt.Sprintf("chown %s:%s %s.new", adminUsername, adminUsername, authorizedKeys),
+		fmt.Sprintf("chmod 600 %s.new", authorizedKeys),
+		fmt.Sprintf("mv %s.new %s", authorizedKeys, authorizedKeys),
+		// Report how many keys have access without being managed.
+		"grep -c '^[^#[:space:]]' \"$unmanaged\" || true",
+		"rm -f \"$keys\" \"$unmanaged\"",
+	}
+	output, err := runShellScript(ctx, config, vmName, script)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to install authorized SSH keys")
+	}
+	if unmanaged, _ := strconv.Atoi(output); unmanaged > 0 {
+		logger.WithFields(logrus.Fields{
+			"file":          authorizedKeys,
+			"unmanagedKeys": unmanaged,
+		}).Warning("keys outside the managed block still have access to the VM; remove them by hand if they are no longer needed")
+	}
+}
+
+// StartProvisioning starts the provisioning script on an existing VM, for which cloud-init has already run.
+func StartProvisioning(ctx context.Context, config azconfig.AZConfig, vmName string, script []string) {
+	logger := logrus.WithFields(logrus.Fields{
+		"resourceGroup": config.ResourceGroup,
+		"vmName":        vmName,
+	})
+	logger.Info("starting provisioning of existing VM via run-command")
+	if _, err := runShellScript(ctx, config, vmName, script); err != nil {
+		logger.WithError(err).Fatal("unable to start provisioning")
+	}
+}
+
+// WaitForProvisioning polls the VM until the provisioning script has finished.
+// If it failed, the tail of its log is shown and the process exits.
+func WaitForProvisioning(ctx context.Context, config azconfig.AZConfig, vmName string) {
+	logger := logrus.WithFields(logrus.Fields{
+		"resourceGroup": config.ResourceGroup,
+		"vmName":        vmName,
+		"statusFile":    flamenco.ProvisionStatusFile,
+	})
+	logger.Info("waiting for provisioning to complete; this can take a while")
+
+	deadline := time.Now().Add(provisioningTimeout)
+	statusScript := []string{"cat " + flamenco.ProvisionStatusFile + " 2>/dev/null || echo pending"}
+	for {
+		status, err := runShellScript(ctx, config, vmName, statusScript)
+		switch {
+		case err != nil:
+			logger.WithError(err).Warning("unable to query provisioning status, will retry")
+		case status == "ok":
+			logger.Info("provisioning completed")
+			return
+		case strings.HasPrefix(status, "failed"):
+			logTail, _ := runShellScript(ctx, config, vmName, []string{"tail -n 40 " + flamenco.ProvisionLogFile})
+			logger.WithFields(logrus.Fields{
+				"status": status,
+				"log":    logTail,
+			}).Fatal("provisioning failed")
+		default:
+			logger.WithField("status", status).Debug("provisioning still running")
+		}
+
+		if time.Now().After(deadline) {
+			logger.WithField("timeout", provisioningTimeout).Fatal("provisioning did not complete in time")
+		}
+		select {
+		case <-ctx.Done():
+			logger.Fatal("aborted")
+		case <-time.After(provisioningPollInterval):
+		}
+	}
+}
+
+// ServiceStatus returns the state of the systemd units on the VM, queried via the Azure run-command API.
+func ServiceStatus(ctx context.Context, config azconfig.AZConfig, vmName string, units []string) ([]flamenco.ServiceStatus, error) {
+	output, err := runShellScript(ctx, config, vmName, []string{flamenco.ServiceStatusCommand(units)})
+	if err != nil {
+		return nil, err
+	}
+	return flamenco.ParseServiceStatus(output), nil
+}
@@ -0,0 +1,275 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package azvm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-06-01/compute"
+	"github.com/Azure/flamenco-manager-azure/azauth"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/flamenco-manager-azure/textio"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/sirupsen/logrus"
+)
+
+// VMSize describes a virtual machine size that is available in a location.
+type VMSize struct {
+	Name     string
+	Family   string // quota family, like "standardDv2Family"
+	Cores    int
+	MemoryGB float64
+}
+
+func (s VMSize) String() string {
+	return fmt.Sprintf("%-24s %3d cores %7.1f GB RAM", s.Name, s.Cores, s.MemoryGB)
+}
+
+func getSkuClient(config azconfig.AZConfig) compute.ResourceSkusClient {
+	skuClient := compute.NewResourceSkusClient(config.SubscriptionID)
+	skuClient.Authorizer = azauth.Load(azure.PublicCloud.ResourceManagerEndpoint)
+	skuClient.Sender = azauth.Sender()
+	return skuClient
+}
+
+func getUsageClient(config azconfig.AZConfig) compute.UsageClient {
+	usageClient := compute.NewUsageClient(config.SubscriptionID)
+	usageClient.Authorizer = azauth.Load(azure.PublicCloud.ResourceManagerEndpoint)
+	usageClient.Sender = azauth.Sender()
+	return usageClient
+}
+
+// ListVMSizes returns the VM sizes that this subscription can use in the configured location, sorted by name.
+func ListVMSizes(ctx context.Context, config azconfig.AZConfig) []VMSize {
+	logger := logrus.WithField("location", config.Location)
+	logger.Info("fetching available VM sizes")
+
+	skuClient := getSkuClient(config)
+	iter, err := skuClient.ListComplete(ctx)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to list VM sizes")
+	}
+
+	sizes := []VMSize{}
+	for iter.NotDone() {
+		sku := iter.Value()
+		if isUsableVMSku(sku, config.Location) {
+			sizes = append(sizes, vmSizeFromSku(sku))
+		}
+		if err := iter.NextWithContext(ctx); err != nil {
+			logger.WithError(err).Fatal("unable to fetch next page of VM sizes")
+		}
+	}
+
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i].Name < sizes[j].Name })
+	logger.WithField("numSizes", len(sizes)).Debug("found VM sizes")
+	return sizes
+}
+
+// isUsableVMSku returns true if the SKU is a VM size that's not restricted in the location.
+// The VMs are not placed in a specific availability zone, so a zone restriction only makes
+// the size unusable when it covers all zones the size is offered in.
+func isUsableVMSku(sku compute.ResourceSku, location string) bool {
+	if sku.ResourceType == nil || *sku.ResourceType != "virtualMachines" || sku.Name == nil {
+		return false
+	}
+
+	inLocation := false
+	if sku.Locations != nil {
+		for _, skuLocation := range *sku.Locations {
+			inLocation = inLocation || strings.EqualFold(skuLocation, location)
+		}
+	}
+	if !inLocation {
+		return false
+	}
+
+	if sku.Restrictions == nil {
+		return true
+	}
+	restrictedZones := map[string]bool{}
+	for _, restriction := range *sku.Restrictions {
+		switch restriction.Type {
+		case compute.Location:
+			if containsFold(restrictionLocations(restriction), location) {
+				return false
+			}
+		case compute.Zone:
+			if restriction.RestrictionInfo == nil || restriction.RestrictionInfo.Zones == nil ||
+				!containsFold(restrictionLocations(restriction), location) {
+				continue
+			}
+			for _, zone := range *restriction.RestrictionInfo.Zones {
+				restrictedZones[zone] = true
+			}
+		}
+	}
+	if len(restrictedZones) == 0 {
+		return true
+	}
+
+	offeredZones := []string{}
+	if sku.LocationInfo != nil {
+		for _, locationInfo := range *sku.LocationInfo {
+			if strings.EqualFold(to.String(locationInfo.Location), location) && locationInfo.Zones != nil {
+				offeredZones = append(offeredZones, *locationInfo.Zones...)
+			}
+		}
+	}
+	for _, zone := range offeredZones {
+		if !restrictedZones[zone] {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictionLocations returns the locations a SKU restriction applies to.
+func restrictionLocations(restriction compute.ResourceSkuRestrictions) []string {
+	if restriction.RestrictionInfo != nil && restriction.RestrictionInfo.Locations != nil {
+		return *restriction.RestrictionInfo.Locations
+	}
+	// Older API responses only list them in Values.
+	if restriction.Values != nil {
+		return *restriction.Values
+	}
+	return nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, candidate := range values {
+		if strings.EqualFold(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func vmSizeFromSku(sku compute.ResourceSku) VMSize {
+	size := VMSize{Name: *sku.Name}
+	if sku.Family != nil {
+		size.Family = *sku.Family
+	}
+	if sku.Capabilities == nil {
+		return size
+	}
+	for _, capability := range *sku.Capabilities {
+		if capability.Name == nil || capability.Value == nil {
+			continue
+		}
+		switch *capability.Name {
+		case "vCPUs":
+			size.Cores, _ = strconv.Atoi(*capability.Value)
+		case "MemoryGB":
+			size.MemoryGB, _ = strconv.ParseFloat(*capability.Value, 64)
+		}
+	}
+	return size
+}
+
+// FindVMSize returns the size with the given name, ignoring case.
+func FindVMSize(sizes []VMSize, name string) (VMSize, bool) {
+	for _, size := range sizes {
+		if strings.EqualFold(size.Name, name) {
+			return size, true
+		}
+	}
+	return VMSize{}, false
+}
+
+// ChooseVMSize asks for a VM size until one of the given sizes is chosen.
+// Input that is not a size name is used to filter the list of sizes shown.
+func ChooseVMSize(ctx context.Context, sizes []VMSize, prompt, defaultSize string) VMSize {
+	if len(sizes) == 0 {
+		logrus.Fatal("no VM sizes available")
+	}
+
+	for {
+		input := textio.ReadLineWithDefault(ctx, prompt+" (type part of a name to list sizes)", defaultSize)
+		if input == "" {
+			logrus.Fatal("no VM size given, aborting")
+		}
+		if size, found := FindVMSize(sizes, input); found {
+			return size
+		}
+
+		matching := 0
+		for _, size := range sizes {
+			if strings.Contains(strings.ToLower(size.Name), strings.ToLower(input)) {
+				fmt.Printf("    %s\n", size)
+				matching++
+			}
+		}
+		if matching == 0 {
+			fmt.Printf("No VM sizes match %q in this location.\n", input)
+		}
+	}
+}
+
+// CheckRegionalQuota checks that 'count' VMs of the given size fit in the regional vCPU quota.
+// Returns false and logs an error if they don't.
+func CheckRegionalQuota(ctx context.Context, config azconfig.AZConfig, size VMSize, count int) bool {
+	logger := logrus.WithFields(logrus.Fields{
+		"location": config.Location,
+		"vmSize":   size.Name,
+		"family":   size.Family,
+		"count":    count,
+	})
+	logger.Debug("checking regional vCPU quota")
+
+	usageClient := getUsageClient(config)
+	iter, err := usageClient.ListComplete(ctx, config.Location)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to fetch quota usage")
+	}
+
+	requiredCores := int64(size.Cores * count)
+	ok := true
+	for iter.NotDone() {
+		usage := iter.Value()
+		if usage.Name != nil && usage.Name.Value != nil && usage.CurrentValue != nil && usage.Limit != nil {
+			name := *usage.Name.Value
+			if name == "cores" || (size.Family != "" && name == size.Family) {
+				available := *usage.Limit - int64(*usage.CurrentValue)
+				if requiredCores > available {
+					logger.WithFields(logrus.Fields{
+						"quota":         name,
+						"requiredCores": requiredCores,
+						"usedCores":     *usage.CurrentValue,
+						"limit":         *usage.Limit,
+					}).Error("not enough vCPU quota in this location")
+					ok = false
+				}
+			}
+		}
+		if err := iter.NextWithContext(ctx); err != nil {
+			logger.WithError(err).Fatal("unable to fetch next page of quota usage")
+		}
+	}
+	return ok
+}
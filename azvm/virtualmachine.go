@@ -25,8 +25,6 @@ package azvm
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-06-01/compute"
@@ -37,12 +35,14 @@ import (
 	"github.com/Azure/flamenco-manager-azure/azconfig"
 	"github.com/Azure/flamenco-manager-azure/azdebug"
 	"github.com/Azure/flamenco-manager-azure/aznetwork"
+	"github.com/Azure/flamenco-manager-azure/azssh"
 	"github.com/Azure/flamenco-manager-azure/textio"
 )
 
 func getVMClient(config azconfig.AZConfig) compute.VirtualMachinesClient {
 	vmClient := compute.NewVirtualMachinesClient(config.SubscriptionID)
 	vmClient.Authorizer = azauth.Load(azure.PublicCloud.ServiceManagementEndpoint)
+	vmClient.Sender = azauth.Sender()
 	vmClient.RequestInspector = azdebug.LogRequest()
 	vmClient.ResponseInspector = azdebug.LogResponse()
 	return vmClient
@@ -124,10 +124,12 @@ func ChooseVM(ctx context.Context, config *azconfig.AZConfig, vmName, defaultNam
 	return vmName, isExisting
 }
 
-// EnsureVM either returns the VM info (isExisting=true) or creates a new VM (isExisting=false)
-func EnsureVM(ctx context.Context, config azconfig.AZConfig, vmName string, isExisting bool) (compute.VirtualMachine, aznetwork.NetworkStack) {
-	vmClient := getVMClient(config)
+// CustomDataFunc produces the base64-encoded custom data for a new VM, once its network stack is known.
+type CustomDataFunc func(netStack aznetwork.NetworkStack) string
 
+// EnsureVM either returns the VM info (isExisting=true) or creates a new VM (isExisting=false).
+// customData is only used when creating a new VM, and may be nil.
+func EnsureVM(ctx context.Context, config azconfig.AZConfig, vmName string, isExisting bool, customData CustomDataFunc) (compute.VirtualMachine, aznetwork.NetworkStack) {
 	logger := logrus.WithFields(logrus.Fields{
 		"resourceGroup": config.ResourceGroup,
 		"location":      config.Location,
@@ -135,40 +137,44 @@ func EnsureVM(ctx context.Context, config azconfig.AZConfig, vmName string, isEx
 	})
 	if !isExisting {
 		logger.Info("creating new VM")
-		return createVM(ctx, config, vmName)
-	}
-
-	logger.Info("retrieving existing VM")
-	vm, err := vmClient.Get(ctx, config.ResourceGroup, vmName, compute.InstanceView)
-	if err != nil {
-		logger.WithError(err).Fatal("unable to retrieve VM info")
+		return createVM(ctx, config, vmName, customData)
 	}
 
-	stack := findVMNetworkStack(ctx, config, vm)
+	vm, stack := FindVM(ctx, config, vmName)
+	vm = attachDataDisk(ctx, config, vm)
 	return vm, stack
 }
 
-func loadSSHKey() string {
-	// TODO: make this configurable/promptable and/or support ssh-agent
-	sshPublicKeyPath := os.ExpandEnv("$HOME/.ssh/id_rsa.pub")
+// FindVM returns the info of an existing VM, without modifying it.
+func FindVM(ctx context.Context, config azconfig.AZConfig, vmName string) (compute.VirtualMachine, aznetwork.NetworkStack) {
+	logger := logrus.WithFields(logrus.Fields{
+		"resourceGroup": config.ResourceGroup,
+		"location":      config.Location,
+		"vmName":        vmName,
+	})
+	logger.Info("retrieving existing VM")
 
-	logger := logrus.WithField("sshPublicKeyPath", sshPublicKeyPath)
-	sshBytes, err := ioutil.ReadFile(sshPublicKeyPath)
+	vmClient := getVMClient(config)
+	vm, err := vmClient.Get(ctx, config.ResourceGroup, vmName, compute.InstanceView)
 	if err != nil {
-		logger.WithError(err).Fatal("failed to read SSH key data")
+		logger.WithError(err).Fatal("unable to retrieve VM info")
 	}
-	return string(sshBytes)
+	return vm, findVMNetworkStack(ctx, config, vm)
 }
 
-func askVMSize(ctx context.Context) compute.VirtualMachineSizeTypes {
-	// TODO(fsiddi): Ensure that the VM size is valid
-	containerServiceVMSizeType := textio.ReadLineWithDefault(ctx, "Desired Flamenco Manager VM size", "Standard_D12_v2")
-	// Verify is containerServiceVMSizeType is valid
-	return compute.VirtualMachineSizeTypes(containerServiceVMSizeType)
+func askVMSize(ctx context.Context, config azconfig.AZConfig) compute.VirtualMachineSizeTypes {
+	sizes := ListVMSizes(ctx, config)
+	for {
+		size := ChooseVMSize(ctx, sizes, "Desired Flamenco Manager VM size", "Standard_D12_v2")
+		if CheckRegionalQuota(ctx, config, size, 1) {
+			return compute.VirtualMachineSizeTypes(size.Name)
+		}
+		fmt.Println("Choose a smaller VM size, or request a quota increase in the Azure portal.")
+	}
 }
 
-func createVM(ctx context.Context, config azconfig.AZConfig, vmName string) (compute.VirtualMachine, aznetwork.NetworkStack) {
-	sshKeyData := loadSSHKey()
+func createVM(ctx context.Context, config azconfig.AZConfig, vmName string, customData CustomDataFunc) (compute.VirtualMachine, aznetwork.NetworkStack) {
+	authorizedKeys := azssh.AuthorizedKeys(config)
 	adminPassword := RandStringBytes(32)
 
 	logger := logrus.WithFields(logrus.Fields{
@@ -177,9 +183,39 @@ func createVM(ctx context.Context, config azconfig.AZConfig, vmName string) (com
 		"vmName":        vmName,
 	})
 
-	vmSize := askVMSize(ctx)
+	vmSize := askVMSize(ctx, config)
+	image := config.ManagerOSImage()
+	logger.WithFields(logrus.Fields{
+		"publisher": image.Publisher,
+		"offer":     image.Offer,
+		"sku":       image.SKU,
+		"version":   image.Version,
+	}).Info("using OS image")
 	netstack := aznetwork.CreateNetworkStack(ctx, config, vmName)
 
+	sshPublicKeys := []compute.SSHPublicKey{}
+	for _, keyData := range authorizedKeys {
+		sshPublicKeys = append(sshPublicKeys, compute.SSHPublicKey{
+			Path:    to.StringPtr(fmt.Sprintf("/home/%s/.ssh/authorized_keys", adminUsername)),
+			KeyData: to.StringPtr(keyData),
+		})
+	}
+
+	osProfile := &compute.OSProfile{
+		ComputerName:  to.StringPtr(vmName),
+		AdminUsername: to.StringPtr(adminUsername),
+		AdminPassword: to.StringPtr(adminPassword),
+		LinuxConfiguration: &compute.LinuxConfiguration{
+			SSH: &compute.SSHConfiguration{
+				PublicKeys: &sshPublicKeys,
+			},
+		},
+	}
+	if customData != nil {
+		logger.Info("passing cloud-init custom data to the VM")
+		osProfile.CustomData = to.StringPtr(customData(netstack))
+	}
+
 	logger.Info("creating virtual machine")
 	vmClient := getVMClient(config)
 	future, err := vmClient.CreateOrUpdate(
@@ -194,25 +230,14 @@ func createVM(ctx context.Context, config azconfig.AZConfig, vmName string) (com
 				},
 				StorageProfile: &compute.StorageProfile{
 					ImageReference: &compute.ImageReference{
-						Publisher: to.StringPtr(publisher),
-						Offer:     to.StringPtr(offer),
-						Sku:       to.StringPtr(sku),
-						Version:   to.StringPtr("latest"),
-					},
-				},
-				OsProfile: &compute.OSProfile{
-					ComputerName:  to.StringPtr(vmName),
-					AdminUsername: to.StringPtr(adminUsername),
-					AdminPassword: to.StringPtr(adminPassword),
-					LinuxConfiguration: &compute.LinuxConfiguration{
-						SSH: &compute.SSHConfiguration{
-							PublicKeys: &[]compute.SSHPublicKey{{
-								Path:    to.StringPtr(fmt.Sprintf("/home/%s/.ssh/authorized_keys", adminUsername)),
-								KeyData: to.StringPtr(sshKeyData),
-							}},
-						},
+						Publisher: to.StringPtr(image.Publisher),
+						Offer:     to.StringPtr(image.Offer),
+						Sku:       to.StringPtr(image.SKU),
+						Version:   to.StringPtr(image.Version),
 					},
+					DataDisks: dataDisks(ctx, config, vmName),
 				},
+				OsProfile: osProfile,
 				NetworkProfile: &compute.NetworkProfile{
 					NetworkInterfaces: &[]compute.NetworkInterfaceReference{{
 						ID: netstack.Interface.ID,
@@ -0,0 +1,143 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/flamenco-manager-azure/azresource"
+	"github.com/Azure/flamenco-manager-azure/azstorage"
+	"github.com/sirupsen/logrus"
+)
+
+// cloneCommand handles 'clone': it creates a parallel deployment based on the current one,
+// with its own configuration file.
+func cloneCommand(ctx context.Context, source azconfig.AZConfig, startupTime time.Time, args []string) {
+	var cloneArgs struct {
+		name       string
+		location   string
+		group      string
+		configFile string
+		restore    bool
+		keepSecret bool
+	}
+	flags := flag.NewFlagSet("clone", flag.ExitOnError)
+	flags.StringVar(&cloneArgs.name, "name", "", "Name of the new deployment; used as VM name and default for other names. Required.")
+	flags.StringVar(&cloneArgs.location, "location", "", "Physical location of the new deployment. Defaults to the current location.")
+	flags.StringVar(&cloneArgs.group, "group", "", "Resource group of the new deployment. Defaults to the new name.")
+	flags.StringVar(&cloneArgs.configFile, "config", "", "Configuration file of the new deployment. Defaults to flamenco_manager_azure-{name}.yaml.")
+	flags.BoolVar(&cloneArgs.restore, "restore", false, "Back up the current Manager database and restore it onto the new Manager.")
+	flags.BoolVar(&cloneArgs.keepSecret, "keep-secret", false, "Keep the worker registration secret, instead of generating a new one.")
+	flags.Parse(args)
+
+	if cloneArgs.name == "" {
+		logrus.Error("the 'clone' command needs a name for the new deployment")
+		flags.Usage()
+		os.Exit(2)
+	}
+	if cloneArgs.configFile == "" {
+		cloneArgs.configFile = fmt.Sprintf("flamenco_manager_azure-%s.yaml", cloneArgs.name)
+	}
+
+	requireDeployment(ctx, source)
+	azstorage.GetCredentials(ctx, &source)
+	defer azstorage.AllowOperatorAccess(ctx, source)()
+
+	logger := logrus.WithFields(logrus.Fields{
+		"source":     source.Filename(),
+		"configFile": cloneArgs.configFile,
+	})
+
+	// An existing config file means a previous clone was interrupted; just continue with it.
+	var target azconfig.AZConfig
+	if _, err := os.Stat(cloneArgs.configFile); err == nil {
+		logger.Info("configuration of the new deployment exists, continuing with it")
+		target = azconfig.Load(cloneArgs.configFile)
+	} else {
+		target = cloneConfig(source, cloneArgs.name, cloneArgs.location, cloneArgs.group, cloneArgs.keepSecret)
+		target.SaveAs(cloneArgs.configFile)
+		logger.Info("created configuration of the new deployment")
+	}
+	if !azresource.EnsureResourceGroup(ctx, &target, target.ResourceGroup) {
+		logger.WithField("resourceGroup", target.ResourceGroup).Fatal("unable to create resource group for the new deployment")
+	}
+
+	// Copying the apps before the Manager is installed means they don't have to be downloaded again.
+	// The setup script overwrites the worker configuration with the one for the new deployment.
+	target = deploy(ctx, target, startupTime, func(target azconfig.AZConfig) {
+		azstorage.CopyShare(ctx, source, target, "flamenco-resources")
+	})
+
+	if cloneArgs.restore {
+		archiveName := makeBackup(ctx, source, source.VMName)
+		azstorage.CopyShare(ctx, source, target, azstorage.BackupShareName)
+		restoreBackup(ctx, target, target.VMName, archiveName)
+	}
+
+	logger.Info("clone complete; use -config to manage the new deployment")
+}
+
+// cloneConfig returns the config for a new deployment based on the source config.
+// The names of the new storage and batch accounts are asked for during deployment.
+func cloneConfig(source azconfig.AZConfig, name, location, group string, keepSecret bool) azconfig.AZConfig {
+	target := source
+	target.DefaultName = name
+	target.VMName = name
+	target.ResourceGroup = group
+	if target.ResourceGroup == "" {
+		target.ResourceGroup = name
+	}
+	if location != "" {
+		target.Location = location
+	}
+	target.StorageAccountName = ""
+	target.BatchAccountName = ""
+	target.StorageCreds = azconfig.StorageCredentials{}
+
+	// The DNS record belongs to the source deployment; pointing it elsewhere is up to the user.
+	target.DNS = nil
+	target.KnownHostsFile = ""
+
+	// Sections that are changed for the new deployment must not be shared with the source.
+	if source.Batch != nil {
+		batch := *source.Batch
+		batch.StoppedTargets = nil
+		target.Batch = &batch
+	}
+	if source.VPN != nil {
+		// Otherwise the certificates and instructions of the source deployment would be overwritten.
+		vpn := *source.VPN
+		vpn.OutputDir = vpn.WithDefaults().OutputDir + "-" + name
+		target.VPN = &vpn
+	}
+
+	if !keepSecret {
+		target.ResetWorkerRegistrationSecret()
+	}
+	return target
+}
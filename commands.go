@@ -0,0 +1,201 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Azure/flamenco-manager-azure/azauth"
+	"github.com/Azure/flamenco-manager-azure/azbatch"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/flamenco-manager-azure/aznetwork"
+	"github.com/Azure/flamenco-manager-azure/azssh"
+	"github.com/Azure/flamenco-manager-azure/azstorage"
+	"github.com/Azure/flamenco-manager-azure/azvm"
+	"github.com/Azure/flamenco-manager-azure/textio"
+	"github.com/sirupsen/logrus"
+)
+
+// requireDeployment hard-exits the process when the config does not describe an existing deployment.
+// Commands other than 'deploy' operate on what the deployment created, and never prompt for it.
+func requireDeployment(ctx context.Context, config azconfig.AZConfig) {
+	logger := logrus.WithField("filename", config.Filename())
+	if config.SubscriptionID == "" || config.ResourceGroup == "" || config.VMName == "" {
+		logger.Fatal("configuration does not describe a deployment yet; run the 'deploy' command first")
+	}
+	azauth.EnsureCredentialsFile(ctx)
+}
+
+// managerVMName returns the name of the Manager VM given on the CLI, or otherwise the one from the config.
+func managerVMName(config azconfig.AZConfig) string {
+	if cliArgs.vmName != "" {
+		return cliArgs.vmName
+	}
+	return config.VMName
+}
+
+// connectToManager opens an SSH connection to the Manager VM.
+func connectToManager(ctx context.Context, config azconfig.AZConfig, vmName string) (azssh.Connection, aznetwork.NetworkStack) {
+	_, netStack := azvm.FindVM(ctx, config, vmName)
+	pinHostKeys(ctx, config, vmName, netStack)
+	sshContext := azssh.LoadSSHContext(ctx, config)
+	return azssh.Connect(ctx, sshContext, *netStack.PublicIP.IPAddress), netStack
+}
+
+// pinHostKeys fetches the SSH host keys of the Manager VM through the Azure API, and adds them to
+// the known_hosts file, unless the VM is known already. If that fails, the first SSH connection
+// trusts the host key it gets instead.
+func pinHostKeys(ctx context.Context, config azconfig.AZConfig, vmName string, netStack aznetwork.NetworkStack) {
+	knownHostsFile := config.KnownHostsPath()
+	publicIP := *netStack.PublicIP.IPAddress
+	if azssh.IsKnownHost(knownHostsFile, publicIP) {
+		return
+	}
+
+	hostKeys, err := azvm.FetchHostKeys(ctx, config, vmName)
+	if err != nil || len(hostKeys) == 0 {
+		logrus.WithError(err).Warning("unable to fetch SSH host keys through Azure, trusting them on first use")
+		return
+	}
+
+	addresses := []string{publicIP, netStack.FQDN()}
+	if managerFQDN := config.ManagerFQDN(netStack.FQDN()); managerFQDN != netStack.FQDN() {
+		addresses = append(addresses, managerFQDN)
+	}
+	azssh.PinHostKeys(knownHostsFile, addresses, hostKeys)
+}
+
+// vmCommand handles 'vm start|stop|restart|resize'.
+func vmCommand(ctx context.Context, config azconfig.AZConfig, args []string) {
+	if len(args) == 0 {
+		logrus.Error("the 'vm' command needs a subcommand")
+		flag.Usage()
+		os.Exit(2)
+	}
+	requireDeployment(ctx, config)
+	vmName := managerVMName(config)
+
+	switch subcommand := args[0]; subcommand {
+	case "start":
+		azvm.StartVM(ctx, config, vmName)
+		if config.Batch == nil || config.Batch.StoppedTargets == nil {
+			logrus.Info("the pool was not scaled down by 'vm stop', leaving it as it is")
+			break
+		}
+		targets := config.Batch.StoppedTargets
+		azbatch.ScalePool(ctx, config, targets.DedicatedNodes, targets.LowPriorityNodes)
+		config.Batch.StoppedTargets = nil
+		config.Save()
+	case "stop":
+		// Workers without a Manager are just burning money, so get rid of them first.
+		// Remember how many there were, unless an earlier 'vm stop' already did.
+		targets := azbatch.PoolTargets(ctx, config)
+		if targets != nil && (targets.DedicatedNodes > 0 || targets.LowPriorityNodes > 0) {
+			config.Batch.StoppedTargets = targets
+			config.Save()
+		}
+		azbatch.ScalePool(ctx, config, 0, 0)
+		azvm.DeallocateVM(ctx, config, vmName)
+	case "restart":
+		azvm.RestartVM(ctx, config, vmName)
+	case "resize":
+		vmSize := ""
+		if len(args) > 1 {
+			vmSize = args[1]
+		}
+		azvm.ResizeVM(ctx, config, vmName, vmSize)
+	default:
+		logrus.WithField("subcommand", subcommand).Error("unknown 'vm' subcommand")
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// backupCommand handles 'backup'.
+func backupCommand(ctx context.Context, config azconfig.AZConfig) {
+	requireDeployment(ctx, config)
+	azstorage.GetCredentials(ctx, &config)
+	makeBackup(ctx, config, managerVMName(config))
+}
+
+// makeBackup backs up the Manager on the given VM, and returns the name of the backup archive.
+// The config must have its storage credentials loaded.
+func makeBackup(ctx context.Context, config azconfig.AZConfig, vmName string) string {
+	defer azstorage.AllowOperatorAccess(ctx, config)()
+	share := azstorage.EnsureBackupShare(ctx, config)
+	archiveName := fmt.Sprintf("flamenco-backup-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+
+	ssh, _ := connectToManager(ctx, config, vmName)
+	defer ssh.Close()
+	ssh.Backup(ctx, share, azstorage.SMBCredentials(config), archiveName, config.BackupRetention())
+	return archiveName
+}
+
+// restoreCommand handles 'restore [archive]'. Without archive name, the user can choose one.
+func restoreCommand(ctx context.Context, config azconfig.AZConfig, args []string) {
+	requireDeployment(ctx, config)
+	azstorage.GetCredentials(ctx, &config)
+	archiveName := ""
+	if len(args) > 0 {
+		archiveName = args[0]
+	}
+	restoreBackup(ctx, config, managerVMName(config), archiveName)
+}
+
+// restoreBackup restores a backup onto the Manager on the given VM.
+// If archiveName is empty, the user can choose from the available backups.
+// The config must have its storage credentials loaded.
+func restoreBackup(ctx context.Context, config azconfig.AZConfig, vmName, archiveName string) {
+	defer azstorage.AllowOperatorAccess(ctx, config)()
+	share := azstorage.EnsureBackupShare(ctx, config)
+	smbCredentials := azstorage.SMBCredentials(config)
+
+	ssh, netStack := connectToManager(ctx, config, vmName)
+	defer ssh.Close()
+
+	backups := ssh.ListBackups(share, smbCredentials)
+	if len(backups) == 0 {
+		logrus.WithField("share", share).Fatal("there are no backups to restore")
+	}
+	if archiveName == "" {
+		fmt.Println("Available backups, most recent first:")
+		for _, backup := range backups {
+			fmt.Printf("  - %s\n", backup)
+		}
+		archiveName = textio.ReadLineWithDefault(ctx, "Backup to restore", backups[0])
+	}
+	if !textio.StrMap(backups)[archiveName] {
+		logrus.WithField("archive", archiveName).Fatal("no such backup")
+	}
+
+	ssh.Restore(ctx, share, smbCredentials, archiveName, azssh.ManagerSettings{
+		FQDN:             config.ManagerFQDN(netStack.FQDN()),
+		WorkerSecret:     config.WorkerRegistrationSecret,
+		Location:         config.Location,
+		BatchAccountName: config.BatchAccountName,
+	})
+}
@@ -0,0 +1,77 @@
+# Functions for downloading and installing the components listed in flamenco-components.sh.
+# Sourced by flamenco-manager-setup-vm.sh and flamenco-manager-upgrade.sh, which set COMPONENTS_DIR
+# to the directory with the downloaded archives.
+
+# download_component PREFIX downloads the archive of a component into the current directory,
+# using the PREFIX_URL, PREFIX_FILE and PREFIX_SHA256 variables from flamenco-components.sh.
+# With a component cache, the archive is copied from there instead.
+# A missing or mismatching checksum aborts the setup; nothing is extracted before it is verified.
+# Only a checksum of 'skip' installs the archive without verification.
+download_component() {
+    local url_var=${1}_URL file_var=${1}_FILE sha256_var=${1}_SHA256
+    local url=${!url_var} file=${!file_var} expected=${!sha256_var}
+    local actual
+
+    if [ -z "$expected" ]; then
+        echo "    ERROR: no checksum configured for $file" >&2
+        exit 4
+    fi
+    if [ -e "$file" ]; then
+        actual=$(sha256sum "$file" | cut -d' ' -f1)
+        if [ "$expected" = skip -o "$actual" = "$expected" ]; then
+            echo "  - $file [already downloaded, sha256 $actual]"
+            return
+        fi
+    fi
+
+    if [ -n "$COMPONENT_CACHE" ]; then
+        if [ ! -e "$COMPONENT_CACHE/$file" ]; then
+            echo "    ERROR: $file is not in the component cache $COMPONENT_CACHE" >&2
+            exit 4
+        fi
+        echo "  - $COMPONENT_CACHE/$file"
+        cp "$COMPONENT_CACHE/$file" "$file.partial"
+    else
+        echo "  - $url"
+        curl -fsSL --retry 3 -o "$file.partial" "$url"
+    fi
+    actual=$(sha256sum "$file.partial" | cut -d' ' -f1)
+    if [ "$expected" = skip ]; then
+        echo "    WARNING: checksum verification disabled for $file; its sha256 is $actual"
+    elif [ "$actual" != "$expected" ]; then
+        echo "    ERROR: $file has sha256 $actual, but $expected was expected" >&2
+        rm -f "$file.partial"
+        exit 4
+    fi
+    mv "$file.partial" "$file"
+}
+
+# install_component PREFIX [USER] extracts the downloaded archive of a component into PREFIX_DIR in
+# the current directory, and points the symlinks in PREFIX_LINKS there.
+# The archive is expected to contain a single top-level directory.
+# --atime-preserve=system --touch is necessary to extract on an SMB share without errors/warnings.
+install_component() {
+    local file_var=${1}_FILE dir_var=${1}_DIR links_var=${1}_LINKS
+    local archive=$COMPONENTS_DIR/${!file_var}
+    local target=${!dir_var} links=${!links_var}
+    local as_user=()
+    if [ -n "$2" ]; then
+        as_user=(sudo -u "$2")
+    fi
+
+    if [ -e "$target" ]; then
+        echo "  - $target [already installed]"
+    else
+        echo "  - $target -> $(pwd)"
+        "${as_user[@]}" rm -rf "$target.partial"
+        "${as_user[@]}" mkdir "$target.partial"
+        "${as_user[@]}" tar xf "$archive" -C "$target.partial" --strip-components=1 \
+            --atime-preserve=system --touch
+        "${as_user[@]}" mv "$target.partial" "$target"
+    fi
+
+    local link
+    for link in $links; do
+        "${as_user[@]}" ln -sfn "$target" "$link"
+    done
+}
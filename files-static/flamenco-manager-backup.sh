@@ -0,0 +1,114 @@
+#!/bin/bash
+
+# Backs up and restores Flamenco Manager: its MongoDB database and flamenco-manager.yaml.
+# Backups are stored on an Azure Files share, which is mounted on demand.
+#
+# Usage:
+#   flamenco-manager-backup.sh backup  <share> <archive name> <number of backups to keep>
+#   flamenco-manager-backup.sh list    <share>
+#   flamenco-manager-backup.sh extract-config <share> <archive name> <copy>
+#   flamenco-manager-backup.sh restore <share> <archive name> <adjusted flamenco-manager.yaml>
+
+set -e
+
+MODE="$1"
+SHARE="$2"
+
+BACKUP_DIR=/mnt/flamenco-backup
+CREDENTIALS=/etc/flamenco-backup.smbcredentials
+FM_USER=flamanager
+MANAGER_HOME=$(getent passwd $FM_USER | cut -d: -f6)
+MY_DIR="$(dirname "$(readlink -f "$0")")"
+
+# The credentials are uploaded next to this script; only root gets to keep them.
+if [ -e $MY_DIR/flamenco-backup.smbcredentials ]; then
+    sudo install -m 0600 -o root -g root $MY_DIR/flamenco-backup.smbcredentials $CREDENTIALS
+    rm $MY_DIR/flamenco-backup.smbcredentials
+fi
+if ! mountpoint -q $BACKUP_DIR; then
+    sudo mkdir -p $BACKUP_DIR
+    sudo mount -t cifs $SHARE $BACKUP_DIR \
+        -o vers=3.0,credentials=$CREDENTIALS,dir_mode=0700,file_mode=0600,sec=ntlmssp
+fi
+
+list_backups() {
+    sudo find $BACKUP_DIR -maxdepth 1 -name 'flamenco-backup-*.tar.gz' -printf '%f\n' | sort -r
+}
+
+if [ "$MODE" = "list" ]; then
+    list_backups
+    exit 0
+fi
+
+# Only the MongoDB server is installed by the setup script of older deployments.
+if ! command -v mongodump >/dev/null; then
+    echo "Installing MongoDB tools"
+    sudo DEBIAN_FRONTEND=noninteractive apt-get install -qy mongodb-org-tools
+fi
+
+WORK_DIR=$(mktemp -d)
+trap "sudo rm -rf $WORK_DIR" EXIT
+
+case "$MODE" in
+    backup)
+        ARCHIVE="$3"
+        KEEP="$4"
+
+        echo "Dumping MongoDB database"
+        mongodump --db flamanager --gzip --archive=$WORK_DIR/mongodb.archive.gz
+        sudo cp $MANAGER_HOME/flamenco-manager.yaml $WORK_DIR/
+        sudo tar czf $BACKUP_DIR/$ARCHIVE -C $WORK_DIR mongodb.archive.gz flamenco-manager.yaml
+        echo "Backup stored as $ARCHIVE"
+
+        # Archive names contain a timestamp, so sorting by name sorts by age.
+        list_backups | tail -n +$((KEEP + 1)) | while read OLD_ARCHIVE; do
+            echo "Removing old backup $OLD_ARCHIVE"
+            sudo rm $BACKUP_DIR/$OLD_ARCHIVE
+        done
+        ;;
+
+    extract-config)
+        # The config is adjusted to this deployment before it is restored.
+        ARCHIVE="$3"
+        COPY="$4"
+        if [ ! -e $BACKUP_DIR/$ARCHIVE ]; then
+            echo "Backup $ARCHIVE does not exist" >&2
+            exit 1
+        fi
+        sudo tar xzf $BACKUP_DIR/$ARCHIVE -C $WORK_DIR flamenco-manager.yaml
+        sudo install -o $(id -un) -g $(id -gn) -m 0600 $WORK_DIR/flamenco-manager.yaml "$COPY"
+        ;;
+
+    restore)
+        ARCHIVE="$3"
+        CONFIG="$4"
+
+        if [ ! -e $BACKUP_DIR/$ARCHIVE ]; then
+            echo "Backup $ARCHIVE does not exist" >&2
+            exit 1
+        fi
+        sudo tar xzf $BACKUP_DIR/$ARCHIVE -C $WORK_DIR mongodb.archive.gz
+
+        echo "Stopping Flamenco Manager"
+        sudo systemctl stop flamenco-manager
+
+        echo "Restoring MongoDB database"
+        mongorestore --drop --gzip --archive=$WORK_DIR/mongodb.archive.gz
+
+        echo "Restoring flamenco-manager.yaml"
+        MANAGER_YAML=$MANAGER_HOME/flamenco-manager.yaml
+        if sudo test -e $MANAGER_YAML; then
+            sudo -u $FM_USER cp $MANAGER_YAML $MANAGER_YAML~before-restore
+        fi
+        sudo install -o $FM_USER -g flamenco -m 0600 "$CONFIG" $MANAGER_YAML
+        rm -f "$CONFIG"
+
+        echo "Starting Flamenco Manager"
+        sudo systemctl start flamenco-manager
+        ;;
+
+    *)
+        echo "Unknown mode '$MODE'" >&2
+        exit 2
+        ;;
+esac
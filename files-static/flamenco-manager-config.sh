@@ -0,0 +1,52 @@
+#!/bin/bash
+
+# Reads and replaces flamenco-manager.yaml, for merging changes of the default configuration into it.
+# Next to it, flamenco-manager.yaml~last-default holds the default configuration the file is based on.
+#
+# Usage:
+#   flamenco-manager-config.sh fetch live|base <copy>
+#   flamenco-manager-config.sh apply <merged config> <new default config>
+#   flamenco-manager-config.sh set-base <new default config>
+
+set -e
+
+MODE="$1"
+FM_USER=flamanager
+MANAGER_HOME=$(getent passwd $FM_USER | cut -d: -f6)
+MANAGER_YAML=$MANAGER_HOME/flamenco-manager.yaml
+BASE_YAML=$MANAGER_HOME/flamenco-manager.yaml~last-default
+
+case "$MODE" in
+    fetch)
+        case "$2" in
+            live) FILE=$MANAGER_YAML ;;
+            base) FILE=$BASE_YAML ;;
+            *) echo "Usage: $0 fetch live|base <copy>" >&2; exit 2 ;;
+        esac
+        # Copy the file to where the SSH user can download it unaltered.
+        rm -f "$3"
+        if sudo test -e $FILE; then
+            sudo install -o $(id -un) -g $(id -gn) -m 0600 $FILE "$3"
+            echo present
+        else
+            echo missing
+        fi
+        ;;
+    apply)
+        echo "Backing up flamenco-manager.yaml to flamenco-manager.yaml~before-merge"
+        sudo cp -a $MANAGER_YAML $MANAGER_YAML~before-merge
+        sudo install -o $FM_USER -g $(sudo stat -c %G $MANAGER_YAML) -m $(sudo stat -c %a $MANAGER_YAML) "$2" $MANAGER_YAML
+        sudo install -o $FM_USER -g flamenco -m 0644 "$3" $BASE_YAML
+        rm -f "$2" "$3"
+        echo "Restarting Flamenco Manager"
+        sudo systemctl restart flamenco-manager
+        ;;
+    set-base)
+        sudo install -o $FM_USER -g flamenco -m 0644 "$2" $BASE_YAML
+        rm -f "$2"
+        ;;
+    *)
+        echo "Usage: $0 fetch live|base <copy> | apply <merged> <default> | set-base <default>" >&2
+        exit 2
+        ;;
+esac
@@ -0,0 +1,40 @@
+#!/bin/bash
+
+# Runs as root on the Flamenco Manager VM, either from cloud-init or through the Azure run-command
+# API. It does what the SSH-based deployment does: put the files in the admin user's home directory
+# and run flamenco-manager-setup-vm.sh there. The outcome is written to the status file, which the
+# deployment tool polls.
+
+ADMIN_USER="$1"
+FMANAGER_GROUP=flamenco
+INSTALL_SCRIPT=flamenco-manager-setup-vm.sh
+
+PROVISION_DIR="$(dirname "$(readlink -f "$0")")"
+STATUS_FILE=$PROVISION_DIR/status
+LOG_FILE=$PROVISION_DIR/provision.log
+
+rm -f $STATUS_FILE
+(
+    set -e
+    echo "Provisioning started at $(date --iso-8601=sec)"
+
+    groupadd --force $FMANAGER_GROUP
+    usermod $ADMIN_USER --append --groups $FMANAGER_GROUP
+
+    ADMIN_HOME=$(getent passwd $ADMIN_USER | cut -d: -f6)
+    for file in $PROVISION_DIR/files/*; do
+        install -o $ADMIN_USER -g $(id -gn $ADMIN_USER) -m $(stat -c %a $file) $file $ADMIN_HOME/
+    done
+    rm -f $PROVISION_DIR/files/client_credentials.json
+
+    # A login shell picks up the new group membership, and starts in the home directory.
+    sudo -iu $ADMIN_USER bash $INSTALL_SCRIPT
+) >>$LOG_FILE 2>&1
+EXIT_CODE=$?
+
+if [ $EXIT_CODE -eq 0 ]; then
+    echo "ok" > $STATUS_FILE
+else
+    echo "failed $EXIT_CODE" > $STATUS_FILE
+fi
+exit $EXIT_CODE
@@ -2,18 +2,13 @@
 
 set -e
 
-FMANAGER_VERSION="2.7"
-FWORKER_VERSION="2.5"
-FFMPEG_VERSION="4.2.1"
-AZURE_PREEMPT_MONITOR_VERSION="1.1"
-
-BLENDER_TAR_XZ=$(curl -s https://builder.blender.org/download/ | grep -oE "(blender-2\.83-[a-z0-9]+-linux-glibc[0-9]+-x86_64\.tar\.xz)")
-BLENDER_TAR="${BLENDER_TAR_XZ%.*}"
-BLENDER_DIR="${BLENDER_TAR%.*}"
-
 WORKER_COMPONENTS_DIR="/mnt/flamenco-resources/apps"
 MY_DIR="$(dirname "$(readlink -f "$0")")"
 
+# Versions, URLs and checksums of the components; flamenco-components.sh is rendered by the Go code.
+. $MY_DIR/flamenco-components.sh
+. $MY_DIR/flamenco-components-functions.sh
+
 ## Set up the firewall via UWF
 sudo -s <<EOT
 set -e
@@ -43,17 +38,61 @@ ufw reload  # just in case it already was enabled
 EOT
 
 
+## Determine release-specific packages
+# Flamenco Manager's MongoDB driver does not support MongoDB 5.1 and newer, and MongoDB 4.4
+# has no packages for Ubuntu 22.04, so that uses the 20.04 packages with the OpenSSL they need.
+. /etc/os-release
+case "$VERSION_CODENAME" in
+    bionic)
+        MONGODB_VERSION="4.0"
+        MONGODB_DIST="bionic"
+        EXTRA_PACKAGES=""
+        ;;
+    focal)
+        MONGODB_VERSION="4.4"
+        MONGODB_DIST="focal"
+        EXTRA_PACKAGES=""
+        ;;
+    jammy)
+        MONGODB_VERSION="4.4"
+        MONGODB_DIST="focal"
+        EXTRA_PACKAGES="libssl1.1"
+        ;;
+    *)
+        echo "Unsupported Ubuntu release '$VERSION_CODENAME'; use Ubuntu 18.04, 20.04 or 22.04." >&2
+        exit 3
+        ;;
+esac
+echo "Setting up for Ubuntu $VERSION_ID ($VERSION_CODENAME) with MongoDB $MONGODB_VERSION"
+
+
 ## Install system packages
 sudo -s <<EOT
-apt-get install -qy software-properties-common
-apt-key adv --keyserver hkp://keyserver.ubuntu.com:80 --recv 9DA31620334BD75D9DCB49F368818C72E52529D4
-cat > /etc/apt/sources.list.d/mongodb-org-4.0.list <<END
-deb [ arch=amd64 ] https://repo.mongodb.org/apt/ubuntu bionic/mongodb-org/4.0 multiverse
+set -e
+apt-get install -qy software-properties-common curl gnupg
+curl -fsSL https://pgp.mongodb.com/server-${MONGODB_VERSION}.asc | \
+    gpg --dearmor --yes -o /usr/share/keyrings/mongodb-server-${MONGODB_VERSION}.gpg
+rm -f /etc/apt/sources.list.d/mongodb-org-*.list
+cat > /etc/apt/sources.list.d/mongodb-org-${MONGODB_VERSION}.list <<END
+deb [ arch=amd64 signed-by=/usr/share/keyrings/mongodb-server-${MONGODB_VERSION}.gpg ] https://repo.mongodb.org/apt/ubuntu ${MONGODB_DIST}/mongodb-org/${MONGODB_VERSION} multiverse
+END
+if [ "$EXTRA_PACKAGES" = "libssl1.1" ]; then
+    # Only take libssl1.1 from focal-security; everything else keeps coming from this release.
+    echo "deb http://archive.ubuntu.com/ubuntu focal-security main" > /etc/apt/sources.list.d/focal-security.list
+    cat > /etc/apt/preferences.d/focal-security <<END
+Package: *
+Pin: release a=focal-security
+Pin-Priority: -1
+
+Package: libssl1.1
+Pin: release a=focal-security
+Pin-Priority: 500
 END
+fi
 apt-get update -q
 DEBIAN_FRONTEND=noninteractive apt-get install -qy \
     -o APT::Install-Recommends=false -o APT::Install-Suggests=false \
-    imagemagick mongodb-org-server
+    imagemagick mongodb-org-server mongodb-org-tools $EXTRA_PACKAGES
 systemctl enable mongod.service
 EOT
 
@@ -77,87 +116,84 @@ fi
 MANAGER_HOME=$(getent passwd $FM_USER | cut -d: -f6)
 
 
+## Put MongoDB and Flamenco Manager state on the data disk, if there is one.
+# The disk is only formatted when it has no filesystem yet, so that a re-used disk keeps its data.
+DATA_DISK=/dev/disk/azure/scsi1/lun0
+if [ -e $DATA_DISK ]; then
+    echo "Setting up data disk $DATA_DISK on /data"
+    sudo -s <<EOT
+set -e
+systemctl stop flamenco-manager.service mongod.service 2>/dev/null || true
+
+if [ ! -e ${DATA_DISK}-part1 ]; then
+    parted -s $DATA_DISK mklabel gpt mkpart primary ext4 0% 100%
+    udevadm settle
+fi
+if ! blkid ${DATA_DISK}-part1 >/dev/null; then
+    mkfs.ext4 -q -L flamenco-data ${DATA_DISK}-part1
+fi
+
+DATA_UUID=\$(blkid -s UUID -o value ${DATA_DISK}-part1)
+mkdir -p /data
+grep -v ' /data' < /etc/fstab | grep -v ' /var/lib/mongodb ' | grep -v ' $MANAGER_HOME ' > /etc/fstab~data
+echo "UUID=\$DATA_UUID /data ext4 defaults,nofail 0 2" >> /etc/fstab~data
+echo "/data/mongodb /var/lib/mongodb none bind,nofail 0 0" >> /etc/fstab~data
+echo "/data/flamanager $MANAGER_HOME none bind,nofail 0 0" >> /etc/fstab~data
+# The new fstab is only installed after the migration, so mount the disk explicitly.
+mountpoint -q /data || mount -t ext4 UUID=\$DATA_UUID /data
+
+# Migrate existing data on first use of the disk.
+if [ ! -e /data/mongodb ]; then
+    mkdir -p /var/lib/mongodb
+    cp -a /var/lib/mongodb /data/mongodb
+fi
+if [ ! -e /data/flamanager ]; then
+    cp -a $MANAGER_HOME /data/flamanager
+fi
+mv /etc/fstab~data /etc/fstab
+mountpoint -q /var/lib/mongodb || mount /var/lib/mongodb
+mountpoint -q $MANAGER_HOME || mount $MANAGER_HOME
+
+chown -R mongodb:mongodb /data/mongodb
+chown -R $FM_USER:flamenco /data/flamanager
+systemctl start mongod.service
+EOT
+fi
+
+
 echo "Downloading Components"
 mkdir -p $HOME/flamenco-components
 cd $HOME/flamenco-components
 COMPONENTS_DIR=$(pwd)
 
-wget -N \
-    https://www.flamenco.io/download/flamenco-manager-${FMANAGER_VERSION}-linux.tar.gz \
-    https://www.flamenco.io/download/flamenco-worker-${FWORKER_VERSION}-linux.tar.gz \
-    https://flamenco.io/download/azure-preempt-monitor/azure-preempt-monitor-v${AZURE_PREEMPT_MONITOR_VERSION}-linux.tar.gz \
-    https://builder.blender.org/download/${BLENDER_TAR_XZ} \
-    https://johnvansickle.com/ffmpeg/old-releases/ffmpeg-${FFMPEG_VERSION}-amd64-static.tar.xz
+for component in FLAMENCO_MANAGER $WORKER_COMPONENTS; do
+    download_component $component
+done
 
 
 echo "Installing Components"
 
 # Flamenco Manager
 cd $MANAGER_HOME
-if [ ! -e flamenco-manager-${FMANAGER_VERSION} ]; then
-    echo "  - Flamenco Manager ${FMANAGER_VERSION} -> $MANAGER_HOME"
-    sudo -u $FM_USER tar zxf $COMPONENTS_DIR/flamenco-manager-${FMANAGER_VERSION}-linux.tar.gz
-    sudo -u $FM_USER rm -f flamenco-manager
-    sudo -u $FM_USER ln -s flamenco-manager-${FMANAGER_VERSION} flamenco-manager
-else
-    echo "  - Flamenco Manager ${FMANAGER_VERSION} [already installed]"
-fi
-sudo cp $MY_DIR/flamenco-manager.service /etc/systemd/system/
+install_component FLAMENCO_MANAGER $FM_USER
+# flamenco-manager.service is put in /etc/systemd/system by the Go code.
 sudo systemctl daemon-reload
 
 
 # Flamenco Worker components (Worker itself + apps)
-# --atime-preserve=system --touch is necessary to extract on an SMB share without errors/warnings.
 mkdir -p $WORKER_COMPONENTS_DIR
 cd $WORKER_COMPONENTS_DIR
-
-if [ ! -e flamenco-worker-${FWORKER_VERSION} ]; then
-    echo "  - Flamenco Worker ${FWORKER_VERSION} -> $WORKER_COMPONENTS_DIR"
-    tar zxf $COMPONENTS_DIR/flamenco-worker-${FWORKER_VERSION}-linux.tar.gz \
-        --atime-preserve=system --touch
-    rm -f flamenco-worker
-    ln -s flamenco-worker-${FWORKER_VERSION} flamenco-worker
-else
-    echo "  - Flamenco Worker ${FWORKER_VERSION} [already installed]"
-fi
-
-if [ ! -e azure-preempt-monitor-v${AZURE_PREEMPT_MONITOR_VERSION} ]; then
-    echo "  - Azure Preempt Monitor ${AZURE_PREEMPT_MONITOR_VERSION} -> $WORKER_COMPONENTS_DIR"
-    tar zxf $COMPONENTS_DIR/azure-preempt-monitor-v${AZURE_PREEMPT_MONITOR_VERSION}-linux.tar.gz \
-        --atime-preserve=system --touch
-    rm -f azure-preempt-monitor
-    ln -s azure-preempt-monitor-v${AZURE_PREEMPT_MONITOR_VERSION} azure-preempt-monitor
-else
-    echo "  - Azure Preempt Monitor ${AZURE_PREEMPT_MONITOR_VERSION} [already installed]"
-fi
-
-BLENDER_VERSION=${BLENDER_DIR/blender-}
-if [ ! -e $BLENDER_DIR ]; then
-    echo "  - Blender ${BLENDER_VERSION} -> $WORKER_COMPONENTS_DIR"
-    tar Jxf $COMPONENTS_DIR/${BLENDER_TAR_XZ} \
-        --atime-preserve=system --touch
-    rm -f blender
-    ln -s $BLENDER_DIR blender
-else
-    echo "  - Blender ${BLENDER_VERSION} [already installed]"
-fi
-
-FFMPEG_DIR=ffmpeg-${FFMPEG_VERSION}-amd64-static
-if [ ! -e $FFMPEG_DIR ]; then
-    echo "  - FFmpeg ${FFMPEG_VERSION} -> $WORKER_COMPONENTS_DIR"
-    tar Jxf $COMPONENTS_DIR/ffmpeg-${FFMPEG_VERSION}-amd64-static.tar.xz \
-        --atime-preserve=system --touch
-    rm -f ffmpeg
-    ln -s $FFMPEG_DIR ffmpeg
-else
-    echo "  - FFmpeg ${FFMPEG_VERSION} [already installed]"
-fi
+for component in $WORKER_COMPONENTS; do
+    install_component $component
+done
 
 # Configure Flamenco Manager
 cd $MANAGER_HOME
 if [ ! -e flamenco-manager.yaml ]; then
     echo "Installing default flamenco-manager.yaml"
     sudo -u $FM_USER cp $MY_DIR/default-flamenco-manager.yaml flamenco-manager.yaml
+    # Keep the default the config is based on, for merging later changes of the default into it.
+    sudo -u $FM_USER cp $MY_DIR/default-flamenco-manager.yaml flamenco-manager.yaml~last-default
 else
     echo "flamenco-manager.yaml already exists, not touching"
 fi
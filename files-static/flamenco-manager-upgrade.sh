@@ -0,0 +1,74 @@
+#!/bin/bash
+
+# Upgrades Flamenco Manager and Flamenco Worker to the versions in flamenco-components.sh.
+# New versions are installed next to the old ones, after which the symlinks are switched.
+# When Flamenco Manager does not come up after the switch, the previous version is restored.
+
+set -e
+
+WORKER_COMPONENTS_DIR="/mnt/flamenco-resources/apps"
+MY_DIR="$(dirname "$(readlink -f "$0")")"
+
+# flamenco-components.sh is rendered by the Go code.
+. $MY_DIR/flamenco-components.sh
+. $MY_DIR/flamenco-components-functions.sh
+
+FM_USER=flamanager
+MANAGER_HOME=$(getent passwd $FM_USER | cut -d: -f6)
+
+# manager_is_healthy waits for Flamenco Manager to be running and to answer HTTP requests.
+# Any response counts, as it redirects to HTTPS when it has a certificate.
+manager_is_healthy() {
+    local attempt status
+    for attempt in $(seq 30); do
+        sleep 2
+        if ! systemctl is-active --quiet flamenco-manager; then
+            continue
+        fi
+        status=$(curl -s -o /dev/null -w '%{http_code}' --max-time 5 http://localhost:8080/ || true)
+        if [ "${status:-0}" -ge 200 -a "${status:-0}" -lt 500 ]; then
+            echo "  - Flamenco Manager is running and responds with HTTP $status"
+            return 0
+        fi
+    done
+    return 1
+}
+
+echo "Downloading Components"
+mkdir -p $HOME/flamenco-components
+cd $HOME/flamenco-components
+COMPONENTS_DIR=$(pwd)
+download_component FLAMENCO_MANAGER
+download_component FLAMENCO_WORKER
+
+
+echo "Upgrading Flamenco Manager"
+cd $MANAGER_HOME
+PREVIOUS_MANAGER=$(readlink flamenco-manager || true)
+install_component FLAMENCO_MANAGER $FM_USER
+
+if [ "$PREVIOUS_MANAGER" = "$FLAMENCO_MANAGER_DIR" ]; then
+    echo "  - Flamenco Manager $FLAMENCO_MANAGER_VERSION was already in use, not restarting it"
+else
+    echo "  - switched from ${PREVIOUS_MANAGER:-nothing} to $FLAMENCO_MANAGER_DIR, restarting"
+    sudo systemctl restart flamenco-manager
+    if ! manager_is_healthy; then
+        echo "ERROR: Flamenco Manager $FLAMENCO_MANAGER_VERSION did not start properly" >&2
+        sudo journalctl --unit flamenco-manager --lines 20 --no-pager >&2 || true
+        if [ -n "$PREVIOUS_MANAGER" ]; then
+            echo "Rolling back to $PREVIOUS_MANAGER" >&2
+            sudo -u $FM_USER ln -sfn "$PREVIOUS_MANAGER" flamenco-manager
+            sudo systemctl restart flamenco-manager
+        fi
+        exit 5
+    fi
+fi
+
+
+echo "Upgrading Flamenco Worker"
+# The Workers pick up the new version when they are restarted.
+mkdir -p $WORKER_COMPONENTS_DIR
+cd $WORKER_COMPONENTS_DIR
+install_component FLAMENCO_WORKER
+
+echo "Upgrade complete"
@@ -0,0 +1,19 @@
+# Components installed by flamenco-manager-setup-vm.sh, from the 'components' section of the
+# configuration. A checksum of 'skip' means verification was disabled with skipChecksum.
+{{- range .Components }}
+{{- $var := envName .ID }}
+
+{{ $var }}_VERSION={{ .Version | shell }}
+{{ $var }}_URL={{ .URL | shell }}
+{{ $var }}_FILE={{ .Filename | shell }}
+{{ $var }}_SHA256={{ if .SkipChecksum }}skip{{ else }}{{ .SHA256 | shell }}{{ end }}
+{{ $var }}_DIR={{ .Dir | shell }}
+{{ $var }}_LINKS={{ join .Links " " | shell }}
+{{- end }}
+
+# Directory with the archives, uploaded from the local component cache. When empty, the archives
+# are downloaded from their URLs.
+COMPONENT_CACHE={{ .ComponentCache | shell }}
+
+# Components on the 'flamenco-resources' share, in installation order.
+WORKER_COMPONENTS='{{ range $index, $component := .WorkerComponents }}{{ if $index }} {{ end }}{{ envName $component.ID }}{{ end }}'
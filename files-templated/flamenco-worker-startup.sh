@@ -49,12 +49,12 @@ else
     apt-get install libgl1-mesa-dev libglu1-mesa-dev libx11-dev libxi6 libxrender1 -y
 fi
 
-groupadd --force {{ .UnixGroupName }}  # --force makes sure it doesn't fail when the group already exists
-adduser _azbatch {{ .UnixGroupName }}
-adduser $USER {{ .UnixGroupName }}
+groupadd --force {{ .UnixGroupName | shell }}  # --force makes sure it doesn't fail when the group already exists
+adduser _azbatch {{ .UnixGroupName | shell }}
+adduser "$USER" {{ .UnixGroupName | shell }}
 
 echo === Preparing SMB shares ===
-cat > fstab-smb <<EOT
+cat > fstab-smb <<'EOT'
 {{ .FSTabForStorage }}
 EOT
 (
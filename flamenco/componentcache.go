@@ -0,0 +1,146 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/Azure/flamenco-manager-azure/azauth"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/sirupsen/logrus"
+)
+
+// FillComponentCache downloads the archives of all components into the local component cache,
+// unless they are already there with the right checksum. Returns the paths of the archives.
+// Errors are fatal, including a mismatching checksum of a fresh download.
+func FillComponentCache(ctx context.Context, config azconfig.AZConfig) []string {
+	cacheDir := config.ComponentCacheDir()
+	logger := logrus.WithField("cacheDir", cacheDir)
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		logger.WithError(err).Fatal("unable to create component cache directory")
+	}
+
+	paths := []string{}
+	for _, component := range config.Components() {
+		archivePath := filepath.Join(cacheDir, component.Filename())
+		paths = append(paths, archivePath)
+		logger := logger.WithFields(logrus.Fields{
+			"component": component.ID,
+			"version":   component.Version,
+			"filename":  component.Filename(),
+		})
+
+		checksum, err := fileSHA256(archivePath)
+		switch {
+		case os.IsNotExist(err):
+			// Not cached yet.
+		case err != nil:
+			logger.WithError(err).Fatal("unable to read cached component")
+		case component.SkipChecksum:
+			logger.WithField("sha256", checksum).Warning("component is cached; its checksum is not verified")
+			continue
+		case checksum == component.SHA256:
+			logger.Debug("component is cached")
+			continue
+		default:
+			logger.WithField("sha256", checksum).Warning("cached component has the wrong checksum, downloading it again")
+		}
+
+		logger.WithField("url", component.URL).Info("downloading component")
+		checksum, err = downloadComponent(ctx, component.URL, archivePath)
+		if err != nil {
+			logger.WithField("url", component.URL).WithError(err).Fatal("unable to download component")
+		}
+		if component.SkipChecksum {
+			logger.WithField("sha256", checksum).Warning("component downloaded; its checksum is not verified")
+			continue
+		}
+		if checksum != component.SHA256 {
+			os.Remove(archivePath)
+			logger.WithFields(logrus.Fields{
+				"sha256":         checksum,
+				"expectedSHA256": component.SHA256,
+			}).Fatal("downloaded component has the wrong checksum")
+		}
+		logger.Info("component downloaded and verified")
+	}
+	return paths
+}
+
+// downloadComponent downloads the URL to the file, and returns its SHA256 checksum.
+// The file only appears when the download is complete.
+func downloadComponent(ctx context.Context, url, filename string) (string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := azauth.HTTPClient().Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected HTTP status %s", response.Status)
+	}
+
+	partial := filename + ".partial"
+	file, err := os.Create(partial)
+	if err != nil {
+		return "", err
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hasher), response.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+	if err := os.Rename(partial, filename); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// fileSHA256 returns the hexadecimal SHA256 checksum of the file.
+func fileSHA256(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,212 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ConfigChange is a difference between the live flamenco-manager.yaml and the merged one,
+// or a conflict that was left alone. Values are nil when the key is absent.
+type ConfigChange struct {
+	Path     string      // dotted path of the key, like "dynamic_pool_platforms.azure.location"
+	Live     interface{} // value in the live config
+	Merged   interface{} // value in the merged config; the same as Live for conflicts
+	Default  interface{} // value in the new default config
+	Conflict bool        // both the live config and the default changed; the live value is kept
+}
+
+// String describes the change on a single line.
+func (cc ConfigChange) String() string {
+	switch {
+	case cc.Conflict:
+		return fmt.Sprintf("! %s: keeping %s, the new default is %s",
+			cc.Path, formatConfigValue(cc.Live), formatConfigValue(cc.Default))
+	case cc.Live == nil:
+		return fmt.Sprintf("+ %s: %s", cc.Path, formatConfigValue(cc.Merged))
+	case cc.Merged == nil:
+		return fmt.Sprintf("- %s: %s", cc.Path, formatConfigValue(cc.Live))
+	default:
+		return fmt.Sprintf("~ %s: %s -> %s", cc.Path, formatConfigValue(cc.Live), formatConfigValue(cc.Merged))
+	}
+}
+
+// MergeManagerConfig merges the changes between two versions of the default flamenco-manager.yaml
+// into the live one, which may have been changed through the Manager's web setup. Mappings are
+// merged key by key; other values, including lists, are compared as a whole. When a value was
+// changed in both the live config and the default, the live value is kept and a conflict reported.
+// An empty oldDefault means it's unknown, in which case every difference is a conflict.
+// Returns the merged config and the changes; changes that are not conflicts modify the live config.
+// The merged config is marshalled again from the parsed YAML, so comments in the live config are
+// lost; the order of the keys is kept.
+func MergeManagerConfig(oldDefault, newDefault, live []byte) ([]byte, []ConfigChange, error) {
+	var base, update, current yaml.MapSlice
+	if err := yaml.Unmarshal(oldDefault, &base); err != nil {
+		return nil, nil, fmt.Errorf("parsing previous default config: %w", err)
+	}
+	if err := yaml.Unmarshal(newDefault, &update); err != nil {
+		return nil, nil, fmt.Errorf("parsing new default config: %w", err)
+	}
+	if err := yaml.Unmarshal(live, &current); err != nil {
+		return nil, nil, fmt.Errorf("parsing live config: %w", err)
+	}
+
+	merged, changes := mergeMappings("", base, update, current)
+	mergedYAML, err := yaml.Marshal(merged)
+	if err != nil {
+		return nil, nil, fmt.Errorf("constructing merged config: %w", err)
+	}
+	return mergedYAML, changes, nil
+}
+
+// SetManagerConfigValues replaces the values of existing keys in flamenco-manager.yaml, by dotted
+// path like "dynamic_pool_platforms.azure.location". Keys that are absent are left absent. As with
+// MergeManagerConfig(), the config is marshalled again, so comments are lost.
+func SetManagerConfigValues(config []byte, values map[string]string) ([]byte, error) {
+	var parsed yaml.MapSlice
+	if err := yaml.Unmarshal(config, &parsed); err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+	for path, value := range values {
+		setMappingValue(parsed, strings.Split(path, "."), value)
+	}
+	updated, err := yaml.Marshal(parsed)
+	if err != nil {
+		return nil, fmt.Errorf("constructing config: %w", err)
+	}
+	return updated, nil
+}
+
+func setMappingValue(mapping yaml.MapSlice, path []string, value string) {
+	for index := range mapping {
+		if mapping[index].Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			mapping[index].Value = value
+			return
+		}
+		if nested, isMap := mapping[index].Value.(yaml.MapSlice); isMap {
+			setMappingValue(nested, path[1:], value)
+		}
+		return
+	}
+}
+
+func mergeMappings(prefix string, base, update, live yaml.MapSlice) (yaml.MapSlice, []ConfigChange) {
+	merged := yaml.MapSlice{}
+	changes := []ConfigChange{}
+
+	// Keep the order of the live config, with new keys at the end.
+	keys := []interface{}{}
+	for _, item := range live {
+		keys = append(keys, item.Key)
+	}
+	for _, item := range update {
+		if _, found := mappingValue(live, item.Key); !found {
+			keys = append(keys, item.Key)
+		}
+	}
+
+	for _, key := range keys {
+		path := fmt.Sprint(key)
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+		baseValue, inBase := mappingValue(base, key)
+		updateValue, inUpdate := mappingValue(update, key)
+		liveValue, inLive := mappingValue(live, key)
+
+		updateMap, updateIsMap := updateValue.(yaml.MapSlice)
+		liveMap, liveIsMap := liveValue.(yaml.MapSlice)
+		if updateIsMap && liveIsMap {
+			baseMap, _ := baseValue.(yaml.MapSlice)
+			mergedMap, subChanges := mergeMappings(path, baseMap, updateMap, liveMap)
+			merged = append(merged, yaml.MapItem{Key: key, Value: mergedMap})
+			changes = append(changes, subChanges...)
+			continue
+		}
+
+		result, keep := liveValue, inLive
+		switch {
+		case sameValue(updateValue, inUpdate, baseValue, inBase), sameValue(liveValue, inLive, updateValue, inUpdate):
+			// The default didn't change, or the live config already has the change.
+		case sameValue(liveValue, inLive, baseValue, inBase):
+			result, keep = updateValue, inUpdate
+			changes = append(changes, ConfigChange{Path: path, Live: liveValue, Merged: updateValue, Default: updateValue})
+		default:
+			changes = append(changes, ConfigChange{Path: path, Live: liveValue, Merged: liveValue, Default: updateValue, Conflict: true})
+		}
+		if keep {
+			merged = append(merged, yaml.MapItem{Key: key, Value: result})
+		}
+	}
+	return merged, changes
+}
+
+// sameValue returns whether two values are equal, including whether they exist at all.
+func sameValue(a interface{}, aExists bool, b interface{}, bExists bool) bool {
+	return aExists == bExists && reflect.DeepEqual(a, b)
+}
+
+// mappingValue returns the value of the key, and whether it exists.
+func mappingValue(mapping yaml.MapSlice, key interface{}) (interface{}, bool) {
+	for _, item := range mapping {
+		if item.Key == key {
+			return item.Value, true
+		}
+	}
+	return nil, false
+}
+
+// formatConfigValue returns the value in YAML flow style, on a single line.
+func formatConfigValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "(absent)"
+	case yaml.MapSlice:
+		items := []string{}
+		for _, item := range v {
+			items = append(items, fmt.Sprintf("%v: %s", item.Key, formatConfigValue(item.Value)))
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	case []interface{}:
+		items := []string{}
+		for _, item := range v {
+			items = append(items, formatConfigValue(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case string:
+		quoted, err := yamlQuote(v)
+		if err != nil {
+			return fmt.Sprintf("%q", v)
+		}
+		return quoted
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,204 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package flamenco
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const mergeTestDefault = `mode: production
+listen: localhost:8083
+variables:
+  blender:
+    direction: oneway
+    values:
+    - platform: linux
+      value: /opt/blender/blender
+dynamic_pool_platforms:
+  azure:
+    location: westeurope
+    batch_account_name: baflamenco
+`
+
+func TestMergeManagerConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		newDefault string
+		live       string
+		merged     string
+		changes    []ConfigChange
+	}{
+		{
+			name:       "unchanged",
+			newDefault: mergeTestDefault,
+			live:       mergeTestDefault,
+			merged:     mergeTestDefault,
+			changes:    []ConfigChange{},
+		},
+		{
+			name:       "changed only in default",
+			newDefault: replaceLine(mergeTestDefault, "    location: westeurope", "    location: eastus2"),
+			live:       mergeTestDefault,
+			merged:     replaceLine(mergeTestDefault, "    location: westeurope", "    location: eastus2"),
+			changes: []ConfigChange{
+				{Path: "dynamic_pool_platforms.azure.location", Live: "westeurope", Merged: "eastus2", Default: "eastus2"},
+			},
+		},
+		{
+			name:       "changed only in live",
+			newDefault: mergeTestDefault,
+			live:       replaceLine(mergeTestDefault, "listen: localhost:8083", "listen: localhost:8080"),
+			merged:     replaceLine(mergeTestDefault, "listen: localhost:8083", "listen: localhost:8080"),
+			changes:    []ConfigChange{},
+		},
+		{
+			name:       "changed in both",
+			newDefault: replaceLine(mergeTestDefault, "listen: localhost:8083", "listen: localhost:8084"),
+			live:       replaceLine(mergeTestDefault, "listen: localhost:8083", "listen: localhost:8080"),
+			merged:     replaceLine(mergeTestDefault, "listen: localhost:8083", "listen: localhost:8080"),
+			changes: []ConfigChange{
+				{Path: "listen", Live: "localhost:8080", Merged: "localhost:8080", Default: "localhost:8084", Conflict: true},
+			},
+		},
+		{
+			name:       "changed in both to the same value",
+			newDefault: replaceLine(mergeTestDefault, "mode: production", "mode: develop"),
+			live:       replaceLine(mergeTestDefault, "mode: production", "mode: develop"),
+			merged:     replaceLine(mergeTestDefault, "mode: production", "mode: develop"),
+			changes:    []ConfigChange{},
+		},
+		{
+			name:       "key added to default",
+			newDefault: mergeTestDefault + "ssdp_discovery: true\n",
+			live:       mergeTestDefault,
+			merged:     mergeTestDefault + "ssdp_discovery: true\n",
+			changes: []ConfigChange{
+				{Path: "ssdp_discovery", Merged: true, Default: true},
+			},
+		},
+		{
+			name:       "key removed from default",
+			newDefault: replaceLine(mergeTestDefault, "mode: production", ""),
+			live:       mergeTestDefault,
+			merged:     replaceLine(mergeTestDefault, "mode: production", ""),
+			changes: []ConfigChange{
+				{Path: "mode", Live: "production"},
+			},
+		},
+		{
+			name:       "key removed from default and changed in live",
+			newDefault: replaceLine(mergeTestDefault, "mode: production", ""),
+			live:       replaceLine(mergeTestDefault, "mode: production", "mode: develop"),
+			merged:     replaceLine(mergeTestDefault, "mode: production", "mode: develop"),
+			changes: []ConfigChange{
+				{Path: "mode", Live: "develop", Merged: "develop", Conflict: true},
+			},
+		},
+		{
+			name:       "key added in live",
+			newDefault: mergeTestDefault,
+			live:       mergeTestDefault + "ssdp_discovery: false\n",
+			merged:     mergeTestDefault + "ssdp_discovery: false\n",
+			changes:    []ConfigChange{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged, changes, err := MergeManagerConfig([]byte(mergeTestDefault), []byte(test.newDefault), []byte(test.live))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(merged) != test.merged {
+				t.Errorf("merged config differs, got:\n%s\nexpected:\n%s", merged, test.merged)
+			}
+			if !reflect.DeepEqual(changes, test.changes) {
+				t.Errorf("changes differ, got %#v, expected %#v", changes, test.changes)
+			}
+		})
+	}
+}
+
+func TestMergeManagerConfigUnknownBase(t *testing.T) {
+	live := replaceLine(mergeTestDefault, "listen: localhost:8083", "listen: localhost:8080")
+	merged, changes, err := MergeManagerConfig(nil, []byte(mergeTestDefault), []byte(live))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(merged) != live {
+		t.Errorf("live config should be kept, got:\n%s", merged)
+	}
+	expected := []ConfigChange{
+		{Path: "listen", Live: "localhost:8080", Merged: "localhost:8080", Default: "localhost:8083", Conflict: true},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("changes differ, got %#v, expected %#v", changes, expected)
+	}
+}
+
+func TestMergeManagerConfigDropsComments(t *testing.T) {
+	live := "# Managed through the web setup.\n" + mergeTestDefault
+	merged, _, err := MergeManagerConfig([]byte(mergeTestDefault), []byte(mergeTestDefault), []byte(live))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(merged) != mergeTestDefault {
+		t.Errorf("expected the comment to be dropped, got:\n%s", merged)
+	}
+}
+
+// replaceLine replaces a complete line of the config; an empty replacement removes the line.
+func replaceLine(config, line, replacement string) string {
+	result := ""
+	for _, l := range strings.SplitAfter(config, "\n") {
+		switch {
+		case l != line+"\n":
+			result += l
+		case replacement != "":
+			result += replacement + "\n"
+		}
+	}
+	return result
+}
+
+func TestSetManagerConfigValues(t *testing.T) {
+	config := mergeTestDefault + "acme_domain_name: old.example.com\nworker_registration_secret: old\n"
+	updated, err := SetManagerConfigValues([]byte(config), map[string]string{
+		"acme_domain_name":                      "render.example.com",
+		"worker_registration_secret":            `it's a "secret" & \ | #1`,
+		"dynamic_pool_platforms.azure.location": "eastus2",
+		"variables.blender.location":            "should not be added",
+		"own_url":                               "https://render.example.com/",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := replaceLine(mergeTestDefault, "    location: westeurope", "    location: eastus2") +
+		"acme_domain_name: render.example.com\n" +
+		`worker_registration_secret: 'it''s a "secret" & \ | #1'` + "\n"
+	if string(updated) != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", updated, expected)
+	}
+}
@@ -29,9 +29,26 @@ const (
 	AdminUsername = "flamencoadmin"
 
 	// When changing this, be sure to also change the installation script.
-	// See flamenco-manager-setup-vm.sh.
+	// See flamenco-manager-setup-vm.sh and flamenco-manager-provision.sh.
 	UnixGroupName = "flamenco"
 
 	// The VM installation script; it is named locally the same as remotely.
 	InstallScriptName = "flamenco-manager-setup-vm.sh"
+	// Output of the installation script when run via SSH, in the admin's home directory.
+	// Without SSH, it ends up in ProvisionLogFile.
+	InstallLogFile = "flamenco-manager-setup.log"
+	// Versions of the components to install, and the functions to install them.
+	// They are used by the installation script as well as by the upgrade script.
+	ComponentsFileName     = "flamenco-components.sh"
+	ComponentFunctionsName = "flamenco-components-functions.sh"
+	UpgradeScriptName      = "flamenco-manager-upgrade.sh"
+
+	// The rendered default Manager configuration. It is only installed when the VM doesn't have a
+	// flamenco-manager.yaml yet; otherwise changes to it are merged, see MergeManagerConfig().
+	ManagerDefaultConfigName = "default-flamenco-manager.yaml"
+
+	// The component cache is uploaded to this directory of this share.
+	// See flamenco-components.sh and flamenco-manager-setup-vm.sh.
+	ComponentCacheShare    = "flamenco-resources"
+	ComponentCacheShareDir = "components"
 )
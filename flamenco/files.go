@@ -0,0 +1,126 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Directories of the static and templated files, in the embedded files as well as on disk.
+const (
+	StaticDir    = "files-static"
+	TemplatesDir = "files-templated"
+)
+
+// files contains the static and templated files; see UseFiles().
+// Until that is called, they are read from the current directory.
+var files fs.FS = os.DirFS(".")
+
+// UseFiles sets the source of the static and templated files. When overrideDir is not empty,
+// files in there take precedence over the built-in ones. It should have the same layout, so
+// for example contain files-templated/flamenco-manager.yaml.
+func UseFiles(builtin fs.FS, overrideDir string) {
+	if overrideDir == "" {
+		files = builtin
+		return
+	}
+
+	logger := logrus.WithField("templatesDir", overrideDir)
+	if stat, err := os.Stat(overrideDir); err != nil || !stat.IsDir() {
+		logger.WithError(err).Fatal("templates directory does not exist")
+	}
+	logger.Info("using files from templates directory over built-in ones")
+	files = layeredFS{os.DirFS(overrideDir), builtin}
+}
+
+// layeredFS opens files from the top layer if they exist there, and otherwise from the bottom one.
+type layeredFS struct {
+	top    fs.FS
+	bottom fs.FS
+}
+
+func (lfs layeredFS) Open(name string) (fs.File, error) {
+	file, err := lfs.top.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return lfs.bottom.Open(name)
+	}
+	if err == nil {
+		logrus.WithField("filename", name).Debug("using customised file")
+	}
+	return file, err
+}
+
+// StaticFile returns the contents of a file from files-static. Errors are fatal.
+func StaticFile(filename string) []byte {
+	filePath := path.Join(StaticDir, filename)
+	contents, err := fs.ReadFile(files, filePath)
+	if err != nil {
+		logrus.WithField("filename", filePath).WithError(err).Fatal("unable to read file")
+	}
+	return contents
+}
+
+// ExportFiles writes the built-in static and templated files to the target directory, so that they can
+// be customised and used via UseFiles(). Existing files are only overwritten when 'overwrite' is true.
+func ExportFiles(builtin fs.FS, targetDir string, overwrite bool) {
+	for _, dir := range []string{StaticDir, TemplatesDir} {
+		err := fs.WalkDir(builtin, dir, func(name string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			target := filepath.Join(targetDir, filepath.FromSlash(name))
+			logger := logrus.WithField("filename", target)
+
+			if entry.IsDir() {
+				return os.MkdirAll(target, 0755)
+			}
+			if _, err := os.Stat(target); err == nil && !overwrite {
+				logger.Warning("file exists, not overwriting")
+				return nil
+			}
+
+			contents, err := fs.ReadFile(builtin, name)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(target, contents, 0644); err != nil {
+				return err
+			}
+			logger.Info("exported file")
+			return nil
+		})
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				logrus.ErrorKey: err,
+				"targetDir":     targetDir,
+			}).Fatal("unable to export files")
+		}
+	}
+}
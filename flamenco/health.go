@@ -0,0 +1,116 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ManagerServices are the systemd units that have to be running on the Manager VM.
+// Their names are also accepted by the 'logs' command.
+var ManagerServices = []string{"flamenco-manager", "mongod"}
+
+// A service that was restarted automatically this often since the VM booted is considered to be crash-looping.
+const crashLoopRestarts = 3
+
+// ServiceStatus is the state of a systemd unit, as reported by 'systemctl show'.
+type ServiceStatus struct {
+	Unit        string
+	LoadState   string
+	ActiveState string
+	SubState    string
+	Restarts    int
+}
+
+// ServiceStatusCommand returns the shell command that reports the state of the units.
+// Its output can be parsed with ParseServiceStatus().
+func ServiceStatusCommand(units []string) string {
+	return "systemctl show --property=Id,LoadState,ActiveState,SubState,NRestarts " + strings.Join(units, " ")
+}
+
+// ParseServiceStatus parses the output of ServiceStatusCommand(), in the order of the units.
+// systemctl separates the units with a blank line, and prints the properties in its own order.
+func ParseServiceStatus(output string) []ServiceStatus {
+	statuses := []ServiceStatus{}
+	current := ServiceStatus{}
+	finishUnit := func() {
+		// Records without an Id, like run-command headers, don't describe a unit.
+		if current.Unit != "" {
+			statuses = append(statuses, current)
+		}
+		current = ServiceStatus{}
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			finishUnit()
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := parts[0], parts[1]
+		switch key {
+		case "Id":
+			current.Unit = strings.TrimSuffix(value, ".service")
+		case "LoadState":
+			current.LoadState = value
+		case "ActiveState":
+			current.ActiveState = value
+		case "SubState":
+			current.SubState = value
+		case "NRestarts":
+			current.Restarts, _ = strconv.Atoi(value)
+		}
+	}
+	finishUnit()
+	return statuses
+}
+
+// Healthy returns true when the service is running and not crash-looping.
+func (s ServiceStatus) Healthy() bool {
+	return s.ActiveState == "active" && s.SubState == "running" && s.Restarts < crashLoopRestarts
+}
+
+// String describes the state of the service, like "active (running), restarted 2 times".
+func (s ServiceStatus) String() string {
+	if s.LoadState == "not-found" {
+		return "not installed"
+	}
+	description := fmt.Sprintf("%s (%s)", s.ActiveState, s.SubState)
+	switch {
+	case s.Restarts >= crashLoopRestarts:
+		description += fmt.Sprintf(", crash-looping: restarted %d times", s.Restarts)
+	case s.Restarts == 1:
+		description += ", restarted once"
+	case s.Restarts > 1:
+		description += fmt.Sprintf(", restarted %d times", s.Restarts)
+	}
+	return description
+}
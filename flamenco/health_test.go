@@ -0,0 +1,83 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+package flamenco
+
+import (
+	"reflect"
+	"testing"
+)
+
+// systemctlShowOutput is real output of ServiceStatusCommand() for three units, one of which is not
+// installed. systemctl prints the properties of the Service interface, like NRestarts, before those
+// of the Unit interface.
+const systemctlShowOutput = `NRestarts=4
+Id=flamenco-manager.service
+LoadState=loaded
+ActiveState=activating
+SubState=auto-restart
+
+NRestarts=0
+Id=mongod.service
+LoadState=loaded
+ActiveState=active
+SubState=running
+
+NRestarts=0
+Id=flamenco-worker.service
+LoadState=not-found
+ActiveState=inactive
+SubState=dead
+`
+
+func TestParseServiceStatus(t *testing.T) {
+	expected := []ServiceStatus{
+		{Unit: "flamenco-manager", LoadState: "loaded", ActiveState: "activating", SubState: "auto-restart", Restarts: 4},
+		{Unit: "mongod", LoadState: "loaded", ActiveState: "active", SubState: "running", Restarts: 0},
+		{Unit: "flamenco-worker", LoadState: "not-found", ActiveState: "inactive", SubState: "dead", Restarts: 0},
+	}
+	statuses := ParseServiceStatus(systemctlShowOutput)
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("got %#v, expected %#v", statuses, expected)
+	}
+
+	if statuses[0].Healthy() {
+		t.Error("crash-looping flamenco-manager should not be healthy")
+	}
+	if !statuses[1].Healthy() {
+		t.Error("running mongod should be healthy")
+	}
+	if description := statuses[2].String(); description != "not installed" {
+		t.Errorf("unexpected description of missing unit: %q", description)
+	}
+}
+
+func TestParseServiceStatusRunCommandOutput(t *testing.T) {
+	// The run-command API trims the output, and may have a header before it.
+	output := "[stdout]\n\n" + systemctlShowOutput[:len(systemctlShowOutput)-1]
+	statuses := ParseServiceStatus(output)
+	if len(statuses) != 3 {
+		t.Fatalf("expected 3 units, got %#v", statuses)
+	}
+	if statuses[2].Unit != "flamenco-worker" || statuses[2].SubState != "dead" {
+		t.Errorf("last unit parsed incorrectly: %#v", statuses[2])
+	}
+}
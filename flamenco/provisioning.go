@@ -0,0 +1,230 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/Azure/flamenco-manager-azure/azauth"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/flamenco-manager-azure/aznetwork"
+	"github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Locations on the VM used when provisioning without SSH; see flamenco-manager-provision.sh.
+const (
+	ProvisionDir        = "/var/lib/flamenco-provisioning"
+	ProvisionStatusFile = ProvisionDir + "/status"
+	ProvisionLogFile    = ProvisionDir + "/provision.log"
+
+	provisionScriptName = "flamenco-manager-provision.sh"
+	provisionFilesDir   = ProvisionDir + "/files"
+	provisionScriptPath = ProvisionDir + "/provision.sh"
+	provisionUnitName   = "flamenco-provisioning"
+
+	// Azure refuses custom data larger than this, after base64-decoding.
+	maxCustomDataSize = 65535
+)
+
+// ProvisioningFile is a file that the install script expects next to it on the VM,
+// or that is put in place directly when it has a Path.
+type ProvisioningFile struct {
+	Name     string
+	Contents []byte
+
+	Path  string      // absolute path on the VM; when empty, the file is placed in the admin's home directory
+	Mode  os.FileMode // permissions; defaults to 0644
+	Owner string      // "user:group" owning the file at Path; defaults to root
+}
+
+// RemotePath returns where the file should be stored on the VM. Relative paths are relative to the
+// home directory of the admin user.
+func (pf ProvisioningFile) RemotePath() string {
+	if pf.Path != "" {
+		return pf.Path
+	}
+	return pf.Name
+}
+
+// FileMode returns the permissions of the file on the VM.
+func (pf ProvisioningFile) FileMode() os.FileMode {
+	if pf.Mode == 0 {
+		return 0644
+	}
+	return pf.Mode
+}
+
+// FileOwner returns the owner of the file on the VM, or an empty string for files in the admin's home directory.
+func (pf ProvisioningFile) FileOwner() string {
+	if pf.Path == "" {
+		return ""
+	}
+	if pf.Owner == "" {
+		return "root:root"
+	}
+	return pf.Owner
+}
+
+// ProvisioningFiles collects the files needed to install Flamenco Manager.
+// The install script itself is the last one.
+func ProvisioningFiles(config azconfig.AZConfig, netStack aznetwork.NetworkStack, fstab string) []ProvisioningFile {
+	tmpl := NewTemplateContext(config, netStack, fstab)
+	serviceFile := staticFile("flamenco-manager.service")
+	serviceFile.Path = "/etc/systemd/system/flamenco-manager.service"
+	credentials := localFile(azauth.CredentialsFile)
+	credentials.Mode = 0600
+
+	return []ProvisioningFile{
+		{Name: "fstab-smb", Contents: []byte(fstab)},
+		serviceFile,
+		{Name: ManagerDefaultConfigName, Contents: tmpl.RenderTemplate("flamenco-manager.yaml")},
+		{Name: "flamenco-worker.cfg", Contents: tmpl.RenderTemplate("flamenco-worker.cfg")},
+		{Name: "flamenco-worker-startup.sh", Contents: tmpl.RenderTemplate("flamenco-worker-startup.sh")},
+		{Name: ComponentsFileName, Contents: tmpl.RenderTemplate(ComponentsFileName)},
+		staticFile(ComponentFunctionsName),
+		credentials,
+		staticFile(InstallScriptName),
+	}
+}
+
+func staticFile(filename string) ProvisioningFile {
+	return ProvisioningFile{Name: filename, Contents: StaticFile(filename)}
+}
+
+func localFile(filename string) ProvisioningFile {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		logrus.WithField("filename", filename).WithError(err).Fatal("unable to read file")
+	}
+	return ProvisioningFile{Name: path.Base(filename), Contents: contents}
+}
+
+type cloudConfig struct {
+	WriteFiles []cloudConfigFile `yaml:"write_files"`
+	RunCmd     [][]string        `yaml:"runcmd"`
+}
+
+type cloudConfigFile struct {
+	Path        string `yaml:"path"`
+	Encoding    string `yaml:"encoding"`
+	Content     string `yaml:"content"`
+	Permissions string `yaml:"permissions"`
+	Owner       string `yaml:"owner,omitempty"`
+}
+
+// CloudInitCustomData returns the base64-encoded custom data for a new VM.
+// It is a gzipped cloud-config document that writes the files and runs the provisioning script.
+func CloudInitCustomData(files []ProvisioningFile) string {
+	provisionScript := staticFile(provisionScriptName)
+	doc := cloudConfig{
+		WriteFiles: []cloudConfigFile{{
+			Path:        provisionScriptPath,
+			Encoding:    "b64",
+			Content:     base64.StdEncoding.EncodeToString(provisionScript.Contents),
+			Permissions: "0700",
+		}},
+		RunCmd: [][]string{{"bash", provisionScriptPath, AdminUsername}},
+	}
+	for _, file := range files {
+		doc.WriteFiles = append(doc.WriteFiles, cloudConfigFile{
+			Path:        provisionPath(file),
+			Encoding:    "b64",
+			Content:     base64.StdEncoding.EncodeToString(file.Contents),
+			Permissions: fmt.Sprintf("%04o", file.FileMode()),
+			Owner:       file.FileOwner(),
+		})
+	}
+
+	docYAML, err := yaml.Marshal(doc)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to construct cloud-init document")
+	}
+
+	compressed := bytes.Buffer{}
+	gzipper := gzip.NewWriter(&compressed)
+	gzipper.Write([]byte("#cloud-config\n"))
+	gzipper.Write(docYAML)
+	if err := gzipper.Close(); err != nil {
+		logrus.WithError(err).Fatal("unable to compress cloud-init document")
+	}
+
+	logger := logrus.WithFields(logrus.Fields{
+		"size":    compressed.Len(),
+		"maxSize": maxCustomDataSize,
+	})
+	if compressed.Len() > maxCustomDataSize {
+		logger.Fatal("cloud-init document is too large for VM custom data")
+	}
+	logger.Debug("constructed cloud-init document")
+	return base64.StdEncoding.EncodeToString(compressed.Bytes())
+}
+
+// provisionPath returns where the file is written when provisioning without SSH. Files for the
+// admin's home directory are put there by flamenco-manager-provision.sh, keeping their permissions.
+func provisionPath(file ProvisioningFile) string {
+	if file.Path != "" {
+		return file.Path
+	}
+	return path.Join(provisionFilesDir, file.Name)
+}
+
+// ProvisioningScript returns a shell script that does on an existing VM what the cloud-init document
+// does on a new one. It starts the provisioning in the background, so that it can be sent via the
+// Azure run-command API without running into its time limit.
+func ProvisioningScript(files []ProvisioningFile) []string {
+	script := []string{
+		"#!/bin/bash",
+		"set -e",
+		fmt.Sprintf("rm -rf %s %s", provisionFilesDir, ProvisionStatusFile),
+		fmt.Sprintf("mkdir -p %s", provisionFilesDir),
+	}
+	writeFile := func(filepath string, contents []byte, mode os.FileMode, owner string) {
+		script = append(script,
+			fmt.Sprintf("base64 -d > %s <<'EOF'", filepath),
+			base64.StdEncoding.EncodeToString(contents),
+			"EOF",
+			fmt.Sprintf("chmod %04o %s", mode, filepath),
+		)
+		if owner != "" {
+			script = append(script, fmt.Sprintf("chown %s %s", owner, filepath))
+		}
+	}
+
+	writeFile(provisionScriptPath, staticFile(provisionScriptName).Contents, 0700, "")
+	for _, file := range files {
+		writeFile(provisionPath(file), file.Contents, file.FileMode(), file.FileOwner())
+	}
+
+	script = append(script,
+		fmt.Sprintf("systemctl reset-failed %s 2>/dev/null || true", provisionUnitName),
+		fmt.Sprintf("systemd-run --unit=%s bash %s %s", provisionUnitName, provisionScriptPath, AdminUsername),
+	)
+	return script
+}
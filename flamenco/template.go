@@ -24,11 +24,13 @@ package flamenco
 
 import (
 	"bytes"
+	"fmt"
 	"path"
 	"strings"
 	"text/template"
 
 	"github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
 	"github.com/Azure/flamenco-manager-azure/azconfig"
 	"github.com/Azure/flamenco-manager-azure/aznetwork"
 )
@@ -44,6 +46,10 @@ type TemplateContext struct {
 
 	AzureLocation    string
 	BatchAccountName string
+
+	Components []azconfig.Component
+	// Path of the component cache on the VM, or empty when components are downloaded by the VM.
+	ComponentCache string
 }
 
 // NewTemplateContext constructs a new context for rendering templated config files.
@@ -54,31 +60,124 @@ func NewTemplateContext(
 ) TemplateContext {
 	ctx := TemplateContext{
 		Name:                     strings.Title(config.VMName),
-		AcmeDomainName:           netStack.FQDN(),
+		AcmeDomainName:           config.ManagerFQDN(netStack.FQDN()),
 		PrivateIP:                netStack.PrivateIP,
 		WorkerRegistrationSecret: config.WorkerRegistrationSecret,
 		FSTabForStorage:          fstab,
 		UnixGroupName:            UnixGroupName,
 		AzureLocation:            config.Location,
 		BatchAccountName:         config.BatchAccountName,
+		Components:               config.Components(),
 	}
+	ctx.ComponentCache = componentCachePath(config)
 	return ctx
 }
 
-// RenderTemplate renders a templated config file.
+// templateFuncs are available in the templates, to quote values for the file format they end up in.
+var templateFuncs = template.FuncMap{
+	"yaml":  yamlQuote,
+	"ini":   iniValue,
+	"shell": shellQuote,
+
+	"envName": envName,
+	"join":    strings.Join,
+}
+
+// RenderComponentsFile renders flamenco-components.sh, which only depends on the component config.
+func RenderComponentsFile(config azconfig.AZConfig) []byte {
+	tc := TemplateContext{
+		Components:     config.Components(),
+		ComponentCache: componentCachePath(config),
+	}
+	return tc.RenderTemplate(ComponentsFileName)
+}
+
+// componentCachePath returns the path of the component cache on the VM, if it is used.
+func componentCachePath(config azconfig.AZConfig) string {
+	if config.ComponentCacheDir() == "" {
+		return ""
+	}
+	return path.Join("/mnt", ComponentCacheShare, ComponentCacheShareDir)
+}
+
+// WorkerComponents returns the components installed on the 'flamenco-resources' share.
+func (tc *TemplateContext) WorkerComponents() []azconfig.Component {
+	components := []azconfig.Component{}
+	for _, component := range tc.Components {
+		if component.Name != azconfig.ComponentManager {
+			components = append(components, component)
+		}
+	}
+	return components
+}
+
+// Blenders returns the Blender versions for the workers, the default one first.
+func (tc *TemplateContext) Blenders() []azconfig.Component {
+	blenders := []azconfig.Component{}
+	for _, component := range tc.Components {
+		if component.Name == azconfig.ComponentBlender {
+			blenders = append(blenders, component)
+		}
+	}
+	return blenders
+}
+
+// RenderTemplate renders a templated config file, and validates the result.
 func (tc *TemplateContext) RenderTemplate(templateFile string) []byte {
 	logger := logrus.WithField("templateFile", templateFile)
-	templatePath := path.Join("files-templated", templateFile)
-	tmpl := template.Must(template.ParseFiles(templatePath))
+
+	rendered, err := tc.renderTemplate(templateFile)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to render template")
+	}
+	if err := tc.validateRendered(templateFile, rendered); err != nil {
+		logger.WithError(err).Fatal("rendered template is invalid")
+	}
+
+	return rendered
+}
+
+func (tc *TemplateContext) renderTemplate(templateFile string) ([]byte, error) {
+	templatePath := path.Join(TemplatesDir, templateFile)
+	tmpl, err := template.New(templateFile).Funcs(templateFuncs).ParseFS(files, templatePath)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", templatePath, err)
+	}
 
 	buf := bytes.NewBuffer([]byte{})
-	err := tmpl.Execute(buf, tc)
+	if err := tmpl.Execute(buf, tc); err != nil {
+		return nil, fmt.Errorf("executing %s: %w", templatePath, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// yamlQuote returns the value as a YAML scalar that parses back to the same string.
+func yamlQuote(value string) (string, error) {
+	quoted, err := yaml.Marshal(value)
 	if err != nil {
-		logger.WithFields(logrus.Fields{
-			"templatePath":  templatePath,
-			logrus.ErrorKey: err,
-		}).Fatal("unable to render template")
+		return "", err
+	}
+	return strings.TrimSuffix(string(quoted), "\n"), nil
+}
+
+// iniValue returns the value for use in the Worker's INI file. Python's configparser
+// has no quoting, so only percent signs (used for interpolation) can be escaped.
+func iniValue(value string) (string, error) {
+	if strings.ContainsAny(value, "\r\n") {
+		return "", fmt.Errorf("value %q cannot be stored in an INI file, as it contains a newline", value)
 	}
+	if value != strings.TrimSpace(value) {
+		return "", fmt.Errorf("value %q cannot be stored in an INI file, as it has leading or trailing whitespace", value)
+	}
+	return strings.Replace(value, "%", "%%", -1), nil
+}
+
+// shellQuote returns the value in single quotes, for use in Bash scripts.
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'"'"'`, -1) + "'"
+}
 
-	return buf.Bytes()
+// envName returns a name usable as shell variable, like "FLAMENCO_MANAGER" for "flamenco-manager".
+func envName(name string) string {
+	return strings.ToUpper(strings.Replace(name, "-", "_", -1))
 }
@@ -0,0 +1,175 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// templateSamples are rendered with every template, and compared to testdata/{sample}/{template}.
+var templateSamples = map[string]TemplateContext{
+	"default": {
+		Name:                     "Flamenco-Manager",
+		AcmeDomainName:           "flamenco-manager.westeurope.cloudapp.azure.com",
+		PrivateIP:                "10.0.0.4",
+		WorkerRegistrationSecret: "Ls5p/8X2+bQ9yWc3kT7hZf==",
+		FSTabForStorage: "//saflamenco.file.core.windows.net/flamenco-input /mnt/flamenco-input cifs " +
+			"vers=3.0,username=saflamenco,password=afdliGF3ADdsf4f98fvklcvh1/4+1f93FBA==,dir_mode=0777 0 0\n",
+		UnixGroupName:    "flamenco",
+		AzureLocation:    "westeurope",
+		BatchAccountName: "baflamenco",
+		Components:       testComponents(azconfig.AZConfig{}),
+	},
+	"special-characters": {
+		Name:                     "Render: Farm #1",
+		AcmeDomainName:           "render.example.com",
+		PrivateIP:                "10.1.2.3",
+		WorkerRegistrationSecret: `it's a "secret": 100% #1 {yes}`,
+		FSTabForStorage: "//sa.file.core.windows.net/flamenco-output /mnt/flamenco-output cifs " +
+			"username=sa,password=$HOME`id` 0 0\n",
+		UnixGroupName:    "render farm",
+		AzureLocation:    "eastus2",
+		BatchAccountName: "0123",
+		Components: testComponents(azconfig.AZConfig{
+			ComponentVersions: &azconfig.AZComponentsConfig{
+				Blender: &azconfig.AZComponentConfig{
+					Version: "2.93.18",
+					URL:     "https://mirror.example.com/blender's/blender-{version}-linux-x64.tar.xz?token=a&b=c",
+					SHA256:  "0123456789ABCDEF0123456789abcdef0123456789abcdef0123456789abcdef",
+				},
+				ExtraBlenders: []azconfig.AZComponentConfig{
+					{Version: "3.6.5", SHA256: "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"},
+					{Version: "4.1.1", Variable: "blender_latest", SkipChecksum: true},
+				},
+			},
+		}),
+		ComponentCache: "/mnt/flamenco-resources/components",
+	},
+}
+
+// testComponents resolves the components of the config, pinning made-up checksums for the
+// components it doesn't configure, so that the golden files do not depend on the real checksums.
+func testComponents(config azconfig.AZConfig) []azconfig.Component {
+	versions := azconfig.AZComponentsConfig{}
+	if config.ComponentVersions != nil {
+		versions = *config.ComponentVersions
+	}
+	for name, component := range map[string]**azconfig.AZComponentConfig{
+		azconfig.ComponentManager:        &versions.Manager,
+		azconfig.ComponentWorker:         &versions.Worker,
+		azconfig.ComponentPreemptMonitor: &versions.PreemptMonitor,
+		azconfig.ComponentBlender:        &versions.Blender,
+		azconfig.ComponentFFmpeg:         &versions.FFmpeg,
+	} {
+		if *component == nil {
+			*component = &azconfig.AZComponentConfig{SHA256: fmt.Sprintf("%x", sha256.Sum256([]byte(name)))}
+		}
+	}
+	config.ComponentVersions = &versions
+	return config.Components()
+}
+
+var templateFiles = []string{
+	"flamenco-manager.yaml",
+	"flamenco-worker.cfg",
+	"flamenco-worker-startup.sh",
+	"flamenco-components.sh",
+}
+
+func TestRenderTemplateGolden(t *testing.T) {
+	UseFiles(os.DirFS(".."), "")
+
+	for sampleName, tc := range templateSamples {
+		for _, templateFile := range templateFiles {
+			t.Run(sampleName+"/"+templateFile, func(t *testing.T) {
+				rendered, err := tc.renderTemplate(templateFile)
+				if err != nil {
+					t.Fatalf("rendering: %v", err)
+				}
+				if err := tc.validateRendered(templateFile, rendered); err != nil {
+					t.Errorf("validating: %v", err)
+				}
+
+				goldenPath := filepath.Join("testdata", sampleName, templateFile)
+				if *updateGolden {
+					if err := os.MkdirAll(filepath.Dir(goldenPath), 0755); err != nil {
+						t.Fatal(err)
+					}
+					if err := ioutil.WriteFile(goldenPath, rendered, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				expect, err := ioutil.ReadFile(goldenPath)
+				if err != nil {
+					t.Fatalf("reading golden file (run 'go test ./flamenco -update' to create it): %v", err)
+				}
+				if string(rendered) != string(expect) {
+					t.Errorf("rendered %s differs from %s", templateFile, goldenPath)
+				}
+			})
+		}
+	}
+}
+
+func TestValidateRenderedRejectsBrokenFiles(t *testing.T) {
+	tc := templateSamples["default"]
+	broken := map[string]string{
+		"flamenco-manager.yaml":      "acme_domain_name: [unterminated\n",
+		"flamenco-worker.cfg":        "[flamenco-worker\nmanager_url = https://example.com/\n",
+		"flamenco-worker-startup.sh": "if true; then\n  echo missing fi\n",
+	}
+	for templateFile, contents := range broken {
+		if err := tc.validateRendered(templateFile, []byte(contents)); err == nil {
+			t.Errorf("%s: expected validation error", templateFile)
+		}
+	}
+
+	// Unquoted values are parsed, but no longer match the context.
+	tc = templateSamples["special-characters"]
+	unquoted := "acme_domain_name: render.example.com\nworker_registration_secret: " + tc.WorkerRegistrationSecret + "\n"
+	if err := tc.validateRendered("flamenco-manager.yaml", []byte(unquoted)); err == nil {
+		t.Error("expected unquoted YAML secret to be rejected")
+	}
+}
+
+func TestINIValueRejectsNewlines(t *testing.T) {
+	if _, err := iniValue("two\nlines"); err == nil {
+		t.Error("expected error for value with newline")
+	}
+	quoted, err := iniValue("100%")
+	if err != nil || !strings.HasSuffix(quoted, "%%") {
+		t.Errorf("expected escaped percent sign, got %q, %v", quoted, err)
+	}
+}
@@ -0,0 +1,44 @@
+# Components installed by flamenco-manager-setup-vm.sh, from the 'components' section of the
+# configuration. A checksum of 'skip' means verification was disabled with skipChecksum.
+
+FLAMENCO_MANAGER_VERSION='2.7'
+FLAMENCO_MANAGER_URL='https://www.flamenco.io/download/flamenco-manager-2.7-linux.tar.gz'
+FLAMENCO_MANAGER_FILE='flamenco-manager-2.7-linux.tar.gz'
+FLAMENCO_MANAGER_SHA256='54864b3959f4ee7699475ba61ae585e051a26f6af942f8515dbde9db9a816885'
+FLAMENCO_MANAGER_DIR='flamenco-manager-2.7'
+FLAMENCO_MANAGER_LINKS='flamenco-manager'
+
+FLAMENCO_WORKER_VERSION='2.5'
+FLAMENCO_WORKER_URL='https://www.flamenco.io/download/flamenco-worker-2.5-linux.tar.gz'
+FLAMENCO_WORKER_FILE='flamenco-worker-2.5-linux.tar.gz'
+FLAMENCO_WORKER_SHA256='a580ec68c6f96fe0d81cfc769fb9d1f5e1ad38b2080ed70d853f33ed483404da'
+FLAMENCO_WORKER_DIR='flamenco-worker-2.5'
+FLAMENCO_WORKER_LINKS='flamenco-worker'
+
+AZURE_PREEMPT_MONITOR_VERSION='1.1'
+AZURE_PREEMPT_MONITOR_URL='https://flamenco.io/download/azure-preempt-monitor/azure-preempt-monitor-v1.1-linux.tar.gz'
+AZURE_PREEMPT_MONITOR_FILE='azure-preempt-monitor-v1.1-linux.tar.gz'
+AZURE_PREEMPT_MONITOR_SHA256='2c3fe96dd9e35dcbdb5d26378ab1a61ae95db21f81352810a9f9acdea2e6e820'
+AZURE_PREEMPT_MONITOR_DIR='azure-preempt-monitor-1.1'
+AZURE_PREEMPT_MONITOR_LINKS='azure-preempt-monitor'
+
+BLENDER_VERSION='2.83.20'
+BLENDER_URL='https://download.blender.org/release/Blender2.83/blender-2.83.20-linux-x64.tar.xz'
+BLENDER_FILE='blender-2.83.20-linux-x64.tar.xz'
+BLENDER_SHA256='5a80e4ba8e6d04259aafa4166f6bc6b1875ffd8396a632997a03e6dabfae12ad'
+BLENDER_DIR='blender-2.83.20'
+BLENDER_LINKS='blender blender_283'
+
+FFMPEG_VERSION='4.2.1'
+FFMPEG_URL='https://johnvansickle.com/ffmpeg/old-releases/ffmpeg-4.2.1-amd64-static.tar.xz'
+FFMPEG_FILE='ffmpeg-4.2.1-amd64-static.tar.xz'
+FFMPEG_SHA256='6862fa01d6f0bc4c9601c1a0a9d170cb49cf255b25bfc66a02f958fa47be43a2'
+FFMPEG_DIR='ffmpeg-4.2.1'
+FFMPEG_LINKS='ffmpeg'
+
+# Directory with the archives, uploaded from the local component cache. When empty, the archives
+# are downloaded from their URLs.
+COMPONENT_CACHE=''
+
+# Components on the 'flamenco-resources' share, in installation order.
+WORKER_COMPONENTS='FLAMENCO_WORKER AZURE_PREEMPT_MONITOR BLENDER FFMPEG'
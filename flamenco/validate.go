@@ -0,0 +1,147 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// validateRendered checks that a rendered template can be parsed, and that the values
+// from the context survived quoting. Files of unknown type are not checked.
+func (tc *TemplateContext) validateRendered(templateFile string, rendered []byte) error {
+	switch {
+	case strings.HasSuffix(templateFile, ".yaml"):
+		return tc.validateManagerConfig(rendered)
+	case strings.HasSuffix(templateFile, ".cfg"):
+		return tc.validateWorkerConfig(rendered)
+	case strings.HasSuffix(templateFile, ".sh"):
+		return validateShellScript(rendered)
+	}
+	return nil
+}
+
+func (tc *TemplateContext) validateManagerConfig(rendered []byte) error {
+	var parsed struct {
+		AcmeDomainName           string `yaml:"acme_domain_name"`
+		WorkerRegistrationSecret string `yaml:"worker_registration_secret"`
+	}
+	if err := yaml.Unmarshal(rendered, &parsed); err != nil {
+		return fmt.Errorf("parsing YAML: %w", err)
+	}
+
+	if parsed.AcmeDomainName != tc.AcmeDomainName {
+		return fmt.Errorf("acme_domain_name is %q, expected %q", parsed.AcmeDomainName, tc.AcmeDomainName)
+	}
+	if parsed.WorkerRegistrationSecret != tc.WorkerRegistrationSecret {
+		return fmt.Errorf("worker_registration_secret does not match the configured secret")
+	}
+	return nil
+}
+
+func (tc *TemplateContext) validateWorkerConfig(rendered []byte) error {
+	sections, err := parseINI(rendered)
+	if err != nil {
+		return fmt.Errorf("parsing INI: %w", err)
+	}
+
+	worker, ok := sections["flamenco-worker"]
+	if !ok {
+		return fmt.Errorf("section [flamenco-worker] is missing")
+	}
+	expectURL := "https://" + tc.AcmeDomainName + "/"
+	if worker["manager_url"] != expectURL {
+		return fmt.Errorf("manager_url is %q, expected %q", worker["manager_url"], expectURL)
+	}
+	secret := strings.Replace(worker["worker_registration_secret"], "%%", "%", -1)
+	if secret != tc.WorkerRegistrationSecret {
+		return fmt.Errorf("worker_registration_secret does not match the configured secret")
+	}
+	return nil
+}
+
+// parseINI parses the INI dialect of Python's configparser, as far as the Worker config uses it.
+// Keys are lower-cased; continuation lines and interpolation are not supported.
+func parseINI(contents []byte) (map[string]map[string]string, error) {
+	sections := map[string]map[string]string{}
+	var section map[string]string
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "", line[0] == '#', line[0] == ';':
+			continue
+		case line[0] == '[':
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated section header %q", lineNum, line)
+			}
+			name := line[1 : len(line)-1]
+			if _, seen := sections[name]; seen {
+				return nil, fmt.Errorf("line %d: duplicate section [%s]", lineNum, name)
+			}
+			section = map[string]string{}
+			sections[name] = section
+			continue
+		}
+
+		if section == nil {
+			return nil, fmt.Errorf("line %d: key outside of a section", lineNum)
+		}
+		sep := strings.IndexAny(line, "=:")
+		if sep < 1 {
+			return nil, fmt.Errorf("line %d: expected 'key = value', got %q", lineNum, line)
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:sep]))
+		if _, seen := section[key]; seen {
+			return nil, fmt.Errorf("line %d: duplicate key %q", lineNum, key)
+		}
+		section[key] = strings.TrimSpace(line[sep+1:])
+	}
+	return sections, scanner.Err()
+}
+
+// validateShellScript runs 'bash -n' on the script, which only parses it.
+// When Bash is not available, the check is skipped.
+func validateShellScript(rendered []byte) error {
+	bashPath, err := exec.LookPath("bash")
+	if err != nil {
+		logrus.Warning("bash not found, unable to check the syntax of shell scripts")
+		return nil
+	}
+
+	cmd := exec.Command(bashPath, "-n")
+	cmd.Stdin = bytes.NewReader(rendered)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("bash syntax check failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
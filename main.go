@@ -23,6 +23,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
@@ -35,6 +36,8 @@ import (
 	"github.com/Azure/flamenco-manager-azure/azauth"
 	"github.com/Azure/flamenco-manager-azure/azbatch"
 	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/flamenco-manager-azure/azdns"
+	"github.com/Azure/flamenco-manager-azure/aznetwork"
 	"github.com/Azure/flamenco-manager-azure/azresource"
 	"github.com/Azure/flamenco-manager-azure/azssh"
 	"github.com/Azure/flamenco-manager-azure/azstorage"
@@ -52,9 +55,10 @@ var applicationVersion = "1.0"
 // Components that make up the application
 
 var cliArgs struct {
-	version bool
-	quiet   bool
-	debug   bool
+	version    bool
+	quiet      bool
+	debug      bool
+	configFile string
 
 	subscriptionID string
 	location       string
@@ -62,12 +66,16 @@ var cliArgs struct {
 	storageAccount string
 	batchAccount   string
 	vmName         string
+	provisioning   string
+	templatesDir   string
+	skipVerify     bool
 }
 
 func parseCliArgs() {
 	flag.BoolVar(&cliArgs.version, "version", false, "Shows the application version, then exits.")
 	flag.BoolVar(&cliArgs.quiet, "quiet", false, "Disable info-level logging (so warning/error only).")
 	flag.BoolVar(&cliArgs.debug, "debug", false, "Enable debug-level logging.")
+	flag.StringVar(&cliArgs.configFile, "config", azconfig.DefaultFilename, "Configuration file of the deployment.")
 
 	flag.StringVar(&cliArgs.subscriptionID, "subscription", "", "Subscription ID. If not given, it will be prompted for.")
 	flag.StringVar(&cliArgs.location, "location", "", "Physical location of the Azure machines. If not given, it will be prompted for.")
@@ -75,6 +83,30 @@ func parseCliArgs() {
 	flag.StringVar(&cliArgs.storageAccount, "sa", "", "Name of the storage account. If not given, it will be prompted for.")
 	flag.StringVar(&cliArgs.batchAccount, "ba", "", "Name of the batch account. If not given, it will be prompted for.")
 	flag.StringVar(&cliArgs.vmName, "vm", "", "Name of the virtual machine to use. If not given, it will be prompted for.")
+	flag.StringVar(&cliArgs.provisioning, "provisioning", "", "How to install Flamenco Manager on the VM, \"ssh\" or \"cloud-init\". If not given, it is taken from the config file, defaulting to \"ssh\".")
+	flag.BoolVar(&cliArgs.skipVerify, "skip-verify", false, "Do not check that Flamenco Manager is up and serves a valid TLS certificate after deploying.")
+	flag.StringVar(&cliArgs.templatesDir, "templates-dir", "", "Directory with customised files, which take precedence over the built-in ones; see the 'export-templates' command.")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [options] [command]\n\n", os.Args[0])
+		fmt.Fprintln(out, "Commands:")
+		fmt.Fprintln(out, "  deploy                   Create or update the Flamenco infrastructure (default).")
+		fmt.Fprintln(out, "  vm start                 Start the Manager VM, then scale the worker pool back up.")
+		fmt.Fprintln(out, "  vm stop                  Scale the worker pool to zero, then deallocate the Manager VM.")
+		fmt.Fprintln(out, "  vm restart               Restart the Manager VM.")
+		fmt.Fprintln(out, "  vm resize [size]         Change the size of the Manager VM.")
+		fmt.Fprintln(out, "  backup                   Back up the Manager database and configuration.")
+		fmt.Fprintln(out, "  restore [archive]        Restore a backup onto the Manager VM (see -vm).")
+		fmt.Fprintln(out, "  clone -name NAME [...]   Create a copy of the deployment; see 'clone -h'.")
+		fmt.Fprintln(out, "  ssh [command]            Open a shell on the Manager VM, or run a command there.")
+		fmt.Fprintln(out, "  tunnel [ports]           Forward local ports to the Manager VM; see 'tunnel -h'.")
+		fmt.Fprintln(out, "  logs [sources]           Show the logs of the Manager VM; see 'logs -h'.")
+		fmt.Fprintln(out, "  upgrade [...]            Upgrade Flamenco Manager and Worker; see 'upgrade -h'.")
+		fmt.Fprintln(out, "  export-templates [dir]   Write the built-in templates and scripts to disk for customisation.")
+		fmt.Fprintln(out)
+		fmt.Fprintln(out, "Options:")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 }
 
@@ -104,6 +136,107 @@ func logStartup() {
 	}).Infof("Starting %s", applicationName)
 }
 
+// provisionViaSSH sets up the VM via an SSH connection.
+func provisionViaSSH(ctx context.Context, sshContext azssh.Context, publicIP string, files []flamenco.ProvisioningFile) {
+	ssh := azssh.Connect(ctx, sshContext, publicIP)
+	ssh.SetupUsers()
+	ssh.Close()
+
+	// Reconnect to ensure the admin user is part of the flamenco group.
+	ssh = azssh.Connect(ctx, sshContext, publicIP)
+	for _, file := range files {
+		ssh.Upload(file.Contents, file.RemotePath(), azssh.FileOptions{
+			Mode:  file.FileMode(),
+			Owner: file.FileOwner(),
+		})
+	}
+	ssh.RunInstallScript(ctx)
+	ssh.Close()
+}
+
+// managerConfigAccess reads and replaces flamenco-manager.yaml on the Manager VM.
+type managerConfigAccess struct {
+	fetch   func() (live, base []byte)
+	apply   func(merged, newDefault []byte)
+	setBase func(newDefault []byte)
+}
+
+// sshManagerConfigAccess accesses flamenco-manager.yaml via SSH.
+func sshManagerConfigAccess(ctx context.Context, ssh *azssh.Connection) managerConfigAccess {
+	return managerConfigAccess{
+		fetch:   ssh.ManagerConfig,
+		apply:   func(merged, newDefault []byte) { ssh.ApplyManagerConfig(ctx, merged, newDefault) },
+		setBase: ssh.SetManagerConfigBase,
+	}
+}
+
+// runCommandManagerConfigAccess accesses flamenco-manager.yaml via the Azure run-command API.
+func runCommandManagerConfigAccess(ctx context.Context, config azconfig.AZConfig, vmName string) managerConfigAccess {
+	return managerConfigAccess{
+		fetch: func() (live, base []byte) { return azvm.ManagerConfig(ctx, config, vmName) },
+		apply: func(merged, newDefault []byte) {
+			azvm.ApplyManagerConfig(ctx, config, vmName, merged, newDefault)
+		},
+		setBase: func(newDefault []byte) { azvm.SetManagerConfigBase(ctx, config, vmName, newDefault) },
+	}
+}
+
+// mergeManagerConfig merges changes of the default flamenco-manager.yaml into the one on the VM,
+// after showing them and asking for confirmation.
+func mergeManagerConfig(ctx context.Context, access managerConfigAccess, files []flamenco.ProvisioningFile) {
+	var newDefault []byte
+	for _, file := range files {
+		if file.Name == flamenco.ManagerDefaultConfigName {
+			newDefault = file.Contents
+		}
+	}
+
+	live, base := access.fetch()
+	if len(live) == 0 {
+		logrus.Warning("flamenco-manager.yaml not found on the VM, unable to merge changes of the default configuration")
+		return
+	}
+	if len(base) == 0 {
+		logrus.Info("unknown which default flamenco-manager.yaml is based on; differences with the new default are shown as conflicts")
+	}
+	merged, changes, err := flamenco.MergeManagerConfig(base, newDefault, live)
+	if err != nil {
+		logrus.WithError(err).Warning("unable to merge changes of the default configuration into flamenco-manager.yaml; leaving it alone")
+		return
+	}
+	if len(changes) == 0 {
+		if !bytes.Equal(base, newDefault) {
+			access.setBase(newDefault)
+		}
+		logrus.Debug("flamenco-manager.yaml is up to date with the default configuration")
+		return
+	}
+
+	numConflicts := 0
+	fmt.Println("The default Flamenco Manager configuration changed. Changes to flamenco-manager.yaml:")
+	for _, change := range changes {
+		fmt.Println("  " + change.String())
+		if change.Conflict {
+			numConflicts++
+		}
+	}
+	if numConflicts > 0 {
+		fmt.Println("Values marked with ! were changed on the Manager as well as in the default; they are kept.")
+	}
+
+	if numConflicts == len(changes) {
+		if textio.Confirm(ctx, "Keep the current values, and stop reporting these differences") {
+			access.setBase(newDefault)
+		}
+		return
+	}
+	if !textio.Confirm(ctx, "Apply these changes and restart Flamenco Manager") {
+		logrus.Info("flamenco-manager.yaml left unchanged; the changes are shown again on the next deployment")
+		return
+	}
+	access.apply(merged, newDefault)
+}
+
 func main() {
 	startupTime := time.Now()
 	parseCliArgs()
@@ -130,8 +263,74 @@ func main() {
 		}
 	}()
 
-	config := azconfig.Load()
-	sshContext := azssh.LoadSSHContext()
+	flamenco.UseFiles(builtinFiles, cliArgs.templatesDir)
+	if flag.Arg(0) == "export-templates" {
+		exportTemplatesCommand(flag.Args()[1:])
+		return
+	}
+
+	config := azconfig.Load(cliArgs.configFile)
+	azauth.ConfigureHTTP(config)
+	switch command := flag.Arg(0); command {
+	case "", "deploy":
+		deploy(ctx, config, startupTime, nil)
+	case "vm":
+		vmCommand(ctx, config, flag.Args()[1:])
+	case "backup":
+		backupCommand(ctx, config)
+	case "restore":
+		restoreCommand(ctx, config, flag.Args()[1:])
+	case "clone":
+		cloneCommand(ctx, config, startupTime, flag.Args()[1:])
+	case "ssh":
+		sshCommand(ctx, config, flag.Args()[1:])
+	case "tunnel":
+		tunnelCommand(ctx, config, flag.Args()[1:])
+	case "logs":
+		logsCommand(ctx, config, flag.Args()[1:])
+	case "upgrade":
+		upgradeCommand(ctx, config, flag.Args()[1:])
+	default:
+		logrus.WithField("command", command).Error("unknown command")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cancelCtx()
+}
+
+// exportTemplatesCommand handles 'export-templates [dir]'. It doesn't need a deployment.
+func exportTemplatesCommand(args []string) {
+	var exportArgs struct {
+		force bool
+	}
+	flags := flag.NewFlagSet("export-templates", flag.ExitOnError)
+	flags.BoolVar(&exportArgs.force, "force", false, "Overwrite files that already exist.")
+	flags.Parse(args)
+
+	targetDir := "."
+	if flags.NArg() > 0 {
+		targetDir = flags.Arg(0)
+	}
+	flamenco.ExportFiles(builtinFiles, targetDir, exportArgs.force)
+	logrus.WithField("templatesDir", targetDir).Info("customise the files, then use them with -templates-dir")
+}
+
+// deploy creates or updates the entire Flamenco infrastructure; this is the default command.
+// afterFileShares, if not nil, is called once the SMB shares exist, before anything is installed on the
+// Manager VM. Returns the config as it is after deployment.
+func deploy(ctx context.Context, config azconfig.AZConfig, startupTime time.Time, afterFileShares func(config azconfig.AZConfig)) azconfig.AZConfig {
+	if cliArgs.provisioning != "" {
+		config.Provisioning = cliArgs.provisioning
+		config.Save()
+	}
+	provisionViaCloudInit := config.ProvisioningMode() == azconfig.ProvisionCloudInit
+	// Also needed for cloud-init provisioning, as the VM is created with our public key.
+	azssh.EnsureKeyPair(ctx, &config)
+	var sshContext azssh.Context
+	if !provisionViaCloudInit {
+		sshContext = azssh.LoadSSHContext(ctx, config)
+	}
 
 	// Get the Azure credentials into the right file.
 	azauth.EnsureCredentialsFile(ctx)
@@ -163,18 +362,8 @@ func main() {
 	}
 
 	vmName, vmExists := azvm.ChooseVM(ctx, &config, cliArgs.vmName, config.DefaultName)
-	// Create or update Manager VM
-	vm, networkStack := azvm.EnsureVM(ctx, config, vmName, vmExists)
-	publicIP := *networkStack.PublicIP.IPAddress
-	logrus.WithFields(logrus.Fields{
-		"vmName":         *vm.Name,
-		"publicAddress":  publicIP,
-		"fqdn":           networkStack.FQDN(),
-		"privateAddress": networkStack.PrivateIP,
-		"vnet":           *networkStack.VNet.Name,
-	}).Info("found network info")
-	azvm.WaitForReady(ctx, config, vmName)
 
+	// Storage and Batch come before the VM, as cloud-init provisioning needs the fstab at VM creation.
 	saName, createSA := azstorage.AskAccountName(ctx, config, cliArgs.storageAccount, config.DefaultName)
 	if createSA && !azstorage.CheckAvailability(ctx, config, saName) {
 		logrus.WithField("storageAccountName", saName).Fatal("storage account name is not available")
@@ -191,36 +380,102 @@ func main() {
 	azbatch.AskParametersAndSave(ctx, &config, config.DefaultName)
 
 	// Collect dynamically generated files (or bits of files).
+	defer azstorage.AllowOperatorAccess(ctx, config)()
 	fstab := azstorage.EnsureFileShares(ctx, config)
-	tmpl := flamenco.NewTemplateContext(config, networkStack, fstab)
-	flamanYAML := tmpl.RenderTemplate("flamenco-manager.yaml")
-	flaworkCfg := tmpl.RenderTemplate("flamenco-worker.cfg")
-	flaworkStart := tmpl.RenderTemplate("flamenco-worker-startup.sh")
+	if config.ComponentCacheDir() != "" {
+		// The VM installs the components from the resources share instead of downloading them.
+		archives := flamenco.FillComponentCache(ctx, config)
+		azstorage.UploadComponentCache(ctx, config, archives)
+	}
+	if afterFileShares != nil {
+		afterFileShares(config)
+	}
+	var customData azvm.CustomDataFunc
+	if provisionViaCloudInit {
+		customData = func(netStack aznetwork.NetworkStack) string {
+			return flamenco.CloudInitCustomData(flamenco.ProvisioningFiles(config, netStack, fstab))
+		}
+	}
 
-	// Set up the VM via an SSH connection
-	ssh := azssh.Connect(sshContext, publicIP)
-	ssh.SetupUsers()
-	ssh.Close()
+	// Create or update Manager VM
+	vm, networkStack := azvm.EnsureVM(ctx, config, vmName, vmExists, customData)
+	publicIP := *networkStack.PublicIP.IPAddress
+	logrus.WithFields(logrus.Fields{
+		"vmName":         *vm.Name,
+		"publicAddress":  publicIP,
+		"fqdn":           networkStack.FQDN(),
+		"privateAddress": networkStack.PrivateIP,
+		"vnet":           *networkStack.VNet.Name,
+	}).Info("found network info")
+	azdns.EnsureRecord(ctx, config, networkStack)
+	azvm.WaitForReady(ctx, config, vmName)
+	// The key pair or the team keys may have changed since the VM was created. On a new VM this
+	// moves the keys into the managed block, so that they can be revoked by a later deploy.
+	azvm.InstallAuthorizedKeys(ctx, config, vmName, azssh.AuthorizedKeys(config))
 
-	// Reconnect to ensure the admin user is part of the flamenco group.
-	ssh = azssh.Connect(sshContext, publicIP)
-	ssh.UploadAsFile([]byte(fstab), "fstab-smb")
-	ssh.UploadStaticFile("flamenco-manager.service")
-	ssh.UploadAsFile(flamanYAML, "default-flamenco-manager.yaml")
-	ssh.UploadAsFile(flaworkCfg, "flamenco-worker.cfg")
-	ssh.UploadAsFile(flaworkStart, "flamenco-worker-startup.sh")
-	ssh.UploadStaticFile(flamenco.InstallScriptName)
-	ssh.UploadLocalFile(azauth.CredentialsFile)
-	ssh.RunInstallScript()
-	ssh.Close()
+	storagePrivateIP := azstorage.RestrictNetworkAccess(ctx, config, networkStack)
+	files := flamenco.ProvisioningFiles(config, networkStack, fstab)
+
+	if provisionViaCloudInit {
+		// A new VM runs the provisioning from cloud-init; an existing one has to be told.
+		if vmExists {
+			azvm.StartProvisioning(ctx, config, vmName, flamenco.ProvisioningScript(files))
+		}
+		azvm.WaitForProvisioning(ctx, config, vmName)
+		if vmExists {
+			mergeManagerConfig(ctx, runCommandManagerConfigAccess(ctx, config, vmName), files)
+		}
+	} else {
+		// A new VM has new host keys, also when it re-uses the address of an earlier VM.
+		if !vmExists {
+			azssh.ForgetHost(config.KnownHostsPath(), publicIP)
+		}
+		pinHostKeys(ctx, config, vmName, networkStack)
+		provisionViaSSH(ctx, sshContext, publicIP, files)
+		if vmExists {
+			ssh := azssh.Connect(ctx, sshContext, publicIP)
+			mergeManagerConfig(ctx, sshManagerConfigAccess(ctx, &ssh), files)
+			ssh.Close()
+		}
+	}
 
 	azbatch.CreatePool(config, networkStack)
 
-	cancelCtx()
+	// Optionally give artists private access to the shares and the Manager.
+	aznetwork.EnsureVPNGateway(ctx, config, networkStack, vmName)
+	aznetwork.WriteVPNInstructions(config, aznetwork.VPNMountInfo{
+		ManagerFQDN:      config.ManagerFQDN(networkStack.FQDN()),
+		ManagerPrivateIP: networkStack.PrivateIP,
+		StorageAccount:   config.StorageAccountName,
+		StorageHost:      azstorage.Host(config),
+		StoragePrivateIP: storagePrivateIP,
+		Shares:           azstorage.ShareNames(),
+	})
+
+	verified := true
+	if !cliArgs.skipVerify {
+		serviceStatus := func(units []string) ([]flamenco.ServiceStatus, error) {
+			return azvm.ServiceStatus(ctx, config, vmName, units)
+		}
+		if !provisionViaCloudInit {
+			serviceStatus = func(units []string) ([]flamenco.ServiceStatus, error) {
+				ssh := azssh.Connect(ctx, sshContext, publicIP)
+				defer ssh.Close()
+				return ssh.ServiceStatus(units)
+			}
+		}
+		verified = verifyDeployment(ctx, config, networkStack, serviceStatus)
+	}
 
 	duration := time.Since(startupTime)
-	logrus.WithFields(logrus.Fields{
+	logger := logrus.WithFields(logrus.Fields{
 		"duration": duration,
-		"url":      fmt.Sprintf("https://%s/setup", networkStack.FQDN()),
-	}).Info("deployment complete")
+		"url":      fmt.Sprintf("https://%s/setup", config.ManagerFQDN(networkStack.FQDN())),
+	})
+	if verified {
+		logger.Info("deployment complete")
+	} else {
+		logger.Error("deployment complete, but Flamenco Manager is not working properly; see the report above")
+	}
+	return config
 }
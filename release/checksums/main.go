@@ -0,0 +1,117 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Command checksums downloads the archives of the default components and writes their SHA256
+// checksums to azconfig/checksums.go. Run it via 'make component-checksums' after changing
+// azconfig.DefaultComponents.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go/format"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	outputFile  = "azconfig/checksums.go"
+	licenseFile = "azconfig/azconfig.go"
+)
+
+func main() {
+	urls := []string{}
+	for _, component := range (azconfig.AZConfig{ComponentVersions: &azconfig.AZComponentsConfig{
+		Manager:        &azconfig.AZComponentConfig{SkipChecksum: true},
+		Worker:         &azconfig.AZComponentConfig{SkipChecksum: true},
+		PreemptMonitor: &azconfig.AZComponentConfig{SkipChecksum: true},
+		Blender:        &azconfig.AZComponentConfig{SkipChecksum: true},
+		FFmpeg:         &azconfig.AZComponentConfig{SkipChecksum: true},
+	}}).Components() {
+		urls = append(urls, component.URL)
+	}
+	sort.Strings(urls)
+
+	source := bytes.Buffer{}
+	source.WriteString(licenseHeader())
+	source.WriteString("\n// Code generated by 'make component-checksums'; DO NOT EDIT.\n\npackage azconfig\n\n")
+	source.WriteString("// DefaultChecksums are the SHA256 checksums of the archives of DefaultComponents, by download URL.\n")
+	source.WriteString("var DefaultChecksums = map[string]string{\n")
+	for _, url := range urls {
+		logger := logrus.WithField("url", url)
+		logger.Info("downloading")
+		checksum, err := downloadSHA256(url)
+		if err != nil {
+			logger.WithError(err).Fatal("unable to download component")
+		}
+		logger.WithField("sha256", checksum).Info("downloaded")
+		fmt.Fprintf(&source, "%q: %q,\n", url, checksum)
+	}
+	source.WriteString("}\n")
+
+	formatted, err := format.Source(source.Bytes())
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to format generated code")
+	}
+	if err := ioutil.WriteFile(outputFile, formatted, 0644); err != nil {
+		logrus.WithError(err).Fatal("unable to write checksums")
+	}
+	logrus.WithField("file", outputFile).Info("checksums written")
+}
+
+// licenseHeader returns the comment block at the top of the license file.
+func licenseHeader() string {
+	contents, err := ioutil.ReadFile(licenseFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to read license header")
+	}
+	end := strings.Index(string(contents), "*/")
+	if end < 0 {
+		logrus.WithField("file", licenseFile).Fatal("no license header found")
+	}
+	return string(contents[:end+2]) + "\n"
+}
+
+// downloadSHA256 downloads the URL and returns the SHA256 checksum of its contents.
+func downloadSHA256(url string) (string, error) {
+	response, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected HTTP status %s", response.Status)
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, response.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
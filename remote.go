@@ -0,0 +1,244 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/flamenco-manager-azure/azssh"
+	"github.com/Azure/flamenco-manager-azure/flamenco"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultTunnelPorts are forwarded by the 'tunnel' command when no ports are given:
+// the Flamenco Manager web interface (HTTP and HTTPS) and MongoDB.
+var defaultTunnelPorts = []string{"8080", "8443", "27017"}
+
+// sshCommand handles 'ssh [command...]': an interactive session on the Manager VM.
+func sshCommand(ctx context.Context, config azconfig.AZConfig, args []string) {
+	requireDeployment(ctx, config)
+
+	ssh, _ := connectToManager(ctx, config, managerVMName(config))
+	exitStatus := ssh.Interactive(strings.Join(args, " "))
+	ssh.Close()
+
+	if exitStatus != 0 {
+		os.Exit(exitStatus)
+	}
+}
+
+// tunnelCommand handles 'tunnel [ports...]': forwarding local ports to the Manager VM until interrupted.
+func tunnelCommand(ctx context.Context, config azconfig.AZConfig, args []string) {
+	var tunnelArgs struct {
+		bind string
+	}
+	flags := flag.NewFlagSet("tunnel", flag.ExitOnError)
+	flags.StringVar(&tunnelArgs.bind, "bind", "127.0.0.1", "Local address to listen on.")
+	flags.Usage = func() {
+		out := flags.Output()
+		fmt.Fprintln(out, "Usage: tunnel [options] [port | localport:remoteport ...]")
+		fmt.Fprintf(out, "Forwards local ports to the Manager VM; by default %s.\n\n", strings.Join(defaultTunnelPorts, ", "))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	portSpecs := flags.Args()
+	if len(portSpecs) == 0 {
+		portSpecs = defaultTunnelPorts
+	}
+	forwards := []azssh.PortForward{}
+	for _, spec := range portSpecs {
+		forward, err := parsePortForward(tunnelArgs.bind, spec)
+		if err != nil {
+			logrus.WithField("port", spec).WithError(err).Error("invalid port")
+			flags.Usage()
+			os.Exit(2)
+		}
+		forwards = append(forwards, forward)
+	}
+
+	requireDeployment(ctx, config)
+	ssh, _ := connectToManager(ctx, config, managerVMName(config))
+	defer ssh.Close()
+
+	logrus.Info("tunnel is open, press Ctrl+C to close it")
+	ssh.Tunnel(ctx, forwards)
+}
+
+// parsePortForward parses "port" or "localport:remoteport". The remote port is on the VM itself.
+func parsePortForward(bindAddress, spec string) (azssh.PortForward, error) {
+	localPort, remotePort := spec, spec
+	if parts := strings.SplitN(spec, ":", 2); len(parts) == 2 {
+		localPort, remotePort = parts[0], parts[1]
+	}
+	for _, port := range []string{localPort, remotePort} {
+		if number, err := strconv.Atoi(port); err != nil || number <= 0 || number > 65535 {
+			return azssh.PortForward{}, fmt.Errorf("%q is not a valid port number", port)
+		}
+	}
+	return azssh.PortForward{
+		LocalAddress:  net.JoinHostPort(bindAddress, localPort),
+		RemoteAddress: net.JoinHostPort("localhost", remotePort),
+	}, nil
+}
+
+// logSources maps the names accepted by the 'logs' command to systemd units.
+// The "install" source is not a unit; see installLogCommand().
+var logSources = map[string]string{
+	"manager": "flamenco-manager",
+	"mongod":  "mongod",
+}
+
+// logsCommand handles 'logs [source...]': showing the logs of the Manager VM.
+func logsCommand(ctx context.Context, config azconfig.AZConfig, args []string) {
+	var logsArgs struct {
+		since  string
+		follow bool
+		grep   string
+		lines  int
+	}
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	flags.StringVar(&logsArgs.since, "since", "", "Only show entries since this time, like \"2019-06-01 12:00\" or \"-1h\"; see journalctl(1).")
+	flags.BoolVar(&logsArgs.follow, "follow", false, "Keep showing new entries until Ctrl+C is pressed.")
+	flags.StringVar(&logsArgs.grep, "grep", "", "Only show lines matching this regular expression.")
+	flags.IntVar(&logsArgs.lines, "lines", 100, "Number of most recent lines to show; 0 shows everything.")
+	flags.Usage = func() {
+		out := flags.Output()
+		fmt.Fprintln(out, "Usage: logs [options] [manager] [mongod] [install]")
+		fmt.Fprintln(out, "Shows logs of the Manager VM; by default those of Flamenco Manager.")
+		fmt.Fprintln(out)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var grep *regexp.Regexp
+	if logsArgs.grep != "" {
+		var err error
+		if grep, err = regexp.Compile(logsArgs.grep); err != nil {
+			logrus.WithField("grep", logsArgs.grep).WithError(err).Error("invalid regular expression")
+			os.Exit(2)
+		}
+	}
+
+	sources := flags.Args()
+	if len(sources) == 0 {
+		sources = []string{"manager"}
+	}
+	commands := []string{}
+	units := []string{}
+	for _, source := range sources {
+		if source == "install" {
+			commands = append(commands, installLogCommand(config, logsArgs.follow, logsArgs.lines))
+			continue
+		}
+		unit, ok := logSources[source]
+		if !ok {
+			logrus.WithField("source", source).Error("unknown log source")
+			flags.Usage()
+			os.Exit(2)
+		}
+		units = append(units, unit)
+	}
+	if len(units) > 0 {
+		commands = append(commands, journalCommand(units, logsArgs.since, logsArgs.follow, logsArgs.lines))
+	} else if logsArgs.since != "" {
+		logrus.Warning("-since only applies to the manager and mongod logs")
+	}
+
+	requireDeployment(ctx, config)
+	ssh, _ := connectToManager(ctx, config, managerVMName(config))
+	defer ssh.Close()
+
+	printMutex := sync.Mutex{}
+	printLine := func(channel, line string) {
+		if grep != nil && !grep.MatchString(line) {
+			return
+		}
+		printMutex.Lock()
+		defer printMutex.Unlock()
+		if channel == "stderr" {
+			fmt.Fprintln(os.Stderr, line)
+		} else {
+			fmt.Println(line)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for _, command := range commands {
+		wg.Add(1)
+		go func(command string) {
+			defer wg.Done()
+			if err := ssh.Stream(ctx, command, 0, printLine); err != nil {
+				logrus.WithField("command", command).WithError(err).Error("unable to show logs")
+			}
+		}(command)
+	}
+	wg.Wait()
+}
+
+// journalCommand returns the shell command that shows the journal of the given systemd units.
+func journalCommand(units []string, since string, follow bool, lines int) string {
+	command := "sudo journalctl --no-pager --output=short-iso"
+	for _, unit := range units {
+		command += " --unit=" + unit
+	}
+	if since != "" {
+		command += " --since=" + azssh.ShellQuote(since)
+	}
+	if lines > 0 {
+		command += fmt.Sprintf(" --lines=%d", lines)
+	}
+	if follow {
+		command += " --follow"
+	}
+	return command
+}
+
+// installLogCommand returns the shell command that shows the output of the installation script.
+// Where that output is depends on how the VM was provisioned.
+func installLogCommand(config azconfig.AZConfig, follow bool, lines int) string {
+	logFile := flamenco.InstallLogFile
+	if config.ProvisioningMode() == azconfig.ProvisionCloudInit {
+		logFile = flamenco.ProvisionLogFile
+	}
+
+	command := "sudo tail"
+	if lines > 0 {
+		command += fmt.Sprintf(" --lines=%d", lines)
+	} else {
+		command += " --lines=+1"
+	}
+	if follow {
+		command += " --follow=name --retry"
+	}
+	return command + " " + logFile
+}
@@ -0,0 +1,61 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package textio
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// ReadPassword reads a line from stdin without echoing it, for passphrases and such.
+func ReadPassword(ctx context.Context, prompt string) ([]byte, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	fmt.Printf("%s: ", prompt)
+
+	type result struct {
+		password []byte
+		err      error
+	}
+	resultChan := make(chan result)
+	go func() {
+		password, err := term.ReadPassword(int(os.Stdin.Fd()))
+		resultChan <- result{password, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		fmt.Println("aborted")
+		return nil, false
+	case res := <-resultChan:
+		fmt.Println()
+		if res.err != nil {
+			return nil, false
+		}
+		return res.password, true
+	}
+}
@@ -58,6 +58,16 @@ func ReadLineWithDefault(ctx context.Context, prompt, defaultValue string) strin
 	return line
 }
 
+// Confirm asks a yes/no question, and returns true only when the user answers yes.
+func Confirm(ctx context.Context, prompt string) bool {
+	line, ok := readline(ctx, prompt+" [y/N]")
+	if !ok {
+		return false
+	}
+	answer := strings.ToLower(line)
+	return answer == "y" || answer == "yes"
+}
+
 func readline(ctx context.Context, prompt string) (string, bool) {
 	mutex.Lock()
 	defer mutex.Unlock()
@@ -0,0 +1,155 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/Azure/flamenco-manager-azure/azbatch"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/flamenco-manager-azure/azstorage"
+	"github.com/Azure/flamenco-manager-azure/flamenco"
+	"github.com/sirupsen/logrus"
+)
+
+// upgradeCommand handles 'upgrade': installing other Flamenco Manager and Worker versions on an
+// existing deployment. The versions are stored in the config file once the upgrade succeeded.
+func upgradeCommand(ctx context.Context, config azconfig.AZConfig, args []string) {
+	var upgradeArgs struct {
+		managerVersion string
+		managerURL     string
+		managerSHA256  string
+		workerVersion  string
+		workerURL      string
+		workerSHA256   string
+		rebootBatch    int
+		noReboot       bool
+	}
+	flags := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	flags.StringVar(&upgradeArgs.managerVersion, "manager", "", "Flamenco Manager version to install. Defaults to the version in the config file.")
+	flags.StringVar(&upgradeArgs.managerURL, "manager-url", "", "Download URL of the Flamenco Manager archive, in which {version} is replaced by the version.")
+	flags.StringVar(&upgradeArgs.managerSHA256, "manager-sha256", "", "SHA256 checksum of the Flamenco Manager archive.")
+	flags.StringVar(&upgradeArgs.workerVersion, "worker", "", "Flamenco Worker version to install. Defaults to the version in the config file.")
+	flags.StringVar(&upgradeArgs.workerURL, "worker-url", "", "Download URL of the Flamenco Worker archive, in which {version} is replaced by the version.")
+	flags.StringVar(&upgradeArgs.workerSHA256, "worker-sha256", "", "SHA256 checksum of the Flamenco Worker archive.")
+	flags.IntVar(&upgradeArgs.rebootBatch, "reboot-batch", 1, "Number of worker nodes to reboot at the same time.")
+	flags.BoolVar(&upgradeArgs.noReboot, "no-reboot", false, "Don't reboot the worker nodes; they pick up the new Worker when they restart.")
+	flags.Usage = func() {
+		out := flags.Output()
+		fmt.Fprintln(out, "Usage: upgrade [options]")
+		fmt.Fprintln(out, "Installs Flamenco Manager and Worker versions next to the current ones and switches to them.")
+		fmt.Fprintln(out, "Flamenco Manager is restarted, and rolled back when it doesn't come up. The worker nodes")
+		fmt.Fprintln(out, "are rebooted a few at a time when the Worker version changed.")
+		fmt.Fprintln(out)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	requireDeployment(ctx, config)
+	if config.ComponentVersions == nil {
+		config.ComponentVersions = &azconfig.AZComponentsConfig{}
+	}
+	setComponentVersion(&config.ComponentVersions.Manager, azconfig.ComponentManager,
+		upgradeArgs.managerVersion, upgradeArgs.managerURL, upgradeArgs.managerSHA256)
+	setComponentVersion(&config.ComponentVersions.Worker, azconfig.ComponentWorker,
+		upgradeArgs.workerVersion, upgradeArgs.workerURL, upgradeArgs.workerSHA256)
+
+	// Resolving the components validates the versions before anything is changed.
+	components := map[string]azconfig.Component{}
+	for _, component := range config.Components() {
+		components[component.ID] = component
+	}
+	manager := components[azconfig.ComponentManager]
+	worker := components[azconfig.ComponentWorker]
+	logger := logrus.WithFields(logrus.Fields{
+		"managerVersion": manager.Version,
+		"workerVersion":  worker.Version,
+	})
+
+	if config.ComponentCacheDir() != "" {
+		azstorage.GetCredentials(ctx, &config)
+		defer azstorage.AllowOperatorAccess(ctx, config)()
+		archives := flamenco.FillComponentCache(ctx, config)
+		azstorage.UploadComponentCache(ctx, config, archives)
+	}
+
+	ssh, _ := connectToManager(ctx, config, managerVMName(config))
+	workerLink := path.Join("/mnt/flamenco-resources/apps", worker.Name)
+	previousWorker := ssh.ReadLink(workerLink)
+	logger.Info("upgrading Flamenco on the Manager VM")
+	ssh.Upgrade(ctx, flamenco.RenderComponentsFile(config))
+	ssh.Close()
+
+	config.Save()
+	logger.Info("Flamenco Manager upgraded; versions saved in configuration file")
+
+	switch {
+	case upgradeArgs.noReboot:
+		logger.Info("not rebooting the worker nodes")
+	case path.Base(previousWorker) == worker.Dir():
+		logger.Info("Flamenco Worker version did not change, not rebooting the worker nodes")
+	default:
+		azbatch.RollingReboot(ctx, config, upgradeArgs.rebootBatch)
+	}
+	logger.Info("upgrade complete")
+}
+
+// setComponentVersion changes the version of a component in the config. The checksum of the
+// previous version is only kept when the version stays the same. A custom URL is only kept when it
+// contains "{version}"; otherwise it would download the previous archive, so a new URL is required.
+func setComponentVersion(configured **azconfig.AZComponentConfig, name, version, url, sha256 string) {
+	logger := logrus.WithField("component", name)
+	if version == "" {
+		if url != "" || sha256 != "" {
+			logger.Fatal("a URL or checksum can only be given together with a version")
+		}
+		return
+	}
+
+	previous := azconfig.AZComponentConfig{}
+	if *configured != nil {
+		previous = **configured
+	}
+	updated := azconfig.AZComponentConfig{Version: version, URL: url}
+	if version == previous.Version {
+		updated.SHA256 = previous.SHA256
+		updated.SkipChecksum = previous.SkipChecksum
+	}
+	if updated.URL == "" {
+		if version != previous.Version && previous.URL != "" && !strings.Contains(previous.URL, "{version}") {
+			logger.WithFields(logrus.Fields{
+				"version": version,
+				"url":     previous.URL,
+			}).Fatal("the configured download URL is for another version; give the URL of the new version as well")
+		}
+		updated.URL = previous.URL
+	}
+	if sha256 != "" {
+		updated.SHA256 = sha256
+	}
+	*configured = &updated
+}
@@ -0,0 +1,238 @@
+/* (c) 2019, Blender Foundation
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Azure/flamenco-manager-azure/azauth"
+	"github.com/Azure/flamenco-manager-azure/azconfig"
+	"github.com/Azure/flamenco-manager-azure/aznetwork"
+	"github.com/Azure/flamenco-manager-azure/flamenco"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Obtaining the ACME certificate can take a while after Flamenco Manager started.
+	verifyTimeout        = 10 * time.Minute
+	verifyPollInterval   = 10 * time.Second
+	verifyRequestTimeout = 30 * time.Second
+)
+
+// verificationCheck is the outcome of one of the checks done after deployment.
+type verificationCheck struct {
+	name   string
+	passed bool
+	detail string
+	// Where to look when the check failed.
+	hints []string
+}
+
+// serviceStatusFunc returns the state of the systemd units on the Manager VM.
+type serviceStatusFunc func(units []string) ([]flamenco.ServiceStatus, error)
+
+// verifyDeployment checks that Flamenco Manager serves a valid TLS certificate and that its services
+// are running, and prints a report. It returns whether all checks passed.
+func verifyDeployment(ctx context.Context, config azconfig.AZConfig, netStack aznetwork.NetworkStack,
+	serviceStatus serviceStatusFunc) bool {
+
+	checks := checkManagerServices(serviceStatus)
+	managerRunning := len(checks) > 0 && checks[0].passed
+	fqdn := config.ManagerFQDN(netStack.FQDN())
+	url := fmt.Sprintf("https://%s/", fqdn)
+	if managerRunning {
+		httpsCheck := checkManagerHTTPS(ctx, url, fqdn, *netStack.PublicIP.IPAddress)
+		// Waiting for the certificate can take minutes, in which a service may have crashed; report
+		// the state after that.
+		checks = append(checkManagerServices(serviceStatus), httpsCheck)
+	} else {
+		checks = append(checks, verificationCheck{
+			name:   url,
+			detail: "not checked, as Flamenco Manager is not running",
+		})
+	}
+
+	allPassed := true
+	fmt.Println("Deployment verification:")
+	for _, check := range checks {
+		result := "PASS"
+		if !check.passed {
+			result = "FAIL"
+			allPassed = false
+		}
+		fmt.Printf("  [%s] %s: %s\n", result, check.name, check.detail)
+		if check.passed {
+			continue
+		}
+		for _, hint := range check.hints {
+			fmt.Printf("         %s\n", hint)
+		}
+	}
+	return allPassed
+}
+
+// checkManagerServices returns a check per service in flamenco.ManagerServices, in that order.
+func checkManagerServices(serviceStatus serviceStatusFunc) []verificationCheck {
+	installLog := logsHint("install")
+	statuses, err := serviceStatus(flamenco.ManagerServices)
+	if err != nil {
+		logrus.WithError(err).Warning("unable to query the state of the services on the Manager VM")
+	}
+
+	checks := []verificationCheck{}
+	for _, unit := range flamenco.ManagerServices {
+		check := verificationCheck{
+			name:   unit,
+			detail: "state unknown",
+			hints:  []string{logsHint(logSourceOfUnit(unit)), installLog},
+		}
+		for _, status := range statuses {
+			if status.Unit == unit {
+				check.passed = status.Healthy()
+				check.detail = status.String()
+			}
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// checkManagerHTTPS polls the URL until it is served with a valid TLS certificate, or the timeout expires.
+func checkManagerHTTPS(ctx context.Context, url, fqdn, publicIP string) verificationCheck {
+	check := verificationCheck{
+		name:  url,
+		hints: []string{logsHint(logSourceOfUnit("flamenco-manager")) + " for ACME errors"},
+	}
+	logger := logrus.WithFields(logrus.Fields{
+		"url":     url,
+		"timeout": verifyTimeout,
+	})
+	logger.Info("waiting for Flamenco Manager to serve a valid TLS certificate")
+
+	client := azauth.HTTPClient()
+	client.Timeout = verifyRequestTimeout
+	deadline := time.Now().Add(verifyTimeout)
+	var lastErr error
+	for {
+		lastErr = getWithValidCertificate(ctx, client, url, &check)
+		if lastErr == nil {
+			check.passed = true
+			return check
+		}
+		logger.WithError(lastErr).Debug("Flamenco Manager not available via HTTPS yet")
+
+		if time.Now().After(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			check.detail = "aborted"
+			return check
+		case <-time.After(verifyPollInterval):
+		}
+	}
+
+	check.detail = describeHTTPSError(lastErr, fqdn)
+	if addresses, err := net.LookupHost(fqdn); err == nil && !containsString(addresses, publicIP) {
+		check.hints = append(check.hints, fmt.Sprintf("check the DNS record of %s, it does not resolve to %s", fqdn, publicIP))
+	}
+	return check
+}
+
+// getWithValidCertificate does a GET request, and describes the server certificate in check.detail.
+// Certificates are verified by the HTTP client, so a request that succeeds has a valid certificate.
+func getWithValidCertificate(ctx context.Context, client *http.Client, url string, check *verificationCheck) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 500 {
+		return fmt.Errorf("server responded with %s", response.Status)
+	}
+	if response.TLS == nil || len(response.TLS.PeerCertificates) == 0 {
+		return errors.New("no TLS certificate received")
+	}
+
+	cert := response.TLS.PeerCertificates[0]
+	check.detail = fmt.Sprintf("%s, certificate issued by %q, valid until %s",
+		response.Status, cert.Issuer.CommonName, cert.NotAfter.Format("2006-01-02"))
+	return nil
+}
+
+// describeHTTPSError explains the most likely cause of the error.
+func describeHTTPSError(err error, fqdn string) string {
+	var (
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+		dnsErr       *net.DNSError
+	)
+	switch {
+	case errors.As(err, &authorityErr):
+		return "the certificate is not trusted; the ACME certificate was probably not issued"
+	case errors.As(err, &hostnameErr):
+		return fmt.Sprintf("the certificate is not valid for %s", fqdn)
+	case errors.As(err, &invalidErr):
+		return fmt.Sprintf("the certificate is invalid: %v", invalidErr)
+	case errors.As(err, &dnsErr):
+		return fmt.Sprintf("%s does not resolve; a new DNS record can take a while to propagate", fqdn)
+	default:
+		return fmt.Sprintf("not reachable in %v: %v", verifyTimeout, err)
+	}
+}
+
+// logSourceOfUnit returns the source name of the systemd unit for the 'logs' command.
+func logSourceOfUnit(unit string) string {
+	for source, logUnit := range logSources {
+		if logUnit == unit {
+			return source
+		}
+	}
+	return unit
+}
+
+// logsHint points to the command that shows the logs of the source.
+func logsHint(source string) string {
+	return fmt.Sprintf("see '%s logs %s'", os.Args[0], source)
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, value := range haystack {
+		if value == needle {
+			return true
+		}
+	}
+	return false
+}